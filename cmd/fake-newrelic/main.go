@@ -0,0 +1,32 @@
+// fake-newrelic serves the newrelictest fake on a port so the adapter can be run against it, e.g. in kind:
+//
+//   fake-newrelic --address :8081 --fixtures fixtures.yml
+package main
+
+import (
+	"flag"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelictest"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+func main() {
+	address := flag.String("address", ":8081", "address to listen on")
+	fixturesPath := flag.String("fixtures", "", "YAML file of apps, hosts, NRQL results and faults to serve")
+	flag.Parse()
+
+	fake := newrelictest.NewFake()
+	if *fixturesPath != "" {
+		fixtures, err := newrelictest.LoadFixtures(*fixturesPath)
+		if err != nil {
+			glog.Fatalf("unable to load fixtures: %v", err)
+		}
+
+		if err := fake.Load(fixtures); err != nil {
+			glog.Fatalf("unable to load fixtures: %v", err)
+		}
+	}
+
+	glog.Infof("Serving fake New Relic on %s with apps %v", *address, fake.Apps())
+	glog.Fatal(http.ListenAndServe(*address, fake))
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"strconv"
+)
+
+// ApiKey returns the configured API key, read from ApiKeyFile when one is set
+func (c *Config) ApiKey() (string, error) {
+	if c.NewRelic.ApiKeyFile != "" {
+		return newrelic.ReadApiKeyFile(c.NewRelic.ApiKeyFile)
+	}
+
+	return c.NewRelic.ApiKey, nil
+}
+
+// NewApi returns an Api for apiKey set up as the newrelic section describes, the config must have been validated
+func (c *Config) NewApi(apiKey string, client newrelic.GetApiRequest) *newrelic.Api {
+	var api *newrelic.Api
+	if c.NewRelic.ApiKeyType == ApiKeyTypeUser {
+		api = newrelic.NewUserKeyApi(apiKey, c.NewRelic.MinRpm, client)
+	} else {
+		api = newrelic.NewApi(apiKey, c.NewRelic.MinRpm, client)
+	}
+
+	// the region was validated with the rest of the config
+	api.UseRegion(c.NewRelic.Region)
+	if c.NewRelic.Endpoint != "" {
+		api.SetEndpoints(newrelic.EndpointsAt(c.NewRelic.Endpoint))
+	}
+
+	api.SetAppIdTTL(c.NewRelic.AppIdCacheTTL.Duration)
+	api.SetRetries(c.NewRelic.Retries, c.NewRelic.RetryBackoff.Duration)
+	api.SetRateLimit(c.NewRelic.RateLimit.limiter())
+	api.SetAccountRateLimits(c.accountRateLimiters)
+	return api
+}
+
+// TelemetryEndpoint returns the Event API URL events are sent to, in the account's region or at newrelic.endpoint
+func (c *Config) TelemetryEndpoint() string {
+	if c.Telemetry.Endpoint != "" {
+		return c.Telemetry.Endpoint
+	}
+
+	// the region was validated with the rest of the config
+	endpoints, _ := newrelic.RegionEndpoints(c.NewRelic.Region)
+	if c.NewRelic.Endpoint != "" {
+		endpoints = newrelic.EndpointsAt(c.NewRelic.Endpoint)
+	}
+
+	accountId := c.Telemetry.AccountID
+	if accountId == 0 {
+		accountId = c.NewRelic.DefaultAccountID
+	}
+
+	return endpoints.EventsUri + "accounts/" + strconv.Itoa(accountId) + "/events"
+}
+
+// limiter returns a limiter for the rate limit, nil when it is disabled
+func (l RateLimit) limiter() *newrelic.RateLimiter {
+	if l.RequestsPerMinute <= 0 {
+		return nil
+	}
+
+	return newrelic.NewRateLimiter(l.RequestsPerMinute, l.Burst, l.MaxWait.Duration)
+}
+
+// accountLimiters returns a limiter for each account rate limit that is enabled
+func (n NewRelic) accountLimiters() map[int]*newrelic.RateLimiter {
+	limiters := map[int]*newrelic.RateLimiter{}
+	for _, limit := range n.AccountRateLimits {
+		if limiter := limit.limiter(); limiter != nil {
+			limiters[limit.AccountID] = limiter
+		}
+	}
+
+	return limiters
+}
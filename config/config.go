@@ -0,0 +1,464 @@
+// Package config loads the adapter's configuration from a versioned YAML or JSON file, with environment variables
+// and flags overriding the file
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Version is the config file version this build understands
+const Version = "v1"
+
+const (
+	ApiKeyTypeRest = "rest"
+	ApiKeyTypeUser = "user"
+)
+
+type Config struct {
+	Version string `json:"version"`
+	NewRelic NewRelic `json:"newrelic"`
+	Provider Provider `json:"provider"`
+	Server Server `json:"server"`
+	HA HA `json:"ha"`
+	Tracing Tracing `json:"tracing"`
+	Telemetry Telemetry `json:"telemetry"`
+	// Metrics are metric definitions served without NewRelicMetric objects, e.g. for clusters without the CRD
+	Metrics []Metric `json:"metrics,omitempty"`
+
+	// accountRateLimiters are built by Validate and shared by every Api made from the config, since an account's
+	// limit applies whichever key is used
+	accountRateLimiters map[int]*newrelic.RateLimiter
+}
+
+type NewRelic struct {
+	// ApiKey should be left out of files that are not Secrets, ApiKeyFile reads it from a mounted Secret instead
+	ApiKey string `json:"apiKey,omitempty"`
+	ApiKeyFile string `json:"apiKeyFile,omitempty"`
+	// ApiKeyFileInterval is how often ApiKeyFile is checked for a rotated key
+	ApiKeyFileInterval Duration `json:"apiKeyFileInterval"`
+	ApiKeyType string `json:"apiKeyType"`
+	Region string `json:"region"`
+	// Endpoint replaces the region's endpoints with a single base URL, e.g. a fake-newrelic server for local testing
+	Endpoint string `json:"endpoint,omitempty"`
+	DefaultAccountID int `json:"defaultAccountId,omitempty"`
+	MinRpm int `json:"minRpm"`
+	// Timeout bounds each request to New Relic
+	Timeout Duration `json:"timeout"`
+	// AppIdCacheTTL is how long app name to ID lookups are reused, 0 disables the cache
+	AppIdCacheTTL Duration `json:"appIdCacheTTL"`
+	// Retries is how many times a request failing with a transport error, a 429 or a 5xx is sent again
+	Retries int `json:"retries"`
+	// RetryBackoff is the wait before the first retry, it doubles for each following one
+	RetryBackoff Duration `json:"retryBackoff"`
+	// RateLimit applies to each API key separately, AccountRateLimits to the NRQL queries made to an account with any key
+	RateLimit RateLimit `json:"rateLimit"`
+	AccountRateLimits []AccountRateLimit `json:"accountRateLimits,omitempty"`
+}
+
+// RateLimit is a token bucket, a RequestsPerMinute of zero disables it
+type RateLimit struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	Burst int `json:"burst"`
+	// MaxWait is how long a request waits for the limiter before failing
+	MaxWait Duration `json:"maxWait"`
+}
+
+type AccountRateLimit struct {
+	AccountID int `json:"accountId"`
+	RateLimit
+}
+
+type Provider struct {
+	Aggregation string `json:"aggregation"`
+	ResolveAppName bool `json:"resolveAppName"`
+	MaxDataAge Duration `json:"maxDataAge"`
+	EnforceAccessPolicy bool `json:"enforceAccessPolicy"`
+	AccessPolicyConfigMap string `json:"accessPolicyConfigMap,omitempty"`
+	CredentialsSecretName string `json:"credentialsSecretName,omitempty"`
+	WatchMetricDefinitions bool `json:"watchMetricDefinitions"`
+	// FailurePolicy is what external metrics serve when New Relic fails, metric definitions can override it
+	FailurePolicy FailurePolicy `json:"failurePolicy"`
+	// Smoothing smooths the values of external metrics, metric definitions can override it
+	Smoothing Smoothing `json:"smoothing"`
+}
+
+// FailurePolicy is Error, LastKnownGood (served for up to MaxAge) or Fallback (serving FallbackValue)
+type FailurePolicy struct {
+	Type string `json:"type"`
+	MaxAge Duration `json:"maxAge,omitempty"`
+	FallbackValue int `json:"fallbackValue,omitempty"`
+}
+
+// Smoothing is EWMA (weighing each value Alpha), Average (of the last Samples values) or Max (over Window), no type
+// serves the values as read
+type Smoothing struct {
+	Type string `json:"type,omitempty"`
+	Alpha float64 `json:"alpha,omitempty"`
+	Samples int `json:"samples,omitempty"`
+	Window Duration `json:"window,omitempty"`
+}
+
+type Server struct {
+	// HttpAddress is where Prometheus metrics and the health probes are served over plain HTTP, empty disables them
+	HttpAddress string `json:"httpAddress"`
+	// ConnectivityMaxAge is how recently New Relic must have answered for the adapter to be ready, older than that
+	// readiness probes New Relic itself
+	ConnectivityMaxAge Duration `json:"connectivityMaxAge"`
+	// ShutdownDelay is how long requests keep being served after SIGTERM while readiness fails, so the pod is taken
+	// out of the Service before the API server stops accepting requests
+	ShutdownDelay Duration `json:"shutdownDelay"`
+	// ShutdownGracePeriod is how long requests in flight may take to finish once the API server stopped accepting
+	// new ones, New Relic calls still running after it are canceled
+	ShutdownGracePeriod Duration `json:"shutdownGracePeriod"`
+}
+
+// HA runs several replicas that elect a leader through a Lease, only the leader reads New Relic and it shares the
+// values with the other replicas through ConfigMaps. Only the values are shared: the last known good values and the
+// smoothing state stay in the leader's memory and start over when another replica takes the lease.
+type HA struct {
+	Enabled bool `json:"enabled"`
+	// Namespace holds the Lease and the ConfigMap, it should be the adapter's own namespace
+	Namespace string `json:"namespace"`
+	LeaseName string `json:"leaseName"`
+	ConfigMapName string `json:"configMapName"`
+	// Shards is how many ConfigMaps named ConfigMapName-N the values are split across
+	Shards int `json:"shards"`
+	LeaseDuration Duration `json:"leaseDuration"`
+	// RefreshInterval is how often the leader reads every value replicas asked for
+	RefreshInterval Duration `json:"refreshInterval"`
+	// MaxAge is how old a shared value may be before it is no longer served
+	MaxAge Duration `json:"maxAge"`
+	// RequestExpiry is how long a value is kept refreshed after it was last asked for
+	RequestExpiry Duration `json:"requestExpiry"`
+	// FollowerWait is how long a follower waits for the leader to read a value it has not shared yet
+	FollowerWait Duration `json:"followerWait"`
+}
+
+// Tracing exports OpenTelemetry spans for metric requests and the New Relic calls serving them
+type Tracing struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, e.g. otel-collector.monitoring:4318, empty disables tracing
+	Endpoint string `json:"endpoint"`
+	// Insecure exports over plain HTTP, for collectors without TLS
+	Insecure bool `json:"insecure"`
+	// SampleRatio is the share of requests traced, between 0 and 1
+	SampleRatio float64 `json:"sampleRatio"`
+	ServiceName string `json:"serviceName"`
+}
+
+// Telemetry reports every metric value served to New Relic as a custom event
+type Telemetry struct {
+	Enabled bool `json:"enabled"`
+	// LicenseKey is an ingest license key, the Event API does not accept REST or user keys
+	LicenseKey string `json:"licenseKey"`
+	// AccountID is the account events are sent to, newrelic.defaultAccountId when unset
+	AccountID int `json:"accountId,omitempty"`
+	// Endpoint replaces the Event API URL built from the region and the account, e.g. for a local stand-in
+	Endpoint string `json:"endpoint,omitempty"`
+	// QueueSize bounds the events waiting to be sent, further events are dropped
+	QueueSize int `json:"queueSize"`
+	// BatchSize is the most events sent in one request
+	BatchSize int `json:"batchSize"`
+	// FlushInterval is the longest an event waits before being sent
+	FlushInterval Duration `json:"flushInterval"`
+}
+
+// Metric is a metric definition in the form of a NewRelicMetric object, its spec is validated by the provider
+type Metric struct {
+	Namespace string `json:"namespace"`
+	Name string `json:"name"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// Duration is a time.Duration written as a string such as 30s or 5m
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\", got %s", data)
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+func (l RateLimit) validate(field string, addProblem func(format string, args ...interface{})) {
+	if l.RequestsPerMinute < 0 {
+		addProblem("%s.requestsPerMinute must not be negative", field)
+	}
+
+	if l.RequestsPerMinute > 0 && l.Burst < 1 {
+		addProblem("%s.burst must be at least 1", field)
+	}
+
+	if l.RequestsPerMinute > 0 && l.MaxWait.Duration <= 0 {
+		addProblem("%s.maxWait must be positive", field)
+	}
+}
+
+func (ha HA) validate(addProblem func(format string, args ...interface{})) {
+	if ha.Namespace == "" || ha.LeaseName == "" || ha.ConfigMapName == "" {
+		addProblem("ha.namespace, ha.leaseName and ha.configMapName must be set")
+	}
+
+	if ha.Shards < 1 {
+		addProblem("ha.shards must be at least 1")
+	}
+
+	if ha.LeaseDuration.Duration < time.Second {
+		addProblem("ha.leaseDuration must be at least 1s")
+	}
+
+	if ha.RefreshInterval.Duration <= 0 {
+		addProblem("ha.refreshInterval must be positive")
+	}
+
+	if ha.MaxAge.Duration <= ha.RefreshInterval.Duration {
+		addProblem("ha.maxAge must be longer than ha.refreshInterval")
+	}
+
+	if ha.RequestExpiry.Duration <= ha.RefreshInterval.Duration {
+		addProblem("ha.requestExpiry must be longer than ha.refreshInterval")
+	}
+
+	if ha.FollowerWait.Duration < 0 {
+		addProblem("ha.followerWait must not be negative")
+	}
+}
+
+func (t Telemetry) validate(defaultAccountId int, addProblem func(format string, args ...interface{})) {
+	if t.LicenseKey == "" {
+		addProblem("telemetry.licenseKey must be set")
+	}
+
+	if t.Endpoint == "" && t.AccountID == 0 && defaultAccountId == 0 {
+		addProblem("telemetry.accountId or newrelic.defaultAccountId must be set unless telemetry.endpoint is")
+	}
+
+	if t.Endpoint != "" {
+		if parsed, err := url.Parse(t.Endpoint); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			addProblem("telemetry.endpoint must be an absolute URL")
+		}
+	}
+
+	if t.QueueSize < 1 || t.BatchSize < 1 {
+		addProblem("telemetry.queueSize and telemetry.batchSize must be at least 1")
+	}
+
+	if t.FlushInterval.Duration <= 0 {
+		addProblem("telemetry.flushInterval must be positive")
+	}
+}
+
+// Default returns the configuration used for anything the file, environment and flags leave unset
+func Default() *Config {
+	return &Config{
+		Version: Version,
+		NewRelic: NewRelic{
+			ApiKeyFileInterval: Duration{30 * time.Second},
+			ApiKeyType: ApiKeyTypeRest,
+			Region: newrelic.RegionUS,
+			Timeout: Duration{30 * time.Second},
+			AppIdCacheTTL: Duration{5 * time.Minute},
+			Retries: 2,
+			RetryBackoff: Duration{500 * time.Millisecond},
+			RateLimit: RateLimit{Burst: 10, MaxWait: Duration{5 * time.Second}},
+		},
+		Provider: Provider{
+			Aggregation: "none",
+			FailurePolicy: FailurePolicy{Type: "Error"},
+		},
+		Server: Server{
+			HttpAddress: ":8080",
+			ConnectivityMaxAge: Duration{5 * time.Minute},
+			ShutdownDelay: Duration{5 * time.Second},
+			ShutdownGracePeriod: Duration{20 * time.Second},
+		},
+		HA: HA{
+			Namespace: "custom-metrics",
+			LeaseName: "newrelic-adapter",
+			ConfigMapName: "newrelic-adapter-values",
+			Shards: 4,
+			LeaseDuration: Duration{15 * time.Second},
+			RefreshInterval: Duration{30 * time.Second},
+			MaxAge: Duration{2 * time.Minute},
+			RequestExpiry: Duration{10 * time.Minute},
+			FollowerWait: Duration{5 * time.Second},
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+			ServiceName: "newrelic-custom-metrics",
+		},
+		Telemetry: Telemetry{
+			QueueSize: 10000,
+			BatchSize: 500,
+			FlushInterval: Duration{10 * time.Second},
+		},
+	}
+}
+
+// LoadFile reads a YAML or JSON config file over the defaults. Unknown fields are rejected so typos are not
+// silently ignored, and the file must declare its version.
+func LoadFile(path string) (*Config, error) {
+	config := Default()
+	if path == "" {
+		return config, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonContents, err := yaml.YAMLToJSON(contents)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	config.Version = ""
+	decoder := json.NewDecoder(bytes.NewReader(jsonContents))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// Validate checks the whole configuration and reports every problem at once
+func (c *Config) Validate() error {
+	problems := []string{}
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Version != Version {
+		addProblem("version must be %q, got %q", Version, c.Version)
+	}
+
+	if c.NewRelic.ApiKey == "" && c.NewRelic.ApiKeyFile == "" {
+		addProblem("newrelic.apiKey or newrelic.apiKeyFile must be set")
+	}
+
+	if c.NewRelic.ApiKeyFile != "" && c.NewRelic.ApiKeyFileInterval.Duration <= 0 {
+		addProblem("newrelic.apiKeyFileInterval must be positive")
+	}
+
+	if c.NewRelic.ApiKeyType != ApiKeyTypeRest && c.NewRelic.ApiKeyType != ApiKeyTypeUser {
+		addProblem("newrelic.apiKeyType must be %s or %s", ApiKeyTypeRest, ApiKeyTypeUser)
+	}
+
+	if !newrelic.ValidRegion(c.NewRelic.Region) {
+		addProblem("newrelic.region must be %s or %s", newrelic.RegionUS, newrelic.RegionEU)
+	}
+
+	if c.NewRelic.Endpoint != "" {
+		endpoint, err := url.Parse(c.NewRelic.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			addProblem("newrelic.endpoint must be an http or https URL")
+		}
+	}
+
+	if c.NewRelic.DefaultAccountID < 0 {
+		addProblem("newrelic.defaultAccountId must not be negative")
+	}
+
+	if c.NewRelic.MinRpm < 0 {
+		addProblem("newrelic.minRpm must not be negative")
+	}
+
+	if c.NewRelic.Timeout.Duration <= 0 {
+		addProblem("newrelic.timeout must be positive")
+	}
+
+	if c.NewRelic.AppIdCacheTTL.Duration < 0 {
+		addProblem("newrelic.appIdCacheTTL must not be negative")
+	}
+
+	if c.NewRelic.Retries < 0 {
+		addProblem("newrelic.retries must not be negative")
+	}
+
+	if c.NewRelic.RetryBackoff.Duration < 0 {
+		addProblem("newrelic.retryBackoff must not be negative")
+	}
+
+	c.NewRelic.RateLimit.validate("newrelic.rateLimit", addProblem)
+	for i, limit := range c.NewRelic.AccountRateLimits {
+		if limit.AccountID <= 0 {
+			addProblem("newrelic.accountRateLimits[%d].accountId must be positive", i)
+		}
+
+		limit.RateLimit.validate(fmt.Sprintf("newrelic.accountRateLimits[%d]", i), addProblem)
+	}
+
+	if c.Server.ConnectivityMaxAge.Duration <= 0 {
+		addProblem("server.connectivityMaxAge must be positive")
+	}
+
+	if c.Server.ShutdownDelay.Duration < 0 || c.Server.ShutdownGracePeriod.Duration < 0 {
+		addProblem("server.shutdownDelay and server.shutdownGracePeriod must not be negative")
+	}
+
+	if c.Provider.Aggregation != "none" && c.Provider.Aggregation != "sum" {
+		addProblem("provider.aggregation must be none or sum")
+	}
+
+	if c.Provider.MaxDataAge.Duration < 0 {
+		addProblem("provider.maxDataAge must not be negative")
+	}
+
+	if c.Provider.AccessPolicyConfigMap != "" && strings.Count(c.Provider.AccessPolicyConfigMap, "/") != 1 {
+		addProblem("provider.accessPolicyConfigMap must be in namespace/name form")
+	}
+
+	if c.HA.Enabled {
+		c.HA.validate(addProblem)
+	}
+
+	if strings.Contains(c.Tracing.Endpoint, "://") {
+		addProblem("tracing.endpoint must be host:port, without a scheme")
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		addProblem("tracing.sampleRatio must be between 0 and 1")
+	}
+
+	if c.Telemetry.Enabled {
+		c.Telemetry.validate(c.NewRelic.DefaultAccountID, addProblem)
+	}
+
+	for i, metric := range c.Metrics {
+		if metric.Namespace == "" || metric.Name == "" {
+			addProblem("metrics[%d] must have a namespace and a name", i)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	c.accountRateLimiters = c.NewRelic.accountLimiters()
+	return nil
+}
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes contents to a temp file, the returned func removes it
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Could not write config: %s", err)
+	}
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func env(values map[string]string) func(key string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+func TestLoadFileYaml(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+version: v1
+newrelic:
+  apiKeyFile: /etc/newrelic/apiKey
+  region: eu
+  timeout: 10s
+provider:
+  aggregation: sum
+  maxDataAge: 10m
+metrics:
+- namespace: marketplace
+  name: errors
+  spec:
+    metricName: marketplace_errors
+    fallbackValue: 0
+`)
+	defer cleanup()
+
+	config, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if config.NewRelic.Region != "eu" || config.NewRelic.Timeout.Duration != 10 * time.Second || config.Provider.MaxDataAge.Duration != 10 * time.Minute {
+		t.Errorf("File values were not loaded, got %+v", config)
+	}
+
+	if config.NewRelic.ApiKeyType != ApiKeyTypeRest || config.NewRelic.AppIdCacheTTL.Duration != 5 * time.Minute {
+		t.Errorf("Expected defaults for values missing from the file, got %+v", config.NewRelic)
+	}
+
+	if len(config.Metrics) != 1 || !strings.Contains(string(config.Metrics[0].Spec), `"metricName":"marketplace_errors"`) {
+		t.Errorf("Expected the metric spec to be kept as JSON, got %+v", config.Metrics)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %s", err)
+	}
+}
+
+func TestLoadFileRejectsUnknownFields(t *testing.T) {
+	path, cleanup := writeConfig(t, "version: v1\nnewrelic:\n  apiKeyFiel: /etc/newrelic/apiKey\n")
+	defer cleanup()
+
+	_, err := LoadFile(path)
+	if err == nil || !strings.Contains(err.Error(), "apiKeyFiel") {
+		t.Errorf("Expected the unknown field to be reported, got %v", err)
+	}
+}
+
+func TestLoadFileRequiresVersion(t *testing.T) {
+	path, cleanup := writeConfig(t, "newrelic:\n  apiKey: abc\n")
+	defer cleanup()
+
+	config, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected a missing version to be invalid, got %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := Default()
+	config.NewRelic.Region = "apac"
+	config.NewRelic.MinRpm = -1
+	config.NewRelic.Endpoint = "localhost:8081"
+	config.NewRelic.RateLimit = RateLimit{RequestsPerMinute: 600}
+	config.NewRelic.AccountRateLimits = []AccountRateLimit{{RateLimit: RateLimit{RequestsPerMinute: 60, Burst: 1, MaxWait: Duration{time.Second}}}}
+	config.Provider.AccessPolicyConfigMap = "policy"
+	config.Server.ShutdownGracePeriod = Duration{-time.Second}
+	config.Tracing.Endpoint = "http://otel-collector:4318"
+	config.Tracing.SampleRatio = 2
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	for _, problem := range []string{"apiKey", "region", "endpoint", "minRpm", "rateLimit.burst", "rateLimit.maxWait", "accountRateLimits[0].accountId", "accessPolicyConfigMap", "shutdownGracePeriod", "tracing.endpoint", "tracing.sampleRatio"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %s to be reported, got %s", problem, err)
+		}
+	}
+}
+
+func TestApplyEnvOverridesFile(t *testing.T) {
+	config := Default()
+	config.NewRelic.MinRpm = 5
+
+	err := config.ApplyEnv(env(map[string]string{"MIN_RPM": "10", "RESOLVE_APP_NAME": "true", "NEWRELIC_API_KEY": "abc"}))
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if config.NewRelic.MinRpm != 10 || !config.Provider.ResolveAppName || config.NewRelic.ApiKey != "abc" {
+		t.Errorf("Expected env values to override, got %+v", config)
+	}
+}
+
+func TestApplyEnvSetsShutdownTimings(t *testing.T) {
+	config := Default()
+
+	err := config.ApplyEnv(env(map[string]string{"SHUTDOWN_DELAY": "10s", "SHUTDOWN_GRACE_PERIOD": "30s"}))
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if config.Server.ShutdownDelay.Duration != 10 * time.Second || config.Server.ShutdownGracePeriod.Duration != 30 * time.Second {
+		t.Errorf("Expected a 10s delay and 30s grace period, got %+v", config.Server)
+	}
+}
+
+func TestApplyEnvRejectsBadValues(t *testing.T) {
+	err := Default().ApplyEnv(env(map[string]string{"MIN_RPM": "lots"}))
+	if err == nil || !strings.Contains(err.Error(), "MIN_RPM") {
+		t.Errorf("Expected MIN_RPM to be rejected, got %v", err)
+	}
+}
+
+func TestFlagsTakePrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, "version: v1\nnewrelic:\n  apiKey: abc\n  minRpm: 5\n  region: eu\n")
+	defer cleanup()
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags := BindFlags(fs)
+	if err := fs.Parse([]string{"--config", path, "--min-rpm", "20"}); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	config, err := flags.Load(env(map[string]string{"MIN_RPM": "10"}))
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if config.NewRelic.MinRpm != 20 {
+		t.Errorf("Expected the flag to win, got %d", config.NewRelic.MinRpm)
+	}
+
+	if config.NewRelic.Region != "eu" {
+		t.Errorf("Expected flags that were not given to leave the file value, got %s", config.NewRelic.Region)
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	config, err := LoadFile("../examples/config.yml")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected the example to be valid, got %s", err)
+	}
+}
+
+func TestValidateBuildsAccountLimitersPerConfig(t *testing.T) {
+	newConfig := func() *Config {
+		config := Default()
+		config.NewRelic.ApiKey = "abc"
+		config.NewRelic.AccountRateLimits = []AccountRateLimit{{AccountID: 42, RateLimit: RateLimit{RequestsPerMinute: 60, Burst: 1, MaxWait: Duration{time.Second}}}}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("There was an error: %s", err)
+		}
+
+		return config
+	}
+
+	config := newConfig()
+	copied := *config
+	if config.accountRateLimiters[42] == nil || copied.accountRateLimiters[42] != config.accountRateLimiters[42] {
+		t.Errorf("Expected a copy of the config to share its account limiters")
+	}
+
+	if other := newConfig(); other.accountRateLimiters[42] == config.accountRateLimiters[42] {
+		t.Errorf("Expected another config to have its own account limiters")
+	}
+}
+
+func TestValidateHA(t *testing.T) {
+	config := Default()
+	config.NewRelic.ApiKey = "abc"
+	config.HA.MaxAge = Duration{10 * time.Second}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected HA settings to be ignored while HA is disabled, got %s", err)
+	}
+
+	config.HA.Enabled = true
+	config.HA.LeaseName = ""
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "ha.leaseName") || !strings.Contains(err.Error(), "ha.maxAge") {
+		t.Errorf("Expected the lease name and max age to be reported, got %v", err)
+	}
+}
+
+func TestTelemetryEndpoint(t *testing.T) {
+	config := Default()
+	config.NewRelic.ApiKey = "abc"
+	config.NewRelic.DefaultAccountID = 1234
+	config.Telemetry.Enabled = true
+	config.Telemetry.LicenseKey = "license"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if endpoint := config.TelemetryEndpoint(); endpoint != "https://insights-collector.newrelic.com/v1/accounts/1234/events" {
+		t.Errorf("Expected the US Event API of the default account, got %s", endpoint)
+	}
+
+	config.NewRelic.Region = "eu"
+	config.Telemetry.AccountID = 5678
+	if endpoint := config.TelemetryEndpoint(); endpoint != "https://insights-collector.eu01.nr-data.net/v1/accounts/5678/events" {
+		t.Errorf("Expected the EU Event API of the telemetry account, got %s", endpoint)
+	}
+
+	config.NewRelic.Endpoint = "http://localhost:8081"
+	if endpoint := config.TelemetryEndpoint(); endpoint != "http://localhost:8081/v1/accounts/5678/events" {
+		t.Errorf("Expected events to go to the stand-in New Relic, got %s", endpoint)
+	}
+
+	config.Telemetry.LicenseKey = ""
+	config.Telemetry.BatchSize = 0
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "telemetry.licenseKey") || !strings.Contains(err.Error(), "telemetry.batchSize") {
+		t.Errorf("Expected the license key and batch size to be reported, got %v", err)
+	}
+}
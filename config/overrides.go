@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"strconv"
+	"time"
+)
+
+// envOverrides are the environment variables the adapter was configured with before the config file existed, they
+// keep working and take precedence over the file
+var envOverrides = map[string]func(c *Config, value string) error{
+	"NEWRELIC_API_KEY": setString(func(c *Config) *string { return &c.NewRelic.ApiKey }),
+	"NEWRELIC_API_KEY_FILE": setString(func(c *Config) *string { return &c.NewRelic.ApiKeyFile }),
+	"NEWRELIC_API_KEY_TYPE": setString(func(c *Config) *string { return &c.NewRelic.ApiKeyType }),
+	"NEWRELIC_REGION": setString(func(c *Config) *string { return &c.NewRelic.Region }),
+	"NEWRELIC_ENDPOINT": setString(func(c *Config) *string { return &c.NewRelic.Endpoint }),
+	"NEWRELIC_TIMEOUT": setDuration(func(c *Config) *Duration { return &c.NewRelic.Timeout }),
+	"APP_ID_CACHE_TTL": setDuration(func(c *Config) *Duration { return &c.NewRelic.AppIdCacheTTL }),
+	"NEWRELIC_RETRIES": setInt(func(c *Config) *int { return &c.NewRelic.Retries }),
+	"NEWRELIC_RATE_LIMIT": setInt(func(c *Config) *int { return &c.NewRelic.RateLimit.RequestsPerMinute }),
+	"DEFAULT_ACCOUNT_ID": setInt(func(c *Config) *int { return &c.NewRelic.DefaultAccountID }),
+	"MIN_RPM": setInt(func(c *Config) *int { return &c.NewRelic.MinRpm }),
+	"APP_AGGREGATION": setString(func(c *Config) *string { return &c.Provider.Aggregation }),
+	"RESOLVE_APP_NAME": setBool(func(c *Config) *bool { return &c.Provider.ResolveAppName }),
+	"MAX_DATA_AGE": setDuration(func(c *Config) *Duration { return &c.Provider.MaxDataAge }),
+	"ENFORCE_ACCESS_POLICY": setBool(func(c *Config) *bool { return &c.Provider.EnforceAccessPolicy }),
+	"ACCESS_POLICY_CONFIGMAP": setString(func(c *Config) *string { return &c.Provider.AccessPolicyConfigMap }),
+	"CREDENTIALS_SECRET_NAME": setString(func(c *Config) *string { return &c.Provider.CredentialsSecretName }),
+	"WATCH_METRIC_DEFINITIONS": setBool(func(c *Config) *bool { return &c.Provider.WatchMetricDefinitions }),
+	"HTTP_ADDRESS": setString(func(c *Config) *string { return &c.Server.HttpAddress }),
+	"SHUTDOWN_DELAY": setDuration(func(c *Config) *Duration { return &c.Server.ShutdownDelay }),
+	"SHUTDOWN_GRACE_PERIOD": setDuration(func(c *Config) *Duration { return &c.Server.ShutdownGracePeriod }),
+	"HA_ENABLED": setBool(func(c *Config) *bool { return &c.HA.Enabled }),
+	"POD_NAMESPACE": setString(func(c *Config) *string { return &c.HA.Namespace }),
+	"TRACING_ENDPOINT": setString(func(c *Config) *string { return &c.Tracing.Endpoint }),
+	"TELEMETRY_ENABLED": setBool(func(c *Config) *bool { return &c.Telemetry.Enabled }),
+	"TELEMETRY_ENDPOINT": setString(func(c *Config) *string { return &c.Telemetry.Endpoint }),
+	"NEWRELIC_LICENSE_KEY": setString(func(c *Config) *string { return &c.Telemetry.LicenseKey }),
+}
+
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 10m")
+		}
+
+		field(c).Duration = parsed
+		return nil
+	}
+}
+
+// ApplyEnv overrides the configuration with the environment variables that are set
+func (c *Config) ApplyEnv(getenv func(key string) string) error {
+	for name, apply := range envOverrides {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+
+		if err := apply(c, value); err != nil {
+			return fmt.Errorf("%s %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Flags are the command line flags choosing and overriding the config file
+type Flags struct {
+	// Path is the config file, the defaults are used when it is empty
+	Path string
+	// ValidateOnly checks the configuration and exits instead of starting the adapter
+	ValidateOnly bool
+
+	flags *pflag.FlagSet
+	overrides []func(c *Config)
+}
+
+// BindFlags registers the config flags on fs. Overrides only apply when the flag is given, so a flag's default never
+// replaces a value from the file or the environment.
+func BindFlags(fs *pflag.FlagSet) *Flags {
+	f := &Flags{flags: fs}
+	fs.StringVar(&f.Path, "config", "", "path to a YAML or JSON config file")
+	fs.BoolVar(&f.ValidateOnly, "validate-config", false, "validate the configuration and exit")
+
+	apiKeyFile := fs.String("newrelic-api-key-file", "", "file holding the New Relic API key, overrides newrelic.apiKeyFile")
+	region := fs.String("newrelic-region", "", "New Relic region (us or eu), overrides newrelic.region")
+	timeout := fs.Duration("newrelic-timeout", 0, "timeout for New Relic requests, overrides newrelic.timeout")
+	minRpm := fs.Int("min-rpm", 0, "minimum RPM for a host to be averaged, overrides newrelic.minRpm")
+	aggregation := fs.String("app-aggregation", "", "how values of several apps are combined (none or sum), overrides provider.aggregation")
+	maxDataAge := fs.Duration("max-data-age", 0, "oldest New Relic data that is served, overrides provider.maxDataAge")
+	httpAddress := fs.String("http-address", "", "address metrics and probes are served on, overrides server.httpAddress")
+	watchDefinitions := fs.Bool("watch-metric-definitions", false, "serve NewRelicMetric objects, overrides provider.watchMetricDefinitions")
+
+	f.override("newrelic-api-key-file", func(c *Config) { c.NewRelic.ApiKeyFile = *apiKeyFile })
+	f.override("newrelic-region", func(c *Config) { c.NewRelic.Region = *region })
+	f.override("newrelic-timeout", func(c *Config) { c.NewRelic.Timeout.Duration = *timeout })
+	f.override("min-rpm", func(c *Config) { c.NewRelic.MinRpm = *minRpm })
+	f.override("app-aggregation", func(c *Config) { c.Provider.Aggregation = *aggregation })
+	f.override("max-data-age", func(c *Config) { c.Provider.MaxDataAge.Duration = *maxDataAge })
+	f.override("http-address", func(c *Config) { c.Server.HttpAddress = *httpAddress })
+	f.override("watch-metric-definitions", func(c *Config) { c.Provider.WatchMetricDefinitions = *watchDefinitions })
+
+	return f
+}
+
+func (f *Flags) override(name string, apply func(c *Config)) {
+	f.overrides = append(f.overrides, func(c *Config) {
+		if f.flags.Changed(name) {
+			apply(c)
+		}
+	})
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the flags, in increasing
+// order of precedence, and validates it
+func (f *Flags) Load(getenv func(key string) string) (*Config, error) {
+	config, err := LoadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.ApplyEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, apply := range f.overrides {
+		apply(config)
+	}
+
+	return config, config.Validate()
+}
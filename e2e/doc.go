@@ -0,0 +1,3 @@
+// Package e2e tests the adapter as HPAs see it: the custom metrics API server runs in-process with the provider,
+// New Relic is the newrelictest fake and requests go through the external metrics client over HTTP.
+package e2e
@@ -0,0 +1,191 @@
+package e2e
+
+import (
+	"encoding/base64"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelictest"
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/discovery"
+	"testing"
+	"time"
+)
+
+func TestExternalMetricRpm(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{})
+	defer stop()
+
+	a.newRelic.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+
+	values, err := a.externalMetrics("marketplace").List("rpm", selector(t, "appName", selection.Equals, "marketplace-prod"))
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if len(values.Items) != 1 || values.Items[0].Value.Value() != 1200 {
+		t.Fatalf("Expected a single value of 1200, got %+v", values.Items)
+	}
+
+	if values.Items[0].MetricName != "rpm" || values.Items[0].MetricLabels["appName"] != "marketplace-prod" {
+		t.Errorf("Expected rpm labelled with its app, got %s %v", values.Items[0].MetricName, values.Items[0].MetricLabels)
+	}
+}
+
+func TestExternalMetricSelectorMatchesSeveralApps(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{Aggregation: nrProvider.AggregationSum})
+	defer stop()
+
+	a.newRelic.AddApp("marketplace-east").SetMetric("HttpDispatcher", "requests_per_minute", 700)
+	a.newRelic.AddApp("marketplace-west").SetMetric("HttpDispatcher", "requests_per_minute", 500)
+
+	values, err := a.externalMetrics("marketplace").List("rpm", selector(t, "appName", selection.In, "marketplace-east", "marketplace-west"))
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if len(values.Items) != 1 || values.Items[0].Value.Value() != 1200 {
+		t.Errorf("Expected a summed value of 1200, got %+v", values.Items)
+	}
+}
+
+func TestExternalMetricRejectsUnsupportedSelectors(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{})
+	defer stop()
+
+	selectors := map[string]labels.Selector{
+		"notin": selector(t, "appName", selection.NotIn, "marketplace-prod"),
+		"missing appName": labels.NewSelector(),
+	}
+
+	for description, metricSelector := range selectors {
+		_, err := a.externalMetrics("marketplace").List("rpm", metricSelector)
+		if err == nil {
+			t.Errorf("Expected an error for %s", description)
+		}
+	}
+
+	_, err := a.externalMetrics("marketplace").List("rpm", selectors["notin"])
+	if !apierrors.IsBadRequest(err) {
+		t.Errorf("Expected a 400 for an unsupported operator, got %v", err)
+	}
+}
+
+func TestExternalMetricNewRelicFailure(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{})
+	defer stop()
+
+	a.newRelic.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+	a.newRelic.AddFault(newrelictest.Fault{Path: "/metrics/data.json", Status: 503})
+
+	_, err := a.externalMetrics("marketplace").List("rpm", selector(t, "appName", selection.Equals, "marketplace-prod"))
+	if statusErr, ok := err.(apierrors.APIStatus); !ok || statusErr.Status().Code != 500 {
+		t.Errorf("Expected New Relic's failure to be served as a 500, got %v", err)
+	}
+}
+
+func TestExternalMetricLastKnownGood(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{
+		FailurePolicy: nrProvider.FailurePolicy{Type: nrProvider.FailurePolicyLastKnownGood, MaxAge: time.Minute},
+	})
+	defer stop()
+
+	a.newRelic.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+	metricSelector := selector(t, "appName", selection.Equals, "marketplace-prod")
+	if _, err := a.externalMetrics("marketplace").List("rpm", metricSelector); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	a.newRelic.AddFault(newrelictest.Fault{Status: 429})
+	values, err := a.externalMetrics("marketplace").List("rpm", metricSelector)
+	if err != nil {
+		t.Fatalf("Expected the last known good value, got %s", err)
+	}
+
+	if values.Items[0].Value.Value() != 1200 || values.Items[0].MetricLabels[nrProvider.FAILURE_POLICY_LABEL] != string(nrProvider.FailurePolicyLastKnownGood) {
+		t.Errorf("Expected 1200 labelled with the failure policy, got %v %v", values.Items[0].Value, values.Items[0].MetricLabels)
+	}
+}
+
+func TestExternalMetricFromDefinition(t *testing.T) {
+	nrql := "SELECT count(*) FROM Transaction WHERE appName = 'marketplace-prod'"
+	a, stop := startAdapter(t, nrProvider.Options{
+		StaticDefinitions: []nrProvider.StaticDefinition{{
+			Namespace: "marketplace",
+			Name: "transactions",
+			Spec: []byte(`{"metricName":"marketplace-transactions","query":{"nrql":"` + nrql + `","accountId":42}}`),
+		}},
+	})
+	defer stop()
+
+	a.newRelic.SetNrql(42, nrql, 340)
+
+	values, err := a.externalMetrics("marketplace").List("marketplace-transactions", labels.NewSelector())
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if values.Items[0].Value.Value() != 340 {
+		t.Errorf("Expected the NRQL result of 340, got %v", values.Items[0].Value)
+	}
+
+	// definitions are namespaced, other namespaces do not see the metric
+	if _, err := a.externalMetrics("checkout").List("marketplace-transactions", labels.NewSelector()); err == nil {
+		t.Errorf("Expected the metric to be unavailable outside its namespace")
+	}
+}
+
+func TestExternalMetricFromDefinitionWithCredentialsSecret(t *testing.T) {
+	nrql := "SELECT count(*) FROM Transaction WHERE appName = 'checkout-prod'"
+	secret := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind": "Secret",
+		"metadata": map[string]interface{}{"namespace": "checkout", "name": "checkout-newrelic"},
+		"data": map[string]interface{}{
+			"apiKey": base64.StdEncoding.EncodeToString([]byte("checkout-key")),
+		},
+	}}
+
+	a, stop := startAdapter(t, nrProvider.Options{
+		CredentialsSecretName: "newrelic-credentials",
+		StaticDefinitions: []nrProvider.StaticDefinition{{
+			Namespace: "checkout",
+			Name: "transactions",
+			Spec: []byte(`{"metricName":"checkout-transactions","credentialsSecret":"checkout-newrelic","query":{"nrql":"` + nrql + `","accountId":42}}`),
+		}},
+	}, secret)
+	defer stop()
+
+	// only the key in the Secret is accepted, the adapter's own key is empty
+	a.newRelic.ApiKey = "checkout-key"
+	a.newRelic.SetNrql(42, nrql, 25)
+
+	values, err := a.externalMetrics("checkout").List("checkout-transactions", labels.NewSelector())
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if values.Items[0].Value.Value() != 25 {
+		t.Errorf("Expected the NRQL result of 25 read with the Secret's key, got %v", values.Items[0].Value)
+	}
+}
+
+func TestDiscoveryListsExternalMetrics(t *testing.T) {
+	a, stop := startAdapter(t, nrProvider.Options{})
+	defer stop()
+
+	resources, err := discovery.NewDiscoveryClientForConfigOrDie(a.config).ServerResourcesForGroupVersion("external.metrics.k8s.io/v1beta1")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	found := false
+	for _, resource := range resources.APIResources {
+		found = found || resource.Name == "rpm"
+	}
+
+	if !found {
+		t.Errorf("Expected rpm to be discoverable, got %+v", resources.APIResources)
+	}
+}
@@ -0,0 +1,120 @@
+package e2e
+
+import (
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelictest"
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/apiserver"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	fakekubernetes "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/metrics/pkg/client/external_metrics"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// adapter is the custom metrics API server serving a provider backed by a fake New Relic
+type adapter struct {
+	newRelic *newrelictest.Server
+	server *httptest.Server
+	config *rest.Config
+}
+
+// fakeDiscovery advertises the core and apps resources the provider maps custom metrics onto
+func fakeDiscovery() discovery.DiscoveryInterface {
+	return &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*meta1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []meta1.APIResource{
+				{Name: "pods", Kind: "Pod", Namespaced: true},
+				{Name: "namespaces", Kind: "Namespace"},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []meta1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+		},
+	}}}
+}
+
+// startAdapter serves the provider on a local port, objects are what the provider's dynamic client sees. newRelic
+// may be changed while the adapter runs, the returned func stops both.
+func startAdapter(t *testing.T, options nrProvider.Options, objects ...runtime.Object) (*adapter, func()) {
+	newRelic := newrelictest.NewServer()
+
+	newApi := func(apiKey string) *newrelic.Api {
+		api := newrelic.NewApi(apiKey, 1, newrelic.HttpGetClient{Timeout: time.Second})
+		api.SetEndpoints(newRelic.Endpoints())
+		api.SetRetries(0, 0)
+		return api
+	}
+
+	api := newApi("")
+	// the APIs for per-namespace credentials talk to the same fake New Relic
+	if options.NewApi == nil {
+		options.NewApi = func(apiKey string) newrelic.RpmProvider {
+			return newApi(apiKey)
+		}
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(fakeDiscovery())
+	if err != nil {
+		newRelic.Close()
+		t.Fatalf("Could not discover resources: %s", err)
+	}
+
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	metricsProvider := nrProvider.NewProvider(client, restmapper.NewDiscoveryRESTMapper(groupResources), api, options)
+
+	// no authentication or authorization is configured, so every request is allowed as in a cluster where the
+	// HPA controller's requests are authorized
+	genericConfig := genericapiserver.NewConfig(apiserver.Codecs)
+	genericConfig.ExternalAddress = "127.0.0.1:443"
+	genericConfig.LoopbackClientConfig = &rest.Config{}
+	config := apiserver.Config{GenericConfig: genericConfig}
+
+	informerFactory := informers.NewSharedInformerFactory(fakekubernetes.NewSimpleClientset(), 0)
+	server, err := config.Complete(informerFactory).New("newrelic-custom-metrics-e2e", metricsProvider, metricsProvider)
+	if err != nil {
+		newRelic.Close()
+		t.Fatalf("Could not create the API server: %s", err)
+	}
+
+	httpServer := httptest.NewServer(server.GenericAPIServer.Handler)
+	a := &adapter{
+		newRelic: newRelic,
+		server: httpServer,
+		config: &rest.Config{Host: httpServer.URL},
+	}
+
+	return a, func() {
+		httpServer.Close()
+		newRelic.Close()
+	}
+}
+
+func (a *adapter) externalMetrics(namespace string) external_metrics.MetricsInterface {
+	return external_metrics.NewForConfigOrDie(a.config).NamespacedMetrics(namespace)
+}
+
+// selector builds a metric selector the way the HPA controller does from a metric's matchLabels and
+// matchExpressions
+func selector(t *testing.T, key string, op selection.Operator, values ...string) labels.Selector {
+	requirement, err := labels.NewRequirement(key, op, values)
+	if err != nil {
+		t.Fatalf("Invalid selector: %s", err)
+	}
+
+	return labels.NewSelector().Add(*requirement)
+}
@@ -0,0 +1,245 @@
+// Package ha lets several adapter replicas share one set of New Relic requests. The replicas elect a leader through a
+// Lease, the leader alone reads New Relic and publishes the values to a ConfigMap that every replica serves from.
+package ha
+
+import (
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"sync"
+	"time"
+)
+
+var leasesResource = schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1beta1", Resource: "leases"}
+
+// leaseRecord is the part of a Lease that changes when it is renewed or taken over
+type leaseRecord struct {
+	holder string
+	renewTime string
+	transitions int64
+}
+
+// Elector takes part in electing a leader through a Lease. Other holders' renew times are never compared with the
+// local clock, a lease is considered expired once it has not changed for the lease duration, as seen locally.
+type Elector struct {
+	client dynamic.ResourceInterface
+	namespace string
+	name string
+	identity string
+	leaseDuration time.Duration
+	// renewDeadline is how long a leader keeps acting as one without renewing, shorter than the lease duration so it
+	// steps down before another replica may take over
+	renewDeadline time.Duration
+	retryPeriod time.Duration
+
+	lock sync.Mutex
+	observed leaseRecord
+	observedAt time.Time
+	renewedAt time.Time
+}
+
+// NewElector returns an Elector for the Lease namespace/name, identity must be unique to the replica such as its pod name
+func NewElector(client dynamic.Interface, namespace string, name string, identity string, leaseDuration time.Duration) *Elector {
+	return &Elector{
+		client: client.Resource(leasesResource).Namespace(namespace),
+		namespace: namespace,
+		name: name,
+		identity: identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: leaseDuration * 2 / 3,
+		retryPeriod: leaseDuration / 5,
+	}
+}
+
+// Run tries to acquire or renew the lease every retry period until stopCh is closed, then releases it so another
+// replica takes over without waiting for it to expire
+func (e *Elector) Run(stopCh <-chan struct{}) {
+	defer e.release()
+
+	wait.Until(func() {
+		wasLeader := e.IsLeader()
+		e.tryAcquireOrRenew(time.Now())
+
+		isLeader := e.IsLeader()
+		if isLeader != wasLeader {
+			glog.Infof("%s is now %s of lease %s", e.identity, role(isLeader), e.name)
+		}
+
+		if isLeader {
+			leader.Set(1)
+		} else {
+			leader.Set(0)
+		}
+	}, e.retryPeriod, stopCh)
+}
+
+func role(isLeader bool) string {
+	if isLeader {
+		return "leader"
+	}
+
+	return "a follower"
+}
+
+// IsLeader reports whether this replica holds the lease and renewed it recently enough to act as leader
+func (e *Elector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.observed.holder == e.identity && time.Since(e.renewedAt) < e.renewDeadline
+}
+
+// Leader returns the identity of the replica last seen holding the lease
+func (e *Elector) Leader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.observed.holder
+}
+
+func parseLeaseRecord(obj *unstructured.Unstructured) leaseRecord {
+	holder, _, _ := unstructured.NestedString(obj.Object, "spec", "holderIdentity")
+	renewTime, _, _ := unstructured.NestedString(obj.Object, "spec", "renewTime")
+	transitions, _, _ := unstructured.NestedInt64(obj.Object, "spec", "leaseTransitions")
+	return leaseRecord{holder: holder, renewTime: renewTime, transitions: transitions}
+}
+
+// tryAcquireOrRenew creates the lease, renews it or takes it over once it expired. Losing a race for the lease is
+// not an error, the replica that won is seen holding it on the next try.
+func (e *Elector) tryAcquireOrRenew(now time.Time) {
+	obj, err := e.client.Get(e.name, meta1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		e.create(now)
+		return
+	}
+
+	if err != nil {
+		glog.Warningf("Could not get lease %s: %v", e.name, err)
+		return
+	}
+
+	record := parseLeaseRecord(obj)
+
+	e.lock.Lock()
+	if record != e.observed {
+		e.observed = record
+		e.observedAt = now
+	}
+
+	expired := !now.Before(e.observedAt.Add(e.leaseDuration))
+	e.lock.Unlock()
+
+	if record.holder != "" && record.holder != e.identity && !expired {
+		return
+	}
+
+	renewTime := meta1.NewMicroTime(now).Format(meta1.RFC3339Micro)
+	spec := map[string]interface{}{
+		"holderIdentity": e.identity,
+		"leaseDurationSeconds": int64(e.leaseDuration / time.Second),
+		"renewTime": renewTime,
+		"leaseTransitions": record.transitions,
+	}
+
+	if record.holder != e.identity {
+		spec["acquireTime"] = renewTime
+		spec["leaseTransitions"] = record.transitions + 1
+	} else if acquireTime, ok, _ := unstructured.NestedString(obj.Object, "spec", "acquireTime"); ok {
+		spec["acquireTime"] = acquireTime
+	}
+
+	err = unstructured.SetNestedMap(obj.Object, spec, "spec")
+	if err != nil {
+		glog.Warningf("Could not set the spec of lease %s: %v", e.name, err)
+		return
+	}
+
+	// the resource version read above makes the update fail if another replica renewed or took the lease meanwhile
+	updated, err := e.client.Update(obj, meta1.UpdateOptions{})
+	if err != nil {
+		if !apierrors.IsConflict(err) {
+			glog.Warningf("Could not update lease %s: %v", e.name, err)
+		}
+
+		return
+	}
+
+	e.renewed(parseLeaseRecord(updated), now)
+}
+
+func (e *Elector) create(now time.Time) {
+	renewTime := meta1.NewMicroTime(now).Format(meta1.RFC3339Micro)
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1beta1",
+		"kind": "Lease",
+		"metadata": map[string]interface{}{
+			"namespace": e.namespace,
+			"name": e.name,
+		},
+		"spec": map[string]interface{}{
+			"holderIdentity": e.identity,
+			"leaseDurationSeconds": int64(e.leaseDuration / time.Second),
+			"acquireTime": renewTime,
+			"renewTime": renewTime,
+			"leaseTransitions": int64(0),
+		},
+	}}
+
+	created, err := e.client.Create(obj, meta1.CreateOptions{})
+	if err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			glog.Warningf("Could not create lease %s: %v", e.name, err)
+		}
+
+		return
+	}
+
+	e.renewed(parseLeaseRecord(created), now)
+}
+
+// release gives up the lease if this replica holds it
+func (e *Elector) release() {
+	if !e.IsLeader() {
+		return
+	}
+
+	e.lock.Lock()
+	e.renewedAt = time.Time{}
+	e.lock.Unlock()
+	leader.Set(0)
+
+	obj, err := e.client.Get(e.name, meta1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Could not get lease %s to release it: %v", e.name, err)
+		return
+	}
+
+	if parseLeaseRecord(obj).holder != e.identity {
+		return
+	}
+
+	err = unstructured.SetNestedField(obj.Object, "", "spec", "holderIdentity")
+	if err == nil {
+		_, err = e.client.Update(obj, meta1.UpdateOptions{})
+	}
+
+	if err != nil {
+		glog.Warningf("Could not release lease %s: %v", e.name, err)
+		return
+	}
+
+	glog.Infof("%s released lease %s", e.identity, e.name)
+}
+
+func (e *Elector) renewed(record leaseRecord, now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.observed = record
+	e.observedAt = now
+	e.renewedAt = now
+}
@@ -0,0 +1,90 @@
+package ha
+
+import (
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	"testing"
+	"time"
+)
+
+func leaseHolder(t *testing.T, client dynamic.Interface) (string, int64) {
+	obj, err := client.Resource(leasesResource).Namespace("custom-metrics").Get("newrelic-adapter", meta1.GetOptions{})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	record := parseLeaseRecord(obj)
+	return record.holder, record.transitions
+}
+
+func TestElector_CreatesLease(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	elector := NewElector(client, "custom-metrics", "newrelic-adapter", "adapter-a", 15 * time.Second)
+
+	elector.tryAcquireOrRenew(time.Now())
+	if !elector.IsLeader() {
+		t.Errorf("Expected the first replica to lead")
+	}
+
+	if holder, _ := leaseHolder(t, client); holder != "adapter-a" {
+		t.Errorf("Expected the lease to be held by adapter-a, got %q", holder)
+	}
+}
+
+func TestElector_WaitsForLeaseToExpire(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := NewElector(client, "custom-metrics", "newrelic-adapter", "adapter-a", 15 * time.Second)
+	b := NewElector(client, "custom-metrics", "newrelic-adapter", "adapter-b", 15 * time.Second)
+
+	now := time.Now()
+	a.tryAcquireOrRenew(now)
+	b.tryAcquireOrRenew(now)
+	if b.IsLeader() || b.Leader() != "adapter-a" {
+		t.Fatalf("Expected adapter-b to follow adapter-a, it sees %q", b.Leader())
+	}
+
+	// adapter-a renews, so the lease changed and adapter-b waits a full lease duration again
+	a.tryAcquireOrRenew(now.Add(10 * time.Second))
+	b.tryAcquireOrRenew(now.Add(16 * time.Second))
+	if b.IsLeader() {
+		t.Fatalf("Expected adapter-b to wait while adapter-a renews")
+	}
+
+	b.tryAcquireOrRenew(now.Add(31 * time.Second))
+	if !b.IsLeader() {
+		t.Fatalf("Expected adapter-b to take over the expired lease")
+	}
+
+	holder, transitions := leaseHolder(t, client)
+	if holder != "adapter-b" || transitions != 1 {
+		t.Errorf("Expected adapter-b to hold the lease after one transition, got %q after %d", holder, transitions)
+	}
+
+	a.tryAcquireOrRenew(now.Add(32 * time.Second))
+	if a.IsLeader() {
+		t.Errorf("Expected adapter-a to step down once adapter-b took over")
+	}
+}
+
+func TestElector_ReleasesLease(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	a := NewElector(client, "custom-metrics", "newrelic-adapter", "adapter-a", 15 * time.Second)
+	b := NewElector(client, "custom-metrics", "newrelic-adapter", "adapter-b", 15 * time.Second)
+
+	now := time.Now()
+	a.tryAcquireOrRenew(now)
+	b.tryAcquireOrRenew(now)
+
+	a.release()
+	if a.IsLeader() {
+		t.Fatalf("Expected adapter-a to stop leading once it released the lease")
+	}
+
+	// no need to wait for the lease to expire
+	b.tryAcquireOrRenew(now.Add(time.Second))
+	if !b.IsLeader() {
+		t.Errorf("Expected adapter-b to take over the released lease")
+	}
+}
@@ -0,0 +1,22 @@
+package ha
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "newrelic_adapter_leader",
+		Help: "1 while this replica holds the lease and reads New Relic for every replica, 0 otherwise.",
+	})
+	sharedValueRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_shared_value_requests_total",
+		Help: "Metric requests by how they were answered: shared (a published value), fetched (read by the leader) or missing (no value published in time).",
+	}, []string{"result"})
+	sharedValueRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "newrelic_adapter_shared_value_refreshes_total",
+		Help: "Values the leader read from New Relic and published for the replicas.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(leader, sharedValueRequests, sharedValueRefreshes)
+}
@@ -0,0 +1,459 @@
+package ha
+
+import (
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/health"
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sync"
+	"time"
+)
+
+// SHARED_VALUE_LABEL is the metric label set on external values served from the shared values rather than read from
+// New Relic for the request, so HPA users can tell them apart
+const SHARED_VALUE_LABEL = "sharedValue"
+
+// Options holds the timings of the shared values
+type Options struct {
+	// RefreshInterval is how often the leader reads every requested value again
+	RefreshInterval time.Duration
+	// MaxAge is how old a published value may be before replicas stop serving it
+	MaxAge time.Duration
+	// RequestExpiry is how long a value is kept refreshed after the last replica asked for it
+	RequestExpiry time.Duration
+	// FollowerWait is how long a follower waits for the leader to publish a value it has not read yet
+	FollowerWait time.Duration
+}
+
+// Provider serves metrics from the shared values. The leader reads New Relic through the wrapped provider, on
+// request for values nobody asked for yet and every RefreshInterval for the rest, so New Relic sees one set of
+// requests however many replicas run.
+//
+// Requests never write the shared values themselves: what they read or ask for is queued and written in batches by
+// the refresh loop.
+type Provider struct {
+	nrProvider.MetricsProvider
+	elector *Elector
+	store *Store
+	options Options
+
+	lock sync.Mutex
+	// fetched are values the leader read, requested the requests served or asked for and dropped the entries found
+	// expired at the time they map to, removed unless asked for meanwhile, until the refresh loop writes them
+	fetched map[string]entry
+	requested map[string]requestMark
+	dropped map[string]time.Time
+	// writes wakes the refresh loop when changes are queued
+	writes chan struct{}
+	// refreshing is set while a refresh pass reads New Relic, refreshQueued when another pass was asked for meanwhile
+	// and refreshQueuedAll when that pass should read every value
+	refreshing bool
+	refreshQueued bool
+	refreshQueuedAll bool
+	refreshHeartbeat health.Heartbeat
+}
+
+// requestMark records that a replica asked for req at at
+type requestMark struct {
+	req request
+	at time.Time
+}
+
+func NewProvider(metricsProvider nrProvider.MetricsProvider, elector *Elector, store *Store, options Options) *Provider {
+	return &Provider{
+		MetricsProvider: metricsProvider,
+		elector: elector,
+		store: store,
+		options: options,
+		fetched: map[string]entry{},
+		requested: map[string]requestMark{},
+		dropped: map[string]time.Time{},
+		writes: make(chan struct{}, 1),
+	}
+}
+
+// Run takes part in the leader election and keeps the shared values in sync until stopCh is closed
+func (p *Provider) Run(stopCh <-chan struct{}) {
+	go p.elector.Run(stopCh)
+	p.store.Watch(stopCh)
+	go p.refreshLoop(stopCh)
+}
+
+func (p *Provider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	values, _, err := p.GetSharedExternalMetric(namespace, metricSelector, info)
+	return values, err
+}
+
+// GetSharedExternalMetric serves the external values, reporting whether they were the shared values rather than read
+// from New Relic for the request
+func (p *Provider) GetSharedExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, bool, error) {
+	e, shared, err := p.serve(request{
+		Kind: kindExternal,
+		Namespace: namespace,
+		Metric: info.Metric,
+		MetricSelector: metricSelector.String(),
+	})
+
+	if err == nil {
+		err = e.err()
+	}
+
+	if err != nil || e.External == nil {
+		return &external_metrics.ExternalMetricValueList{}, false, err
+	}
+
+	if !shared {
+		return e.External, false, nil
+	}
+
+	// the entry is shared with the other requests for the same key, so the labels are set on a copy
+	values := e.External.DeepCopy()
+	for i := range values.Items {
+		if values.Items[i].MetricLabels == nil {
+			values.Items[i].MetricLabels = map[string]string{}
+		}
+
+		values.Items[i].MetricLabels[SHARED_VALUE_LABEL] = "true"
+	}
+
+	return values, true, nil
+}
+
+func (p *Provider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	e, _, err := p.serve(request{
+		Kind: kindObject,
+		Namespace: name.Namespace,
+		Metric: info.Metric,
+		MetricSelector: metricSelector.String(),
+		GroupResource: info.GroupResource.String(),
+		Namespaced: info.Namespaced,
+		Name: name.Name,
+	})
+
+	if err == nil {
+		err = e.err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Object, nil
+}
+
+func (p *Provider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	e, _, err := p.serve(request{
+		Kind: kindSelector,
+		Namespace: namespace,
+		Metric: info.Metric,
+		MetricSelector: metricSelector.String(),
+		GroupResource: info.GroupResource.String(),
+		Namespaced: info.Namespaced,
+		Selector: selector.String(),
+	})
+
+	if err == nil {
+		err = e.err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Objects, nil
+}
+
+// fresh reports whether the leader read the entry recently enough for it to be served
+func (p *Provider) fresh(e entry, now time.Time) bool {
+	return !e.Updated.IsZero() && now.Sub(e.Updated) <= p.options.MaxAge
+}
+
+// serve answers req from the shared values, reporting whether the value was one of them. A leader reads values
+// missing from them itself, a follower asks the leader for the request and waits for the value to be published.
+func (p *Provider) serve(req request) (entry, bool, error) {
+	key := req.key()
+	now := time.Now()
+	if e, ok := p.lookup(key); ok && p.fresh(e, now) {
+		p.markRequested(key, e, now)
+		sharedValueRequests.WithLabelValues("shared").Inc()
+		return e, true, nil
+	}
+
+	if p.elector.IsLeader() {
+		e := p.fetch(req)
+		e.Requested = now
+		p.queue(map[string]entry{key: e}, nil, nil)
+		sharedValueRequests.WithLabelValues("fetched").Inc()
+		return e, false, nil
+	}
+
+	p.queue(nil, map[string]requestMark{key: {req: req, at: now}}, nil)
+	e, ok := p.store.wait(key, now.Add(p.options.FollowerWait), func(e entry) bool {
+		return p.fresh(e, time.Now())
+	})
+
+	if !ok {
+		sharedValueRequests.WithLabelValues("missing").Inc()
+		return entry{}, false, apierrors.NewServiceUnavailable(fmt.Sprintf("the leader (%s) has not published a value for %s yet", p.elector.Leader(), req.Metric))
+	}
+
+	sharedValueRequests.WithLabelValues("shared").Inc()
+	return e, true, nil
+}
+
+// lookup returns the entry for key, a value the leader read but did not write yet is served straight away
+func (p *Provider) lookup(key string) (entry, bool) {
+	p.lock.Lock()
+	e, ok := p.fetched[key]
+	p.lock.Unlock()
+
+	if ok {
+		return e, true
+	}
+
+	return p.store.get(key)
+}
+
+// markRequested tells the leader the entry is still in use, at most twice per RequestExpiry to keep writes rare
+func (p *Provider) markRequested(key string, e entry, now time.Time) {
+	if now.Sub(e.Requested) < p.options.RequestExpiry / 2 {
+		return
+	}
+
+	p.queue(nil, map[string]requestMark{key: {req: e.Request, at: now}}, nil)
+}
+
+// queue adds changes for the refresh loop to write and wakes it
+func (p *Provider) queue(fetched map[string]entry, requested map[string]requestMark, expired map[string]time.Time) {
+	p.lock.Lock()
+	for key, e := range fetched {
+		p.fetched[key] = e
+	}
+
+	for key, mark := range requested {
+		if current, ok := p.requested[key]; !ok || current.at.Before(mark.at) {
+			p.requested[key] = mark
+		}
+	}
+
+	for key, at := range expired {
+		p.dropped[key] = at
+	}
+	p.lock.Unlock()
+
+	select {
+	case p.writes <- struct{}{}:
+	default:
+	}
+}
+
+// fetch makes the request through the wrapped provider, which reads New Relic
+func (p *Provider) fetch(req request) entry {
+	e := entry{Request: req}
+	metricSelector, err := labels.Parse(req.MetricSelector)
+	if err == nil {
+		switch req.Kind {
+		case kindExternal:
+			e.External, err = p.MetricsProvider.GetExternalMetric(req.Namespace, metricSelector, provider.ExternalMetricInfo{Metric: req.Metric})
+		case kindObject:
+			e.Object, err = p.MetricsProvider.GetMetricByName(types.NamespacedName{Namespace: req.Namespace, Name: req.Name}, req.customMetricInfo(), metricSelector)
+		case kindSelector:
+			var selector labels.Selector
+			selector, err = labels.Parse(req.Selector)
+			if err == nil {
+				e.Objects, err = p.MetricsProvider.GetMetricBySelector(req.Namespace, selector, req.customMetricInfo(), metricSelector)
+			}
+		default:
+			err = fmt.Errorf("unknown request kind %q", req.Kind)
+		}
+	}
+
+	if err != nil {
+		e = entry{Request: req, Error: errorStatus(err)}
+	}
+
+	e.Updated = time.Now()
+	sharedValueRefreshes.Inc()
+	return e
+}
+
+func (r request) customMetricInfo() provider.CustomMetricInfo {
+	return provider.CustomMetricInfo{
+		GroupResource: schema.ParseGroupResource(r.GroupResource),
+		Namespaced: r.Namespaced,
+		Metric: r.Metric,
+	}
+}
+
+// flush writes the queued changes in one batch. Fetched entries keep a later request time written by another
+// replica, new requests are added and expired entries removed unless a replica asked for them meanwhile.
+func (p *Provider) flush() {
+	p.lock.Lock()
+	fetched, requested, dropped := p.fetched, p.requested, p.dropped
+	p.fetched = map[string]entry{}
+	p.requested = map[string]requestMark{}
+	p.dropped = map[string]time.Time{}
+	p.lock.Unlock()
+
+	keys := []string{}
+	for key := range fetched {
+		keys = append(keys, key)
+	}
+
+	for key := range requested {
+		if _, ok := fetched[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	for key := range dropped {
+		_, isFetched := fetched[key]
+		_, isRequested := requested[key]
+		if !isFetched && !isRequested {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	err := p.store.update(keys, func(key string, e entry, ok bool) (entry, bool) {
+		if refreshed, isFetched := fetched[key]; isFetched {
+			if ok && e.Requested.After(refreshed.Requested) {
+				refreshed.Requested = e.Requested
+			}
+
+			e, ok = refreshed, true
+		}
+
+		if mark, isRequested := requested[key]; isRequested {
+			if !ok {
+				e, ok = entry{Request: mark.req}, true
+			}
+
+			if e.Requested.Before(mark.at) {
+				e.Requested = mark.at
+			}
+		}
+
+		if at, isDropped := dropped[key]; ok && isDropped && p.expired(e, at) {
+			return entry{}, false
+		}
+
+		return e, ok
+	})
+
+	if err != nil {
+		glog.Warningf("Could not write %d shared values: %v", len(keys), err)
+	}
+}
+
+func (p *Provider) expired(e entry, now time.Time) bool {
+	return now.Sub(e.Requested) > p.options.RequestExpiry
+}
+
+// refresh reads the entries again, every one of them when all is set and only those too old to serve otherwise, and
+// queues the entries no replica asked for within RequestExpiry for removal
+func (p *Provider) refresh(now time.Time, all bool) {
+	fetched := map[string]entry{}
+	expired := map[string]time.Time{}
+	for key, e := range p.store.list() {
+		if pending, ok := p.lookup(key); ok {
+			e = pending
+		}
+
+		if p.expired(e, now) {
+			expired[key] = now
+			continue
+		}
+
+		if all || !p.fresh(e, now) {
+			refreshed := p.fetch(e.Request)
+			refreshed.Requested = e.Requested
+			fetched[key] = refreshed
+		}
+	}
+
+	if len(fetched) > 0 || len(expired) > 0 {
+		p.queue(fetched, nil, expired)
+	}
+}
+
+// startRefresh starts a refresh pass in the background unless one is running, in which case another pass runs once it
+// is done. Passes read New Relic and can take a lot longer than RefreshInterval while it is failing or rate limited,
+// so the refresh loop never waits for them.
+func (p *Provider) startRefresh(all bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.refreshing {
+		p.refreshQueued = true
+		p.refreshQueuedAll = p.refreshQueuedAll || all
+		return
+	}
+
+	p.refreshing = true
+	go p.runRefreshes(all)
+}
+
+func (p *Provider) runRefreshes(all bool) {
+	for {
+		if p.elector.IsLeader() {
+			p.refresh(time.Now(), all)
+		}
+
+		p.lock.Lock()
+		if !p.refreshQueued {
+			p.refreshing = false
+			p.lock.Unlock()
+			return
+		}
+
+		all = p.refreshQueuedAll
+		p.refreshQueued, p.refreshQueuedAll = false, false
+		p.lock.Unlock()
+	}
+}
+
+// refreshLoop refreshes every value each RefreshInterval and the values followers ask for as soon as they do, for
+// as long as the replica leads, and writes the queued changes on every replica. It beats on every wake whatever
+// New Relic does, only a loop stuck writing the shared values fails the liveness check.
+func (p *Provider) refreshLoop(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(p.options.RefreshInterval)
+	defer ticker.Stop()
+
+	p.refreshHeartbeat.Start(p.options.RefreshInterval)
+	for {
+		changed := p.store.changes()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if p.elector.IsLeader() {
+				p.startRefresh(true)
+			}
+		case <-changed:
+			if p.elector.IsLeader() {
+				p.startRefresh(false)
+			}
+		case <-p.writes:
+		}
+
+		p.flush()
+		p.refreshHeartbeat.Beat()
+	}
+}
+
+// CheckRefreshLoop fails when the refresh loop stopped making progress, e.g. stuck writing the shared values. Slow or
+// failing New Relic requests do not fail it, restarting the leader would not make them succeed.
+func (p *Provider) CheckRefreshLoop() error {
+	return p.refreshHeartbeat.Check()
+}
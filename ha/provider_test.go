@@ -0,0 +1,329 @@
+package ha
+
+import (
+	"fmt"
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"testing"
+	"time"
+)
+
+// TestMetricsProvider counts the requests that would have reached New Relic
+type TestMetricsProvider struct {
+	nrProvider.MetricsProvider
+	calls int
+}
+
+func (p *TestMetricsProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	p.calls++
+	if info.Metric == "missing" {
+		return &external_metrics.ExternalMetricValueList{}, provider.NewMetricNotFoundError(schema.GroupResource{Resource: info.Metric}, info.Metric)
+	}
+
+	return &external_metrics.ExternalMetricValueList{Items: []external_metrics.ExternalMetricValue{{
+		MetricName: info.Metric,
+		MetricLabels: map[string]string{"appName": "marketplace-prod"},
+		Timestamp: meta1.Now(),
+		Value: *resource.NewQuantity(123, resource.DecimalSI),
+	}}}, nil
+}
+
+func (p *TestMetricsProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	p.calls++
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", Namespace: name.Namespace, Name: name.Name},
+		Metric: custom_metrics.MetricIdentifier{Name: info.Metric},
+		Timestamp: meta1.Now(),
+		Value: *resource.NewQuantity(7, resource.DecimalSI),
+	}, nil
+}
+
+var testOptions = Options{
+	RefreshInterval: 30 * time.Second,
+	MaxAge: 2 * time.Minute,
+	RequestExpiry: 10 * time.Minute,
+	FollowerWait: 10 * time.Millisecond,
+}
+
+// testReplica is a replica sharing client with the others, its store is synced by hand rather than watched
+func testReplica(client dynamic.Interface, identity string) (*Provider, *TestMetricsProvider) {
+	metricsProvider := &TestMetricsProvider{}
+	elector := NewElector(client, "custom-metrics", "newrelic-adapter", identity, 15 * time.Second)
+	elector.tryAcquireOrRenew(time.Now())
+	return NewProvider(metricsProvider, elector, NewStore(client, "custom-metrics", "newrelic-adapter-values", 4), testOptions), metricsProvider
+}
+
+// syncStore loads every ConfigMap of the store, as watching them would
+func syncStore(t *testing.T, p *Provider) {
+	list, err := p.store.client.List(meta1.ListOptions{LabelSelector: STORE_LABEL + "=newrelic-adapter-values"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	for i := range list.Items {
+		p.store.loadObject(&list.Items[i])
+	}
+}
+
+func TestProvider_FollowersServeTheLeadersValues(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, leaderMetrics := testReplica(client, "adapter-a")
+	follower, followerMetrics := testReplica(client, "adapter-b")
+
+	selector := labels.SelectorFromSet(labels.Set{"appName": "marketplace-prod"})
+	values, err := leader.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "rpm"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if len(values.Items) != 1 || leaderMetrics.calls != 1 {
+		t.Fatalf("Expected the leader to read the value, got %v after %d calls", values.Items, leaderMetrics.calls)
+	}
+
+	if _, ok := values.Items[0].MetricLabels[SHARED_VALUE_LABEL]; ok {
+		t.Errorf("Expected the value the leader read not to be labeled as shared, got %v", values.Items[0].MetricLabels)
+	}
+
+	leader.flush()
+	syncStore(t, follower)
+	for i := 0; i < 3; i++ {
+		values, err = follower.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "rpm"})
+		if err != nil {
+			t.Fatalf("There was an error: %s", err)
+		}
+	}
+
+	if followerMetrics.calls != 0 || leaderMetrics.calls != 1 {
+		t.Errorf("Expected the follower to serve the shared value, New Relic was read %d times", leaderMetrics.calls + followerMetrics.calls)
+	}
+
+	if len(values.Items) != 1 || values.Items[0].Value.Value() != 123 || values.Items[0].MetricLabels["appName"] != "marketplace-prod" {
+		t.Errorf("Expected the shared value, got %v", values.Items)
+	}
+
+	if values.Items[0].MetricLabels[SHARED_VALUE_LABEL] != "true" {
+		t.Errorf("Expected the shared value to be labeled, got %v", values.Items[0].MetricLabels)
+	}
+
+	if _, shared, _ := follower.GetSharedExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "rpm"}); !shared {
+		t.Errorf("Expected the follower to report the value as shared")
+	}
+
+	key := request{Kind: kindExternal, Namespace: "marketplace", Metric: "rpm", MetricSelector: selector.String()}.key()
+	if e, _ := follower.store.get(key); e.External.Items[0].MetricLabels[SHARED_VALUE_LABEL] != "" {
+		t.Errorf("Expected the label to be set on a copy of the stored value, got %v", e.External.Items[0].MetricLabels)
+	}
+}
+
+func TestProvider_FollowerAsksTheLeader(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, leaderMetrics := testReplica(client, "adapter-a")
+	follower, followerMetrics := testReplica(client, "adapter-b")
+
+	name := types.NamespacedName{Namespace: "marketplace", Name: "marketplace-1234"}
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "rpm"}
+	_, err := follower.GetMetricByName(name, info, labels.Everything())
+	if !apierrors.IsServiceUnavailable(err) {
+		t.Fatalf("Expected the follower to be unavailable until the leader publishes, got %v", err)
+	}
+
+	follower.flush()
+	syncStore(t, leader)
+	leader.refresh(time.Now(), false)
+	if leaderMetrics.calls != 1 {
+		t.Fatalf("Expected the leader to read the requested value once, got %d calls", leaderMetrics.calls)
+	}
+
+	leader.flush()
+	syncStore(t, follower)
+	value, err := follower.GetMetricByName(name, info, labels.Everything())
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if followerMetrics.calls != 0 || value.Value.Value() != 7 || value.DescribedObject.Name != "marketplace-1234" {
+		t.Errorf("Expected the published value, got %v after %d follower calls", value, followerMetrics.calls)
+	}
+}
+
+func TestProvider_FollowersGetTheLeadersErrors(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, _ := testReplica(client, "adapter-a")
+	follower, _ := testReplica(client, "adapter-b")
+
+	leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "missing"})
+	leader.flush()
+	syncStore(t, follower)
+
+	values, err := follower.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "missing"})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the leader's not found error, got %v", err)
+	}
+
+	if values == nil || len(values.Items) != 0 {
+		t.Errorf("Expected an empty list with the error, got %v", values)
+	}
+}
+
+func TestProvider_RefreshDropsExpiredRequests(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, leaderMetrics := testReplica(client, "adapter-a")
+
+	leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "rpm"})
+	leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "errors"})
+	leader.flush()
+
+	leader.refresh(time.Now().Add(time.Minute), true)
+	leader.flush()
+	if leaderMetrics.calls != 4 || len(leader.store.list()) != 2 {
+		t.Fatalf("Expected both values to be refreshed, got %d calls and %d entries", leaderMetrics.calls, len(leader.store.list()))
+	}
+
+	leader.refresh(time.Now().Add(11 * time.Minute), true)
+	leader.flush()
+	if leaderMetrics.calls != 4 || len(leader.store.list()) != 0 {
+		t.Errorf("Expected values nobody asked for to be dropped, got %d calls and %d entries", leaderMetrics.calls, len(leader.store.list()))
+	}
+}
+
+func TestProvider_RequestsDoNotWriteTheSharedValues(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, leaderMetrics := testReplica(client, "adapter-a")
+	client.ClearActions()
+
+	for i := 0; i < 3; i++ {
+		leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "rpm"})
+		leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "errors"})
+	}
+
+	if len(client.Actions()) != 0 || leaderMetrics.calls != 2 {
+		t.Fatalf("Expected the leader to serve what it read without writing, got %d calls and actions %v", leaderMetrics.calls, client.Actions())
+	}
+
+	leader.flush()
+	writes := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			writes++
+		}
+	}
+
+	if writes == 0 || writes > 2 {
+		t.Errorf("Expected both values to be written in one batch of at most one write per ConfigMap, got %d writes", writes)
+	}
+}
+
+func TestStore_SplitsEntriesAcrossShards(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	store := NewStore(client, "custom-metrics", "newrelic-adapter-values", 4)
+
+	keys := []string{}
+	shards := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		key := request{Kind: kindExternal, Namespace: "marketplace", Metric: fmt.Sprintf("rpm-%d", i)}.key()
+		keys = append(keys, key)
+		shards[store.shardName(key)] = true
+	}
+
+	err := store.update(keys, func(key string, e entry, ok bool) (entry, bool) {
+		return entry{Requested: time.Now()}, true
+	})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	list, _ := client.Resource(configMapsResource).Namespace("custom-metrics").List(meta1.ListOptions{})
+	if len(shards) < 2 || len(list.Items) != len(shards) || len(store.list()) != 20 {
+		t.Errorf("Expected the entries split across %d ConfigMaps, got %d ConfigMaps holding %d entries", len(shards), len(list.Items), len(store.list()))
+	}
+}
+
+func TestStore_FullShardKeepsItsEntries(t *testing.T) {
+	defer func(limit int) { maxShardBytes = limit }(maxShardBytes)
+
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	store := NewStore(client, "custom-metrics", "newrelic-adapter-values", 1)
+	requested := func(key string, e entry, ok bool) (entry, bool) {
+		return entry{Requested: time.Now()}, true
+	}
+
+	first := request{Kind: kindExternal, Metric: "rpm"}.key()
+	store.update([]string{first}, requested)
+
+	maxShardBytes = 1
+	second := request{Kind: kindExternal, Metric: "errors"}.key()
+	store.update([]string{first, second}, requested)
+
+	if _, ok := store.get(first); !ok {
+		t.Errorf("Expected the full ConfigMap to keep its entry")
+	}
+
+	if _, ok := store.get(second); ok {
+		t.Errorf("Expected a new request not to be added to a full ConfigMap")
+	}
+}
+
+func TestProvider_RefreshLoopBeats(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, _ := testReplica(client, "adapter-a")
+	leader.options.RefreshInterval = 10 * time.Millisecond
+
+	stopCh := make(chan struct{})
+	go leader.refreshLoop(stopCh)
+	time.Sleep(50 * time.Millisecond)
+
+	if err := leader.CheckRefreshLoop(); err != nil {
+		t.Errorf("Expected a running refresh loop to be healthy, got %s", err)
+	}
+
+	close(stopCh)
+	time.Sleep(50 * time.Millisecond)
+	if err := leader.CheckRefreshLoop(); err == nil {
+		t.Errorf("Expected a stopped refresh loop to fail the check")
+	}
+}
+
+// BlockingMetricsProvider stands for a New Relic that does not answer until release is closed
+type BlockingMetricsProvider struct {
+	nrProvider.MetricsProvider
+	release chan struct{}
+}
+
+func (p BlockingMetricsProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	<-p.release
+	return &external_metrics.ExternalMetricValueList{}, nil
+}
+
+func TestProvider_RefreshLoopBeatsWhileNewRelicHangs(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	leader, _ := testReplica(client, "adapter-a")
+	leader.options.RefreshInterval = 10 * time.Millisecond
+
+	// a value to refresh, read before New Relic stopped answering
+	leader.GetExternalMetric("marketplace", labels.Everything(), provider.ExternalMetricInfo{Metric: "rpm"})
+	leader.flush()
+
+	release := make(chan struct{})
+	defer close(release)
+	leader.MetricsProvider = BlockingMetricsProvider{release: release}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go leader.refreshLoop(stopCh)
+	time.Sleep(100 * time.Millisecond)
+
+	if err := leader.CheckRefreshLoop(); err != nil {
+		t.Errorf("Expected the refresh loop to stay healthy while New Relic hangs, got %s", err)
+	}
+}
@@ -0,0 +1,422 @@
+package ha
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var configMapsResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// maxUpdateAttempts bounds the read-modify-write retries when replicas update a ConfigMap at the same time
+const maxUpdateAttempts = 5
+
+// maxShardBytes is how much data a ConfigMap may hold, below the 1MiB limit of the whole object
+var maxShardBytes = 900 * 1024
+
+// STORE_LABEL is the label naming the shared values ConfigMaps a replica watches, set to ha.configMapName
+const STORE_LABEL = "newrelic.flexshopper.com/shared-values"
+
+const (
+	kindExternal = "external"
+	kindObject = "object"
+	kindSelector = "selector"
+)
+
+// request is a metric request as the API server made it, recorded so the leader can make it again. Selectors are
+// kept in their string form.
+type request struct {
+	Kind string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Metric string `json:"metric"`
+	MetricSelector string `json:"metricSelector,omitempty"`
+	// GroupResource, Namespaced, Name and Selector are only set for custom metrics
+	GroupResource string `json:"groupResource,omitempty"`
+	Namespaced bool `json:"namespaced,omitempty"`
+	Name string `json:"name,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// key names the request's entry in the ConfigMaps, whose keys may only hold a few characters besides letters and
+// digits
+func (r request) key() string {
+	encoded, _ := json.Marshal(r)
+	sum := sha1.Sum(encoded)
+	return hex.EncodeToString(sum[:10])
+}
+
+// entry is a request with the last value or error the leader read for it. Requested is bumped by any replica
+// serving the entry so the leader keeps refreshing it, Updated is when the leader last read it.
+type entry struct {
+	Request request `json:"request"`
+	Requested time.Time `json:"requested"`
+	Updated time.Time `json:"updated"`
+	External *external_metrics.ExternalMetricValueList `json:"external,omitempty"`
+	Object *custom_metrics.MetricValue `json:"object,omitempty"`
+	Objects *custom_metrics.MetricValueList `json:"objects,omitempty"`
+	Error *meta1.Status `json:"error,omitempty"`
+}
+
+// err returns the error the leader got, as the same status so followers answer with the same code
+func (e entry) err() error {
+	if e.Error == nil {
+		return nil
+	}
+
+	return &apierrors.StatusError{ErrStatus: *e.Error}
+}
+
+// errorStatus keeps the status of Kubernetes errors, other errors are reported by the API server as a 500 with
+// their message and are stored that way
+func errorStatus(err error) *meta1.Status {
+	if status, ok := err.(apierrors.APIStatus); ok {
+		errStatus := status.Status()
+		return &errStatus
+	}
+
+	return &meta1.Status{
+		Status: meta1.StatusFailure,
+		Code: 500,
+		Message: err.Error(),
+	}
+}
+
+// Store is the replicas' copy of the shared values, split across shards ConfigMaps named name-0, name-1... so each
+// write only rewrites the entries of one of them and no ConfigMap reaches the 1MiB limit. Every replica watches
+// them, the leader writes values into them and followers add the requests they need a value for.
+type Store struct {
+	client dynamic.ResourceInterface
+	namespace string
+	name string
+	shards int
+
+	lock sync.Mutex
+	// shardEntries holds the entries of each ConfigMap by name, entries all of them together
+	shardEntries map[string]map[string]entry
+	entries map[string]entry
+	// changed is closed and replaced whenever the entries are reloaded
+	changed chan struct{}
+	synced func() bool
+}
+
+// NewStore returns a Store for the ConfigMaps namespace/name-N, which are created on their first write
+func NewStore(client dynamic.Interface, namespace string, name string, shards int) *Store {
+	if shards < 1 {
+		shards = 1
+	}
+
+	return &Store{
+		client: client.Resource(configMapsResource).Namespace(namespace),
+		namespace: namespace,
+		name: name,
+		shards: shards,
+		shardEntries: map[string]map[string]entry{},
+		entries: map[string]entry{},
+		changed: make(chan struct{}),
+	}
+}
+
+// shardName is the ConfigMap holding the entry for key
+func (s *Store) shardName(key string) string {
+	hash, _ := strconv.ParseUint(key[:8], 16, 32)
+	return fmt.Sprintf("%s-%d", s.name, hash % uint64(s.shards))
+}
+
+// Watch keeps the entries in sync with the ConfigMaps until stopCh is closed
+func (s *Store) Watch(stopCh <-chan struct{}) {
+	storeSelector := labels.SelectorFromSet(labels.Set{STORE_LABEL: s.name}).String()
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options meta1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = storeSelector
+				return s.client.List(options)
+			},
+			WatchFunc: func(options meta1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = storeSelector
+				return s.client.Watch(options)
+			},
+		},
+		&unstructured.Unstructured{},
+		0,
+		cache.Indexers{},
+	)
+
+	s.lock.Lock()
+	s.synced = informer.HasSynced
+	s.lock.Unlock()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.loadObject,
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			s.loadObject(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if unstructuredObj, ok := obj.(*unstructured.Unstructured); ok {
+				s.load(unstructuredObj.GetName(), map[string]entry{})
+			}
+		},
+	})
+
+	go informer.Run(stopCh)
+}
+
+// Check fails until the ConfigMaps have been listed, followers would otherwise ask the leader for values it already
+// shared
+func (s *Store) Check() error {
+	s.lock.Lock()
+	synced := s.synced
+	s.lock.Unlock()
+
+	if synced != nil && !synced() {
+		return errors.New("the shared values ConfigMaps have not been listed yet")
+	}
+
+	return nil
+}
+
+func (s *Store) loadObject(obj interface{}) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	s.load(unstructuredObj.GetName(), parseEntries(unstructuredObj))
+}
+
+// load replaces the entries of the ConfigMap shard
+func (s *Store) load(shard string, entries map[string]entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shardEntries[shard] = entries
+	s.entries = map[string]entry{}
+	for _, shardEntries := range s.shardEntries {
+		for key, e := range shardEntries {
+			s.entries[key] = e
+		}
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// parseEntries reads the entries out of the ConfigMap's data, entries that cannot be read are skipped
+func parseEntries(obj *unstructured.Unstructured) map[string]entry {
+	entries := map[string]entry{}
+	data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+	for key, value := range data {
+		e := entry{}
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			glog.Warningf("Skipping shared value %s in ConfigMap %s: %v", key, obj.GetName(), err)
+			continue
+		}
+
+		entries[key] = e
+	}
+
+	return entries
+}
+
+// encodeEntries returns the ConfigMap data holding entries and its size
+func encodeEntries(entries map[string]entry) (map[string]string, int, error) {
+	data := map[string]string{}
+	size := 0
+	for key, e := range entries {
+		encoded, err := json.Marshal(e)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		data[key] = string(encoded)
+		size += len(key) + len(encoded)
+	}
+
+	return data, size, nil
+}
+
+func (s *Store) get(key string) (entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.entries[key]
+	return e, ok
+}
+
+// list returns a copy of the entries
+func (s *Store) list() map[string]entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := map[string]entry{}
+	for key, e := range s.entries {
+		entries[key] = e
+	}
+
+	return entries
+}
+
+// changes returns a channel closed the next time the entries are reloaded
+func (s *Store) changes() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.changed
+}
+
+// wait waits until the entry for key is ready or the deadline passes
+func (s *Store) wait(key string, deadline time.Time, ready func(e entry) bool) (entry, bool) {
+	for {
+		s.lock.Lock()
+		e, ok := s.entries[key]
+		changed := s.changed
+		s.lock.Unlock()
+
+		if ok && ready(e) {
+			return e, true
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return e, false
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// update applies modify to the latest entry of each of keys and writes back the ConfigMaps holding them, creating
+// those that do not exist yet. modify returns the entry to keep, or false to remove it. Writes from other replicas
+// in between are retried rather than overwritten.
+func (s *Store) update(keys []string, modify func(key string, e entry, ok bool) (entry, bool)) error {
+	shards := map[string][]string{}
+	for _, key := range keys {
+		shard := s.shardName(key)
+		shards[shard] = append(shards[shard], key)
+	}
+
+	failed := []string{}
+	for shard, shardKeys := range shards {
+		if err := s.updateShard(shard, shardKeys, modify); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", shard, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.New(strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (s *Store) updateShard(shard string, keys []string, modify func(key string, e entry, ok bool) (entry, bool)) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		obj, err := s.client.Get(shard, meta1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+
+		if notFound {
+			obj = &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind": "ConfigMap",
+				"metadata": map[string]interface{}{
+					"namespace": s.namespace,
+					"name": shard,
+					"labels": map[string]interface{}{
+						STORE_LABEL: s.name,
+					},
+				},
+			}}
+		}
+
+		entries := parseEntries(obj)
+		added := []string{}
+		for _, key := range keys {
+			current, ok := entries[key]
+			e, keep := modify(key, current, ok)
+			if !keep {
+				delete(entries, key)
+				continue
+			}
+
+			if !ok {
+				added = append(added, key)
+			}
+
+			entries[key] = e
+		}
+
+		data, size, err := encodeEntries(entries)
+		if err != nil {
+			return err
+		}
+
+		// a full ConfigMap keeps serving the values it has, the requests that do not fit wait for others to expire
+		if size > maxShardBytes && len(added) > 0 {
+			for _, key := range added {
+				delete(entries, key)
+			}
+
+			glog.Warningf("ConfigMap %s is full, %d new requests are not shared, raise ha.shards", shard, len(added))
+			data, _, err = encodeEntries(entries)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = unstructured.SetNestedStringMap(obj.Object, data, "data")
+		if err != nil {
+			return err
+		}
+
+		var written *unstructured.Unstructured
+		if notFound {
+			written, err = s.client.Create(obj, meta1.CreateOptions{})
+		} else {
+			written, err = s.client.Update(obj, meta1.UpdateOptions{})
+		}
+
+		if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.load(shard, parseEntries(written))
+		return nil
+	}
+
+	return fmt.Errorf("ConfigMap %s kept changing, gave up after %d attempts", shard, maxUpdateAttempts)
+}
@@ -0,0 +1,130 @@
+// Package health collects the adapter's liveness and readiness checks and serves them over HTTP
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checks is a set of named checks that all have to pass
+type Checks struct {
+	lock sync.RWMutex
+	checks map[string]func() error
+}
+
+func NewChecks() *Checks {
+	return &Checks{
+		checks: map[string]func() error{},
+	}
+}
+
+// Add registers a check, a check with the same name is replaced
+func (c *Checks) Add(name string, check func() error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.checks[name] = check
+}
+
+// Run runs every check and returns the failures keyed by check name
+func (c *Checks) Run() map[string]error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	failures := map[string]error{}
+	for name, check := range c.checks {
+		if err := check(); err != nil {
+			failures[name] = err
+		}
+	}
+
+	return failures
+}
+
+// Check returns a single error naming every failed check
+func (c *Checks) Check() error {
+	failures := c.Run()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	messages := []string{}
+	for name, err := range failures {
+		messages = append(messages, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	sort.Strings(messages)
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// ServeHTTP responds 200 when every check passes and 500 listing each check otherwise, in the format of the API
+// server's verbose /healthz output
+func (c *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failures := c.Run()
+
+	c.lock.RLock()
+	names := []string{}
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	c.lock.RUnlock()
+	sort.Strings(names)
+
+	if len(failures) == 0 {
+		w.Write([]byte("ok"))
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	for _, name := range names {
+		if err, failed := failures[name]; failed {
+			fmt.Fprintf(w, "[-]%s failed: %v\n", name, err)
+		} else {
+			fmt.Fprintf(w, "[+]%s ok\n", name)
+		}
+	}
+}
+
+// Heartbeat records the progress of a background loop so a loop that stopped running can be detected
+type Heartbeat struct {
+	lock sync.Mutex
+	last time.Time
+	interval time.Duration
+}
+
+// Start marks the loop as running with a beat expected every interval
+func (h *Heartbeat) Start(interval time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.interval = interval
+	h.last = time.Now()
+}
+
+func (h *Heartbeat) Beat() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.last = time.Now()
+}
+
+// Check fails when a started loop missed three beats in a row, loops that were never started are healthy
+func (h *Heartbeat) Check() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.interval == 0 {
+		return nil
+	}
+
+	if since := time.Since(h.last); since > 3 * h.interval {
+		return fmt.Errorf("no progress for %s, expected every %s", since.Round(time.Second), h.interval)
+	}
+
+	return nil
+}
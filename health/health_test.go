@@ -0,0 +1,69 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecksServeHTTP(t *testing.T) {
+	checks := NewChecks()
+	checks.Add("newrelic", func() error { return nil })
+
+	recorder := httptest.NewRecorder()
+	checks.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+		t.Errorf("Expected 200 ok, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	checks.Add("metric-definitions", func() error { return errors.New("not synced") })
+
+	recorder = httptest.NewRecorder()
+	checks.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", recorder.Code)
+	}
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, "[-]metric-definitions failed: not synced") || !strings.Contains(body, "[+]newrelic ok") {
+		t.Errorf("Expected every check to be listed, got %s", body)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	heartbeat := &Heartbeat{}
+	if err := heartbeat.Check(); err != nil {
+		t.Errorf("Expected a loop that never started to be healthy, got %s", err)
+	}
+
+	heartbeat.Start(10 * time.Millisecond)
+	if err := heartbeat.Check(); err != nil {
+		t.Errorf("Expected a started loop to be healthy, got %s", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := heartbeat.Check(); err == nil {
+		t.Errorf("Expected a loop without beats to be unhealthy")
+	}
+
+	heartbeat.Beat()
+	if err := heartbeat.Check(); err != nil {
+		t.Errorf("Expected a beat to make the loop healthy, got %s", err)
+	}
+}
+
+func TestChecksCheck(t *testing.T) {
+	checks := NewChecks()
+	checks.Add("api-key-file", func() error { return nil })
+	if err := checks.Check(); err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	checks.Add("poller", func() error { return errors.New("no progress") })
+	if err := checks.Check(); err == nil || err.Error() != "poller: no progress" {
+		t.Errorf("Expected the failed check to be named, got %v", err)
+	}
+}
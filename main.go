@@ -1,109 +1,322 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/config"
+	"github.com/flexshopper/newrelic-custom-metrics/ha"
+	"github.com/flexshopper/newrelic-custom-metrics/health"
 	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
-	"io/ioutil"
+	"github.com/flexshopper/newrelic-custom-metrics/query"
+	"github.com/flexshopper/newrelic-custom-metrics/shutdown"
+	"github.com/flexshopper/newrelic-custom-metrics/telemetry"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
 	"net/http"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/golang/glog"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/apiserver/pkg/util/logs"
 
 	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
 	basecmd "github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/cmd"
-	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 )
 
 type NewrelicAdapter struct {
 	basecmd.AdapterBase
-
-	// Message is printed on successful startup
-	Message string
 }
 
-type HttpGetClient struct {
-	
+// serveHttp exposes the adapter's Prometheus metrics and probes on a plain HTTP port, separate from the
+// authenticated API server port
+func serveHttp(address string, liveness *health.Checks, readiness *health.Checks) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", liveness)
+	mux.Handle("/readyz", readiness)
+
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		glog.Fatalf("unable to serve metrics and probes on %s: %v", address, err)
+	}()
 }
 
-func (HttpGetClient) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
-	client := http.Client{}
+// makeProviderOrDie returns the provider reading New Relic and the check of New Relic's connectivity, which the caller
+// adds to the readiness checks
+func (a *NewrelicAdapter) makeProviderOrDie(cfg *config.Config, liveness *health.Checks, readiness *health.Checks, shutdownHandler *shutdown.Handler) (nrProvider.MetricsProvider, func() error) {
+	client, err := a.DynamicClient()
+	if err != nil {
+		glog.Fatalf("unable to construct dynamic client: %v", err)
+	}
+
+	mapper, err := a.RESTMapper()
+	if err != nil {
+		glog.Fatalf("unable to construct discovery REST mapper: %v", err)
+	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	newrelicApiKey, err := cfg.ApiKey()
 	if err != nil {
-		return []byte{}, err
+		glog.Fatalf("unable to read API key file: %v", err)
 	}
 
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	httpClient := newrelic.HttpGetClient{Timeout: cfg.NewRelic.Timeout.Duration, Context: shutdownHandler.Context()}
+
+	options := nrProvider.Options{
+		Aggregation: nrProvider.Aggregation(cfg.Provider.Aggregation),
+		ResolveAppName: cfg.Provider.ResolveAppName,
+		MaxDataAge: cfg.Provider.MaxDataAge.Duration,
+		EnforceAccessPolicy: cfg.Provider.EnforceAccessPolicy,
+		AccessPolicyConfigMap: cfg.Provider.AccessPolicyConfigMap,
+		CredentialsSecretName: cfg.Provider.CredentialsSecretName,
+		NewApi: func(apiKey string) newrelic.RpmProvider {
+			return cfg.NewApi(apiKey, httpClient)
+		},
+		DefaultAccountID: cfg.NewRelic.DefaultAccountID,
+		FailurePolicy: failurePolicy(cfg),
+		Smoothing: smoothing(cfg),
+		StaticDefinitions: staticDefinitions(cfg),
 	}
 
-	q := req.URL.Query()
-	for k, v := range params {
-		q.Set(k, v)
+	api := cfg.NewApi(newrelicApiKey, httpClient)
+	if cfg.NewRelic.ApiKeyFile != "" {
+		go api.WatchApiKeyFile(cfg.NewRelic.ApiKeyFile, cfg.NewRelic.ApiKeyFileInterval.Duration, shutdownHandler.StopCh())
+		liveness.Add("api-key-file", api.CheckApiKeyFileWatcher)
 	}
 
-	req.URL.RawQuery = q.Encode()
+	connectivity := func() error {
+		return api.CheckConnectivity(cfg.Server.ConnectivityMaxAge.Duration)
+	}
+
+	newrelicProvider := nrProvider.NewProvider(client, mapper, api, options)
+	readiness.Add("metric-definitions", newrelicProvider.CheckMetricDefinitions)
+	return newrelicProvider, connectivity
+}
 
-	res, err := client.Do(req)
+// makeHAProviderOrDie shares newrelicProvider's values between the replicas, only the elected leader reads New Relic
+func (a *NewrelicAdapter) makeHAProviderOrDie(cfg *config.Config, newrelicProvider nrProvider.MetricsProvider, connectivity func() error, liveness *health.Checks, readiness *health.Checks, stopCh <-chan struct{}) nrProvider.MetricsProvider {
+	client, err := a.DynamicClient()
 	if err != nil {
-		return []byte{}, err
+		glog.Fatalf("unable to construct dynamic client: %v", err)
+	}
+
+	// POD_NAME is set through the downward API, the hostname is the pod name too unless hostNetwork is used
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			glog.Fatalf("unable to find an identity for leader election: %v", err)
+		}
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	glog.Infof("Request made to %s with params %v, response was: %s", url, params, body)
+	elector := ha.NewElector(client, cfg.HA.Namespace, cfg.HA.LeaseName, identity, cfg.HA.LeaseDuration.Duration)
+	store := ha.NewStore(client, cfg.HA.Namespace, cfg.HA.ConfigMapName, cfg.HA.Shards)
+	readiness.Add("shared-values", store.Check)
+
+	// followers serve the shared values and never read New Relic, probing it from every replica would spend the
+	// account's rate limit and take the followers out of service during an outage only the leader is exposed to
+	readiness.Add("newrelic", func() error {
+		if !elector.IsLeader() {
+			return nil
+		}
+
+		return connectivity()
+	})
+
+	haProvider := ha.NewProvider(newrelicProvider, elector, store, ha.Options{
+		RefreshInterval: cfg.HA.RefreshInterval.Duration,
+		MaxAge: cfg.HA.MaxAge.Duration,
+		RequestExpiry: cfg.HA.RequestExpiry.Duration,
+		FollowerWait: cfg.HA.FollowerWait.Duration,
+	})
+
+	liveness.Add("shared-values-refresh", haProvider.CheckRefreshLoop)
+	haProvider.Run(stopCh)
+	return haProvider
+}
+
+// addHealthChecksOrDie adds the liveness checks to the API server's /healthz. The API server has no readiness
+// endpoint, so readiness is only served on the plain HTTP port.
+func (a *NewrelicAdapter) addHealthChecksOrDie(liveness *health.Checks) {
+	adapterConfig, err := a.Config()
 	if err != nil {
-		return []byte{}, err
+		glog.Fatalf("unable to construct adapter config: %v", err)
 	}
 
-	return body, nil
+	adapterConfig.GenericConfig.HealthzChecks = append(adapterConfig.GenericConfig.HealthzChecks,
+		healthz.NamedCheck("newrelic-adapter", func(r *http.Request) error {
+			return liveness.Check()
+		}))
 }
 
-func (a *NewrelicAdapter) makeProviderOrDie() provider.ExternalMetricsProvider {
-	client, err := a.DynamicClient()
+func staticDefinitions(cfg *config.Config) []nrProvider.StaticDefinition {
+	statics := []nrProvider.StaticDefinition{}
+	for _, metric := range cfg.Metrics {
+		statics = append(statics, nrProvider.StaticDefinition{
+			Namespace: metric.Namespace,
+			Name: metric.Name,
+			Spec: metric.Spec,
+		})
+	}
+
+	return statics
+}
+
+func failurePolicy(cfg *config.Config) nrProvider.FailurePolicy {
+	return nrProvider.FailurePolicy{
+		Type: nrProvider.FailurePolicyType(cfg.Provider.FailurePolicy.Type),
+		MaxAge: cfg.Provider.FailurePolicy.MaxAge.Duration,
+		FallbackValue: cfg.Provider.FailurePolicy.FallbackValue,
+	}
+}
+
+func smoothing(cfg *config.Config) nrProvider.Smoothing {
+	return nrProvider.Smoothing{
+		Type: nrProvider.SmoothingType(cfg.Provider.Smoothing.Type),
+		Alpha: cfg.Provider.Smoothing.Alpha,
+		Samples: cfg.Provider.Smoothing.Samples,
+		Window: cfg.Provider.Smoothing.Window.Duration,
+	}
+}
+
+// loadConfig reads the config file with its env and flag overrides, the failure policy, smoothing and metric
+// definitions it declares are checked by the provider so a bad file fails here rather than on the first request
+func loadConfig(flags *config.Flags) (*config.Config, error) {
+	cfg, err := flags.Load(os.Getenv)
 	if err != nil {
-		glog.Fatalf("unable to construct dynamic client: %v", err)
+		return nil, err
 	}
 
-	mapper, err := a.RESTMapper()
+	err = failurePolicy(cfg).Validate()
 	if err != nil {
-		glog.Fatalf("unable to construct discovery REST mapper: %v", err)
+		return nil, fmt.Errorf("invalid provider.failurePolicy: %v", err)
 	}
 
-	newrelicApiKey := os.Getenv("NEWRELIC_API_KEY")
-	if newrelicApiKey == "" {
-		glog.Fatalf("NEWRELIC_API_KEY env var must be set")
+	err = smoothing(cfg).Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid provider.smoothing: %v", err)
 	}
 
-	minRpm := 0
-	minRpmArg := os.Getenv("MIN_RPM")
-	if minRpmArg != "" {
-		minRpm, err = strconv.Atoi(minRpmArg)
-		if err != nil {
-			glog.Warningf("Could parse MIN_RPM to int, defaulting to %d", minRpm)
-		}
+	err = nrProvider.ValidateStaticDefinitions(staticDefinitions(cfg))
+	if err != nil {
+		return nil, err
 	}
 
-	return nrProvider.NewProvider(client, mapper, newrelic.NewApi(newrelicApiKey, minRpm, HttpGetClient{}))
+	return cfg, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		err := query.Run(os.Args[2:], os.Stdout, os.Getenv, func(timeout time.Duration) newrelic.GetApiRequest {
+			return newrelic.HttpGetClient{Timeout: timeout}
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
 	cmd := &NewrelicAdapter{}
-	cmd.Flags().StringVar(&cmd.Message, "msg", "starting adapter...", "startup message")
+	configFlags := config.BindFlags(cmd.Flags())
 	cmd.Flags().AddGoFlagSet(flag.CommandLine) // make sure we get the glog flags
 	cmd.Flags().Parse(os.Args)
 
-	newrelicProvider := cmd.makeProviderOrDie()
+	cfg, err := loadConfig(configFlags)
+	if configFlags.ValidateOnly {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
+	if err != nil {
+		glog.Fatalf("unable to load configuration: %v", err)
+	}
+
+	shutdownHandler := shutdown.NewHandler(cfg.Server.ShutdownDelay.Duration, cfg.Server.ShutdownGracePeriod.Duration)
+	shutdownHandler.Notify()
+	stopCh := shutdownHandler.StopCh()
+
+	flushTraces, err := tracing.Setup(tracing.Options{
+		Endpoint: cfg.Tracing.Endpoint,
+		Insecure: cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		glog.Fatalf("unable to set up tracing: %v", err)
+	}
+
+	liveness := health.NewChecks()
+	readiness := health.NewChecks()
+	readiness.Add("shutdown", shutdownHandler.Check)
+	newrelicProvider, connectivity := cmd.makeProviderOrDie(cfg, liveness, readiness, shutdownHandler)
+	if cfg.Provider.WatchMetricDefinitions {
+		newrelicProvider.WatchMetricDefinitions(stopCh)
+	}
+
+	if cfg.HA.Enabled {
+		newrelicProvider = cmd.makeHAProviderOrDie(cfg, newrelicProvider, connectivity, liveness, readiness, stopCh)
+	} else {
+		readiness.Add("newrelic", connectivity)
+	}
+
+	var reporter *telemetry.Reporter
+	if cfg.Telemetry.Enabled {
+		reporter = telemetry.NewReporter(telemetry.Options{
+			Endpoint: cfg.TelemetryEndpoint(),
+			LicenseKey: cfg.Telemetry.LicenseKey,
+			QueueSize: cfg.Telemetry.QueueSize,
+			BatchSize: cfg.Telemetry.BatchSize,
+			FlushInterval: cfg.Telemetry.FlushInterval.Duration,
+			Timeout: cfg.NewRelic.Timeout.Duration,
+		})
+		go reporter.Run(stopCh)
+
+		// wrapping the HA provider reports what every replica served, not only what the leader read
+		newrelicProvider = telemetry.NewProvider(newrelicProvider, reporter)
+	}
+
+	cmd.addHealthChecksOrDie(liveness)
+	if cfg.Server.HttpAddress != "" {
+		serveHttp(cfg.Server.HttpAddress, liveness, readiness)
+	}
+
+	cmd.WithCustomMetrics(newrelicProvider)
 	cmd.WithExternalMetrics(newrelicProvider)
 
-	glog.Infof(cmd.Message)
+	glog.Infof("starting adapter...")
 
-	if err := cmd.Run(wait.NeverStop); err != nil {
+	// Run returns once stopCh is closed and the API server finished the requests in flight
+	if err := cmd.Run(stopCh); err != nil {
 		glog.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
+
+	shutdownHandler.Done()
+
+	// the events and spans of the last requests are still buffered
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if reporter != nil {
+		select {
+		case <-reporter.Stopped():
+		case <-ctx.Done():
+			glog.Warningf("gave up sending the remaining events to New Relic")
+		}
+	}
+
+	if err := flushTraces(ctx); err != nil {
+		glog.Warningf("unable to export the remaining spans: %v", err)
+	}
+
+	glog.Infof("adapter stopped")
 }
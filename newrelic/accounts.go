@@ -0,0 +1,115 @@
+package newrelic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// PostApiRequest is implemented by http clients that can also POST, which NerdGraph requires
+type PostApiRequest interface {
+	Post(url string, headers map[string]string, body []byte) ([]byte, error)
+}
+
+type nerdGraphRequest struct {
+	Query string `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type nerdGraphError struct {
+	Message string `json:"message"`
+}
+
+type nerdGraphResponse struct {
+	Data struct {
+		Actor struct {
+			Account struct {
+				Nrql struct {
+					Results []map[string]interface{} `json:"results"`
+				} `json:"nrql"`
+			} `json:"account"`
+		} `json:"actor"`
+	} `json:"data"`
+	Errors []nerdGraphError `json:"errors"`
+}
+
+const nerdGraphNrqlQuery = `query($accountId: Int!, $nrql: Nrql!) { actor { account(id: $accountId) { nrql(query: $nrql) { results } } } }`
+
+// NewUserKeyApi returns an Api authenticated with a user key. NRQL queries are sent through NerdGraph, so a single
+// key with access to several accounts (e.g. a parent account and its sub-accounts) can query any of them.
+func NewUserKeyApi(userKey string, minRpmForConsideration int, client GetApiRequest) *Api {
+	api := NewApi(userKey, minRpmForConsideration, client)
+	api.userKey = true
+	return api
+}
+
+// AccountApi is an Api bound to a single account, for callers that route queries by account
+type AccountApi struct {
+	api *Api
+	accountId int
+}
+
+// ForAccount returns a client sending its queries to accountId
+func (nr *Api) ForAccount(accountId int) *AccountApi {
+	return &AccountApi{
+		api: nr,
+		accountId: accountId,
+	}
+}
+
+func (a *AccountApi) AccountID() int {
+	return a.accountId
+}
+
+func (a *AccountApi) GetNrqlMetric(ctx context.Context, nrql string) (MetricResult, error) {
+	return a.api.GetNrqlMetric(ctx, a.accountId, nrql)
+}
+
+// getNerdGraphNrqlMetric runs an NRQL query against an account through NerdGraph
+func (nr *Api) getNerdGraphNrqlMetric(ctx context.Context, accountId int, nrql string) (MetricResult, error) {
+	poster, ok := nr.httpClient.(PostApiRequest)
+	if !ok {
+		return MetricResult{}, errors.New("http client does not support the POST requests NerdGraph requires")
+	}
+
+	body, err := json.Marshal(nerdGraphRequest{
+		Query: nerdGraphNrqlQuery,
+		Variables: map[string]interface{}{
+			"accountId": accountId,
+			"nrql": nrql,
+		},
+	})
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	headers := map[string]string{
+		"api-key": nr.currentApiKey(),
+		"content-type": "application/json",
+	}
+
+	responseBody, err := nr.send(ctx, endpointNerdGraph, PriorityHigh, accountId, nr.nerdGraphUri, func() ([]byte, error) {
+		return poster.Post(nr.nerdGraphUri, headers, body)
+	})
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	response := nerdGraphResponse{}
+	err = decode(ctx, endpointNerdGraph, responseBody, &response)
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	if len(response.Errors) > 0 {
+		messages := []string{}
+		for _, graphErr := range response.Errors {
+			messages = append(messages, graphErr.Message)
+		}
+
+		return MetricResult{}, errors.New("NerdGraph query failed: " + strings.Join(messages, "; "))
+	}
+
+	return nr.nrqlResult(accountId, response.Data.Actor.Account.Nrql.Results, "")
+}
@@ -0,0 +1,70 @@
+package newrelic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type TestPostApiRequest struct {
+	TestApiRequest
+	Response string
+	Headers map[string]string
+	Body nerdGraphRequest
+}
+
+func (p *TestPostApiRequest) Post(url string, headers map[string]string, body []byte) ([]byte, error) {
+	p.Headers = headers
+	json.Unmarshal(body, &p.Body)
+
+	if p.Response == "" {
+		return nil, errors.New("nerdgraph unavailable")
+	}
+
+	return []byte(p.Response), nil
+}
+
+func TestAccountApi_GetNrqlMetricThroughNerdGraph(t *testing.T) {
+	client := &TestPostApiRequest{
+		Response: `{"data":{"actor":{"account":{"nrql":{"results":[{"count":1200}]}}}}}`,
+	}
+	nr := NewUserKeyApi("NRAK-123", 1, client)
+
+	result, err := nr.ForAccount(2345).GetNrqlMetric(context.Background(), "SELECT count(*) FROM Transaction")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if result.Value != 1200 || result.AccountID != 2345 {
+		t.Errorf("Expected 1200 from account 2345, got %d from %d", result.Value, result.AccountID)
+	}
+
+	if client.Headers["api-key"] != "NRAK-123" {
+		t.Errorf("User key was not sent, got headers %v", client.Headers)
+	}
+
+	if client.Body.Variables["accountId"] != float64(2345) || client.Body.Variables["nrql"] != "SELECT count(*) FROM Transaction" {
+		t.Errorf("Query was not routed to the account, got variables %v", client.Body.Variables)
+	}
+}
+
+func TestAccountApi_GetNrqlMetricNerdGraphErrors(t *testing.T) {
+	nr := NewUserKeyApi("NRAK-123", 1, &TestPostApiRequest{
+		Response: `{"data":{"actor":{"account":null}},"errors":[{"message":"Account 9 not found"}]}`,
+	})
+
+	_, err := nr.ForAccount(9).GetNrqlMetric(context.Background(), "SELECT count(*) FROM Transaction")
+	if err == nil || err.Error() != "NerdGraph query failed: Account 9 not found" {
+		t.Errorf("NerdGraph errors are not bubbling up, got %v", err)
+	}
+}
+
+func TestAccountApi_RequiresPostSupport(t *testing.T) {
+	nr := NewUserKeyApi("NRAK-123", 1, TestApiRequest{})
+
+	_, err := nr.ForAccount(9).GetNrqlMetric(context.Background(), "SELECT count(*) FROM Transaction")
+	if err == nil {
+		t.Errorf("Expected an error for a client without POST support")
+	}
+}
@@ -0,0 +1,139 @@
+package newrelic
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	callAppId = "app_id"
+	callMetric = "metric"
+	callHostMetrics = "host_metrics"
+	callNrql = "nrql"
+)
+
+// flightKey identifies calls whose results can be shared. The Api already scopes REST calls to one account through
+// its key, accountId tells NRQL queries for different accounts apart.
+type flightKey struct {
+	call string
+	accountId int
+	appName string
+	query MetricQuery
+	nrql string
+}
+
+// flight is a call in progress, dups counts the callers that joined it and waiters the callers still waiting on it
+type flight struct {
+	done chan struct{}
+	result interface{}
+	err error
+	dups int
+	waiters int
+	cancel context.CancelFunc
+}
+
+// detachedContext keeps the values of the context a call started from, e.g. its trace, without its deadline or
+// cancellation, so a shared call does not fail because the caller that started it gave up
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+var errFlightPanicked = errors.New("the shared New Relic request panicked")
+
+// flightGroup shares the result of a call between every caller asking for the same key while it is in flight, so
+// several HPAs asking for the same app at once cost a single set of New Relic requests. Results are not kept once the
+// call returns, the app ID cache is what avoids repeated lookups over time.
+//
+// The call runs on its own, each caller waits for it until its own context is done. The call is cancelled once every
+// caller gave up.
+type flightGroup struct {
+	lock sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func (g *flightGroup) do(ctx context.Context, key flightKey, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.lock.Lock()
+	if g.flights == nil {
+		g.flights = map[flightKey]*flight{}
+	}
+
+	f, ok := g.flights[key]
+	if ok {
+		f.dups++
+		coalescedRequests.WithLabelValues(key.call).Inc()
+	} else {
+		callCtx, cancel := context.WithCancel(detachedContext{ctx})
+		// waiters get an error rather than a zero result if fn panics
+		f = &flight{done: make(chan struct{}), err: errFlightPanicked, cancel: cancel}
+		g.flights[key] = f
+		go g.run(callCtx, key, f, fn)
+	}
+
+	f.waiters++
+	g.lock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.lock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// later callers start a new call rather than joining the cancelled one
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+
+			f.cancel()
+		}
+		g.lock.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key flightKey, f *flight, fn func(ctx context.Context) (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Shared New Relic %s call panicked: %v", key.call, r)
+		}
+
+		g.lock.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.lock.Unlock()
+
+		f.cancel()
+		close(f.done)
+	}()
+
+	f.result, f.err = fn(ctx)
+}
+
+// dups returns how many callers joined the call in flight for key after the one that started it
+func (g *flightGroup) dups(key flightKey) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f.dups
+	}
+
+	return 0
+}
@@ -0,0 +1,151 @@
+package newrelic
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BlockingApiRequest holds every request until released
+type BlockingApiRequest struct {
+	TestApiRequest
+	Release chan struct{}
+	Calls int32
+}
+
+func (b *BlockingApiRequest) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	atomic.AddInt32(&b.Calls, 1)
+	<-b.Release
+	return b.TestApiRequest.Fetch(url, headers, params)
+}
+
+// waitForDups waits until dups callers joined the call in flight for key
+func waitForDups(t *testing.T, group *flightGroup, key flightKey, dups int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for group.dups(key) < dups {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d callers to join the call in flight, got %d", dups, group.dups(key))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApi_GetMetricCoalescesConcurrentLookups(t *testing.T) {
+	client := &BlockingApiRequest{Release: make(chan struct{})}
+	nr := NewApi("123", 1, client)
+
+	callers := 5
+	values := make([]int, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, _ := nr.GetMetric(context.Background(), "marketplace", HostCallsPerMinute)
+			values[i] = result.Value
+		}(i)
+	}
+
+	waitForDups(t, &nr.flights, flightKey{call: callMetric, appName: "marketplace", query: HostCallsPerMinute}, callers - 1)
+	close(client.Release)
+	wg.Wait()
+
+	// one listing of the apps, one of the hosts and one host's metric data
+	if client.Calls != 3 {
+		t.Errorf("Expected the callers to share 3 requests, got %d", client.Calls)
+	}
+
+	for i, value := range values {
+		if value != 120 {
+			t.Errorf("Expected caller %d to get 120, got %d", i, value)
+		}
+	}
+}
+
+func TestFlightGroup_SeparatesKeys(t *testing.T) {
+	group := &flightGroup{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	go group.do(context.Background(), flightKey{call: callMetric, appName: "marketplace", query: MetricQuery{Window: time.Minute}}, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-release
+		return 1, nil
+	})
+	<-started
+
+	// a different window is a different lookup and must not wait on the one in flight
+	result, err := group.do(context.Background(), flightKey{call: callMetric, appName: "marketplace", query: MetricQuery{Window: 5 * time.Minute}}, func(ctx context.Context) (interface{}, error) {
+		return 2, nil
+	})
+	close(release)
+
+	if err != nil || result.(int) != 2 {
+		t.Errorf("Expected its own result of 2, got %v (%v)", result, err)
+	}
+}
+
+func TestFlightGroup_CallOutlivesTheCallerThatStartedIt(t *testing.T) {
+	group := &flightGroup{}
+	key := flightKey{call: callMetric, appName: "marketplace"}
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return 120, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := group.do(first, key, fn)
+		firstErr <- err
+	}()
+
+	results := make(chan interface{})
+	go func() {
+		result, _ := group.do(context.Background(), key, fn)
+		results <- result
+	}()
+	waitForDups(t, group, key, 1)
+
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("Expected the first caller to stop waiting when its context is done, got %v", err)
+	}
+
+	close(release)
+	if result := <-results; result != 120 {
+		t.Errorf("Expected the other caller to get the result of 120, got %v", result)
+	}
+}
+
+func TestFlightGroup_CancelsTheCallOnceEveryCallerGaveUp(t *testing.T) {
+	group := &flightGroup{}
+	key := flightKey{call: callMetric, appName: "marketplace"}
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+
+	_, err := group.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the caller's deadline to be returned, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the call to be cancelled once no caller waits for it")
+	}
+}
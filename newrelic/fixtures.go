@@ -0,0 +1,277 @@
+package newrelic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// REDACTED replaces secrets in recorded fixtures
+const REDACTED = "REDACTED"
+
+// secretHeaders carry the API key in requests to the REST API, Insights and NerdGraph
+var secretHeaders = map[string]bool{"x-api-key": true, "x-query-key": true, "api-key": true}
+
+// Fixture is a request to New Relic and its response as recorded by FixtureRecorder
+type Fixture struct {
+	Request FixtureRequest `json:"request"`
+	Response FixtureResponse `json:"response"`
+}
+
+type FixtureRequest struct {
+	Method string `json:"method"`
+	// Path is the URL path without the host, so fixtures replay against any region or endpoint
+	Path string `json:"path"`
+	Params map[string]string `json:"params,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type FixtureResponse struct {
+	// Status is the HTTP status, zero when the request failed without a response
+	Status int `json:"status,omitempty"`
+	// Body holds JSON responses as is, BodyText holds anything else such as malformed JSON
+	Body json.RawMessage `json:"body,omitempty"`
+	BodyText string `json:"bodyText,omitempty"`
+	// Error is the transport error for requests that got no response
+	Error string `json:"error,omitempty"`
+}
+
+// ignoredParams change on every request, they are recorded but not used to match a request to its fixture
+var ignoredParams = map[string]bool{"from": true, "to": true}
+
+// key identifies the request a fixture answers
+func (r FixtureRequest) key() string {
+	names := []string{}
+	for name := range r.Params {
+		if !ignoredParams[name] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	key := r.Method + " " + r.Path
+	for _, name := range names {
+		key += " " + name + "=" + r.Params[name]
+	}
+
+	if len(r.Body) > 0 {
+		// recorded bodies are indented, compacting them matches them to the request
+		body := bytes.Buffer{}
+		if json.Compact(&body, r.Body) == nil {
+			key += " " + body.String()
+		} else {
+			key += " " + string(r.Body)
+		}
+	}
+
+	return key
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-z0-9]+`)
+
+// fileName is readable and unique per request, e.g. get-v2-applications-1234-metrics-data-json-0a1b2c3d.json
+func (r FixtureRequest) fileName() string {
+	sum := sha256.Sum256([]byte(r.key()))
+	slug := strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToLower(r.Method + " " + r.Path), "-"), "-")
+	return slug + "-" + hex.EncodeToString(sum[:4]) + ".json"
+}
+
+func newFixtureRequest(method string, uri string, headers map[string]string, params map[string]string, body []byte) FixtureRequest {
+	path := uri
+	if parsed, err := url.Parse(uri); err == nil {
+		path = parsed.Path
+	}
+
+	return FixtureRequest{Method: method, Path: path, Params: params, Headers: headers, Body: body}
+}
+
+// FixtureRecorder sends requests through Client and writes each request and its response to Dir, with the API
+// key and any other Secrets replaced by REDACTED. Requests sent again overwrite their earlier fixture.
+type FixtureRecorder struct {
+	Client GetApiRequest
+	Dir string
+	// Secrets are redacted wherever they appear, the values of API key headers are always redacted
+	Secrets []string
+	lock sync.Mutex
+}
+
+func NewFixtureRecorder(client GetApiRequest, dir string, secrets ...string) *FixtureRecorder {
+	return &FixtureRecorder{Client: client, Dir: dir, Secrets: secrets}
+}
+
+func (r *FixtureRecorder) Fetch(uri string, headers map[string]string, params map[string]string) ([]byte, error) {
+	body, err := r.Client.Fetch(uri, headers, params)
+	return body, r.record(newFixtureRequest("GET", uri, headers, params, nil), body, err)
+}
+
+// Post records NerdGraph requests, it fails like an Api's own client would when Client cannot POST
+func (r *FixtureRecorder) Post(uri string, headers map[string]string, requestBody []byte) ([]byte, error) {
+	poster, ok := r.Client.(PostApiRequest)
+	if !ok {
+		return nil, errors.New("http client does not support the POST requests NerdGraph requires")
+	}
+
+	body, err := poster.Post(uri, headers, requestBody)
+	return body, r.record(newFixtureRequest("POST", uri, headers, nil, requestBody), body, err)
+}
+
+// record writes the fixture and returns the request's own error, requests that succeeded fail when their fixture
+// cannot be written so a recording is never silently incomplete
+func (r *FixtureRecorder) record(request FixtureRequest, body []byte, err error) error {
+	fixture := Fixture{Request: r.redactRequest(request), Response: r.redactResponse(body, err)}
+	writeErr := r.write(fixture)
+	if err == nil && writeErr != nil {
+		return fmt.Errorf("could not record fixture: %v", writeErr)
+	}
+
+	return err
+}
+
+func (r *FixtureRecorder) write(fixture Fixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(r.Dir, fixture.Request.fileName()), append(data, '\n'), 0644)
+}
+
+func (r *FixtureRecorder) redact(value string) string {
+	for _, secret := range r.Secrets {
+		if secret != "" {
+			value = strings.Replace(value, secret, REDACTED, -1)
+		}
+	}
+
+	return value
+}
+
+func (r *FixtureRecorder) redactRequest(request FixtureRequest) FixtureRequest {
+	redacted := FixtureRequest{Method: request.Method, Path: r.redact(request.Path)}
+	if len(request.Params) > 0 {
+		redacted.Params = map[string]string{}
+		for name, value := range request.Params {
+			redacted.Params[name] = r.redact(value)
+		}
+	}
+
+	if len(request.Headers) > 0 {
+		redacted.Headers = map[string]string{}
+		for name, value := range request.Headers {
+			if secretHeaders[strings.ToLower(name)] {
+				value = REDACTED
+			}
+
+			redacted.Headers[name] = r.redact(value)
+		}
+	}
+
+	if len(request.Body) > 0 {
+		redacted.Body = json.RawMessage(r.redact(string(request.Body)))
+	}
+
+	return redacted
+}
+
+func (r *FixtureRecorder) redactResponse(body []byte, err error) FixtureResponse {
+	response := FixtureResponse{Status: 200}
+	if err != nil {
+		statusErr, ok := err.(*StatusError)
+		if !ok {
+			return FixtureResponse{Error: r.redact(err.Error())}
+		}
+
+		response.Status = statusErr.StatusCode
+		body = statusErr.Body
+	}
+
+	redacted := r.redact(string(body))
+	if json.Valid([]byte(redacted)) {
+		response.Body = json.RawMessage(redacted)
+	} else {
+		response.BodyText = redacted
+	}
+
+	return response
+}
+
+// FixtureReplayer answers requests with the fixtures recorded in a directory, matching them by method, path,
+// query parameters and body. Requests without a fixture fail.
+type FixtureReplayer struct {
+	fixtures map[string]Fixture
+}
+
+// NewFixtureReplayer loads every fixture in dir
+func NewFixtureReplayer(dir string) (*FixtureReplayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	replay := &FixtureReplayer{fixtures: map[string]Fixture{}}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		fixture := Fixture{}
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("could not parse fixture %s: %v", path, err)
+		}
+
+		replay.fixtures[fixture.Request.key()] = fixture
+	}
+
+	return replay, nil
+}
+
+func (r *FixtureReplayer) Fetch(uri string, headers map[string]string, params map[string]string) ([]byte, error) {
+	return r.replay(newFixtureRequest("GET", uri, headers, params, nil))
+}
+
+func (r *FixtureReplayer) Post(uri string, headers map[string]string, body []byte) ([]byte, error) {
+	return r.replay(newFixtureRequest("POST", uri, headers, nil, body))
+}
+
+func (r *FixtureReplayer) replay(request FixtureRequest) ([]byte, error) {
+	fixture, ok := r.fixtures[request.key()]
+	if !ok {
+		return nil, fmt.Errorf("no fixture recorded for %s", request.key())
+	}
+
+	response := fixture.Response
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	body := []byte(response.BodyText)
+	if len(response.Body) > 0 {
+		body = response.Body
+	}
+
+	if response.Status >= 400 {
+		return body, &StatusError{StatusCode: response.Status, Body: body}
+	}
+
+	return body, nil
+}
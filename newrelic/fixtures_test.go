@@ -0,0 +1,138 @@
+package newrelic
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fixtureDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "newrelic-fixtures")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestFixtureRecorder_RedactsSecrets(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	recorder := NewFixtureRecorder(&TestApiRequestListAppsFails{
+		Returns: []ApiReturn{{
+			UrlRegex: ".*applications.json$",
+			ReturnJson: `{"applications":[{"id":1234,"name":"marketplace","note":"key NRRA-secret-key"}]}`,
+		}},
+	}, dir, "NRRA-secret-key")
+	nr := NewApi("NRRA-secret-key", 1, recorder)
+	nr.getApplicationId(context.Background(), "marketplace")
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("Expected 1 fixture, got %v", paths)
+	}
+
+	data, _ := ioutil.ReadFile(paths[0])
+	if strings.Contains(string(data), "NRRA-secret-key") || !strings.Contains(string(data), REDACTED) {
+		t.Errorf("Expected the key to be redacted, got %s", data)
+	}
+}
+
+func TestFixtureRecorder_ReplaysRecordedResponses(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	client := &TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: ".*applications.json$",
+				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
+			},
+			{
+				UrlRegex: `.*applications/1234/metrics/data.json`,
+				ReturnJson: `{"metric_data":{"from":"foo","to":"foo","metrics_not_found":[],"metrics_found":["HttpDispatcher"],"metrics":[{"name":"HttpDispatcher","timeslices":[{"from":"foo","to":"foo","values":{"requests_per_minute":250}}]}]}}`,
+			},
+		},
+	}
+	NewApi("123", 1, NewFixtureRecorder(client, dir)).GetApplicationMetric(context.Background(), "marketplace")
+
+	replay, err := NewFixtureReplayer(dir)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	result, err := NewApi("other-key", 1, replay).GetApplicationMetric(context.Background(), "marketplace")
+	if err != nil || result.Value != 250 {
+		t.Errorf("Expected the recorded 250, got %d (%v)", result.Value, err)
+	}
+
+	if _, err := NewApi("other-key", 1, replay).GetApplicationMetric(context.Background(), "checkout"); err == nil || !strings.Contains(err.Error(), "no fixture recorded") {
+		t.Errorf("Expected requests without a fixture to fail, got %v", err)
+	}
+}
+
+func TestFixtureRecorder_ReplaysErrors(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	recorder := NewFixtureRecorder(&FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 429, Body: []byte(`{"error":{"title":"Rate limited"}}`)}}}, dir)
+	recorder.Fetch("https://api.newrelic.com/v2/applications.json", nil, nil)
+	recorder = NewFixtureRecorder(&TestApiRequestListAppsFails{
+		Returns: []ApiReturn{{UrlRegex: "hosts.json$", ErrorReturn: "connection reset by peer"}},
+	}, dir)
+	recorder.Fetch("https://api.newrelic.com/v2/applications/1234/hosts.json", nil, nil)
+
+	replay, _ := NewFixtureReplayer(dir)
+	_, err := replay.Fetch("https://api.eu.newrelic.com/v2/applications.json", nil, nil)
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != 429 {
+		t.Errorf("Expected the recorded 429 from any region, got %v", err)
+	}
+
+	_, err = replay.Fetch("https://api.newrelic.com/v2/applications/1234/hosts.json", nil, nil)
+	if err == nil || err.Error() != "connection reset by peer" {
+		t.Errorf("Expected the recorded transport error, got %v", err)
+	}
+}
+
+func TestFixtureRecorder_ReplaysNerdGraph(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	NewUserKeyApi("NRAK-123", 1, NewFixtureRecorder(&TestPostApiRequest{
+		Response: `{"data":{"actor":{"account":{"nrql":{"results":[{"count":1200}]}}}}}`,
+	}, dir)).GetNrqlMetric(context.Background(), 2345, "SELECT count(*) FROM Transaction")
+
+	replay, _ := NewFixtureReplayer(dir)
+	result, err := NewUserKeyApi("NRAK-456", 1, replay).GetNrqlMetric(context.Background(), 2345, "SELECT count(*) FROM Transaction")
+	if err != nil || result.Value != 1200 {
+		t.Errorf("Expected the recorded 1200, got %d (%v)", result.Value, err)
+	}
+}
+
+func TestFixtureRecorder_RequiresPostForNerdGraph(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	_, err := NewFixtureRecorder(TestApiRequest{}, dir).Post("https://api.newrelic.com/graphql", nil, []byte(`{}`))
+	if err == nil {
+		t.Errorf("Expected an error when the client cannot POST")
+	}
+}
+
+func TestNewFixtureReplayer_BrokenFixture(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+
+	if _, err := NewFixtureReplayer(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Expected an empty replay for a missing directory, got %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644)
+	if _, err := NewFixtureReplayer(dir); err == nil {
+		t.Errorf("Expected an error for a broken fixture")
+	}
+}
@@ -0,0 +1,105 @@
+package newrelic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ErrCanceled is returned for requests cut off by the client's context, they are not retried
+var ErrCanceled = errors.New("New Relic request canceled, the adapter is shutting down")
+
+// HttpGetClient sends requests to New Relic over HTTP
+type HttpGetClient struct {
+	// Timeout bounds each request, zero means no timeout
+	Timeout time.Duration
+	// Context cancels the requests in flight when it is done, nil never cancels them
+	Context context.Context
+}
+
+// do sends req within the client's context
+func (c HttpGetClient) do(req *http.Request) (*http.Response, error) {
+	client := http.Client{Timeout: c.Timeout}
+	if c.Context == nil {
+		return client.Do(req)
+	}
+
+	res, err := client.Do(req.WithContext(c.Context))
+	if err != nil && c.Context.Err() != nil {
+		return nil, ErrCanceled
+	}
+
+	return res, err
+}
+
+func (c HttpGetClient) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	q := req.URL.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+
+	req.URL.RawQuery = q.Encode()
+
+	res, err := c.do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	glog.Infof("Request made to %s with params %v, response was: %s", url, params, body)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return body, responseError(res, body)
+}
+
+// responseError turns error statuses into a StatusError so they are counted and retried by status
+func responseError(res *http.Response, body []byte) error {
+	if res.StatusCode >= http.StatusBadRequest {
+		return &StatusError{StatusCode: res.StatusCode, Body: body}
+	}
+
+	return nil
+}
+
+func (c HttpGetClient) Post(url string, headers map[string]string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer res.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(res.Body)
+	glog.Infof("POST request made to %s, response was: %s", url, responseBody)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return responseBody, responseError(res, responseBody)
+}
@@ -0,0 +1,171 @@
+package newrelic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+const (
+	endpointApplications = "applications"
+	endpointHosts = "hosts"
+	endpointMetricData = "metric_data"
+	endpointInsightsQuery = "insights_query"
+	endpointNerdGraph = "nerdgraph"
+)
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_api_requests_total",
+		Help: "Requests made to New Relic by endpoint and status code, transport failures have the code \"error\".",
+	}, []string{"endpoint", "code"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "newrelic_adapter_api_request_duration_seconds",
+		Help: "Latency of requests made to New Relic by endpoint, retries are timed separately.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"endpoint"})
+	apiRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_api_retries_total",
+		Help: "Requests to New Relic that were retried after a transport error, a 429 or a 5xx.",
+	}, []string{"endpoint"})
+	appIdCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_app_id_cache_requests_total",
+		Help: "App name to ID lookups by result (hit or miss).",
+	}, []string{"result"})
+	lastSuccessfulFetch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "newrelic_adapter_last_successful_fetch_timestamp_seconds",
+		Help: "Unix time of the last metric successfully read from New Relic for each app.",
+	}, []string{"app"})
+	coalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_coalesced_requests_total",
+		Help: "Lookups that shared the result of an identical lookup already in flight, by call.",
+	}, []string{"call"})
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_rate_limited_requests_total",
+		Help: "Requests that gave up waiting for the adapter's rate limiter, by priority.",
+	}, []string{"priority"})
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiRequestDuration, apiRetries, appIdCacheRequests, lastSuccessfulFetch, coalescedRequests, rateLimitedRequests)
+}
+
+// StatusError is returned by GetApiRequest implementations when New Relic responds with an error status
+type StatusError struct {
+	StatusCode int
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("New Relic responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable reports whether a failed request may succeed when sent again
+func retryable(err error) bool {
+	if err == ErrCanceled {
+		return false
+	}
+
+	statusErr, ok := err.(*StatusError)
+	if !ok {
+		// transport errors such as timeouts and resets
+		return true
+	}
+
+	return statusErr.StatusCode == 429 || statusErr.StatusCode >= 500
+}
+
+func statusCode(err error) string {
+	if err == nil {
+		return "2xx"
+	}
+
+	if statusErr, ok := err.(*StatusError); ok {
+		return strconv.Itoa(statusErr.StatusCode)
+	}
+
+	return "error"
+}
+
+// SetRetries retries failed requests up to retries times, waiting backoff before the first retry and doubling it
+// before each following one. Only transport errors, 429s and 5xx responses are retried.
+func (nr *Api) SetRetries(retries int, backoff time.Duration) {
+	nr.retries = retries
+	nr.retryBackoff = backoff
+}
+
+// send makes a request to New Relic for uri through request, recording it and retrying it as configured. Every attempt
+// waits for the rate limits of the key and, when accountId is set, of the account, and is traced as its own span.
+func (nr *Api) send(ctx context.Context, endpoint string, priority Priority, accountId int, uri string, request func() ([]byte, error)) ([]byte, error) {
+	backoff := nr.retryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := nr.waitForRateLimit(ctx, priority, accountId); err != nil {
+			return nil, err
+		}
+
+		_, span := tracing.Start(ctx, "newrelic.request",
+			tracing.String("newrelic.endpoint", endpoint),
+			tracing.String("http.url", tracing.RedactUrl(uri)),
+			tracing.Int("newrelic.attempt", attempt),
+		)
+
+		start := time.Now()
+		body, err := request()
+		span.SetAttributes(tracing.String("newrelic.status", statusCode(err)))
+		tracing.End(span, err)
+		apiRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		apiRequests.WithLabelValues(endpoint, statusCode(err)).Inc()
+		if err == nil {
+			nr.lastSuccess.Store(time.Now())
+		}
+
+		if err == nil || attempt >= nr.retries || !retryable(err) {
+			return body, err
+		}
+
+		apiRetries.WithLabelValues(endpoint).Inc()
+
+		// callers that gave up do not wait for the retry, they get the last failure
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return body, err
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
+
+// decode unmarshals a response of endpoint into v, traced apart from the request so large responses that are slow
+// to read show up on their own
+func decode(ctx context.Context, endpoint string, body []byte, v interface{}) error {
+	_, span := tracing.Start(ctx, "newrelic.decode",
+		tracing.String("newrelic.endpoint", endpoint),
+		tracing.Int("newrelic.response_bytes", len(body)),
+	)
+
+	err := json.Unmarshal(body, v)
+	tracing.End(span, err)
+	return err
+}
+
+func recordSuccessfulFetch(appName string) {
+	lastSuccessfulFetch.WithLabelValues(appName).SetToCurrentTime()
+}
+
+// CheckConnectivity passes when New Relic answered a request within maxAge. Otherwise the apps are listed as a probe,
+// so a revoked key or an unreachable API fails the check while an idle adapter does not. Only the first page is read.
+func (nr *Api) CheckConnectivity(maxAge time.Duration) error {
+	if last, ok := nr.lastSuccess.Load().(time.Time); ok && time.Since(last) <= maxAge {
+		return nil
+	}
+
+	_, err := nr.listAppsPage(context.Background(), "", 1)
+	return err
+}
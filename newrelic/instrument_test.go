@@ -0,0 +1,196 @@
+package newrelic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type FlakyApiRequest struct {
+	Failures []error
+	Calls int
+}
+
+func (f *FlakyApiRequest) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	f.Calls++
+	if f.Calls <= len(f.Failures) {
+		return nil, f.Failures[f.Calls - 1]
+	}
+
+	return []byte(`{"applications":[{"id":1234,"name":"marketplace"}]}`), nil
+}
+
+func TestApi_RetriesTransientFailures(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 503}, errors.New("connection reset")}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(2, 0)
+
+	appId, err := nr.getApplicationId(context.Background(), "marketplace")
+	if err != nil || appId != 1234 {
+		t.Fatalf("Expected app 1234 after retrying, got %d (%v)", appId, err)
+	}
+
+	if client.Calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", client.Calls)
+	}
+}
+
+func TestApi_DoesNotRetryClientErrors(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 401}}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(2, 0)
+
+	_, err := nr.getApplicationId(context.Background(), "marketplace")
+	if err == nil || client.Calls != 1 {
+		t.Errorf("Expected a single failed attempt, got %d attempts (%v)", client.Calls, err)
+	}
+}
+
+func TestApi_DoesNotRetryCanceledRequests(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{ErrCanceled}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(2, 0)
+
+	_, err := nr.getApplicationId(context.Background(), "marketplace")
+	if err != ErrCanceled || client.Calls != 1 {
+		t.Errorf("Expected a single canceled attempt, got %d attempts (%v)", client.Calls, err)
+	}
+}
+
+func TestHttpGetClient_CanceledByContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20 * time.Millisecond, cancel)
+
+	_, err := HttpGetClient{Timeout: 5 * time.Second, Context: ctx}.Fetch(server.URL, map[string]string{}, map[string]string{})
+	if err != ErrCanceled {
+		t.Errorf("Expected the request to be canceled, got %v", err)
+	}
+}
+
+func TestApi_GivesUpAfterRetries(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 429}, &StatusError{StatusCode: 429}}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(1, 0)
+
+	_, err := nr.getApplicationId(context.Background(), "marketplace")
+	if err == nil || client.Calls != 2 {
+		t.Errorf("Expected to give up after 2 attempts, got %d attempts (%v)", client.Calls, err)
+	}
+}
+
+func TestApi_StopsRetryingWhenTheCallerGivesUp(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 503}}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(2, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20 * time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := nr.lookupApplicationId(ctx, "marketplace")
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != 503 || client.Calls != 1 {
+		t.Errorf("Expected the 503 after a single attempt, got %d attempts (%v)", client.Calls, err)
+	}
+
+	if waited := time.Since(start); waited > 5 * time.Second {
+		t.Errorf("Expected the backoff to stop with the context, waited %s", waited)
+	}
+}
+
+func spanAttribute(span *tracing.Span, key string) string {
+	return fmt.Sprint(span.Attribute(key))
+}
+
+func TestApi_TracesEachAttempt(t *testing.T) {
+	recorder := tracing.Record()
+
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 503}}}
+	nr := NewApi("123", 1, client)
+	nr.SetRetries(1, 0)
+	nr.SetAppIdTTL(time.Minute)
+
+	nr.getApplicationId(context.Background(), "marketplace")
+	nr.getApplicationId(context.Background(), "marketplace")
+
+	byName := map[string][]*tracing.Span{}
+	for _, span := range recorder.Ended() {
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+
+	attempts := byName["newrelic.request"]
+	if len(attempts) != 2 {
+		t.Fatalf("Expected a span for each of the 2 attempts, got %d", len(attempts))
+	}
+
+	if attempts[0].Err() == nil || spanAttribute(attempts[0], "newrelic.status") != "503" {
+		t.Errorf("Expected the first attempt to be failed with a 503, got %v", attempts[0].Err())
+	}
+
+	if url := spanAttribute(attempts[1], "http.url"); url != "https://api.newrelic.com/v2/applications.json" {
+		t.Errorf("Expected the url without its query, got %s", url)
+	}
+
+	lookups := byName["newrelic.resolveApplicationId"]
+	if len(lookups) != 2 || spanAttribute(lookups[0], "newrelic.cache_hit") != "false" || spanAttribute(lookups[1], "newrelic.cache_hit") != "true" {
+		t.Fatalf("Expected a lookup missing and then hitting the cache, got %d lookups", len(lookups))
+	}
+
+	listApps := byName["newrelic.listApps"]
+	if len(listApps) != 1 || listApps[0].ParentSpanID() != lookups[0].SpanID() {
+		t.Fatalf("Expected the apps to be listed under the first lookup")
+	}
+
+	for _, attempt := range attempts {
+		if attempt.ParentSpanID() != listApps[0].SpanID() {
+			t.Errorf("Expected the requests to be made under the app listing")
+		}
+	}
+
+	decodes := byName["newrelic.decode"]
+	if len(decodes) != 1 || decodes[0].ParentSpanID() != listApps[0].SpanID() || spanAttribute(decodes[0], "newrelic.endpoint") != endpointApplications {
+		t.Errorf("Expected the app list to be decoded under the app listing, got %d decodes", len(decodes))
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	codes := map[string]error{
+		"2xx": nil,
+		"404": &StatusError{StatusCode: 404},
+		"error": errors.New("timeout"),
+	}
+
+	for expected, err := range codes {
+		if code := statusCode(err); code != expected {
+			t.Errorf("Expected %s, got %s", expected, code)
+		}
+	}
+}
+
+func TestApi_CheckConnectivityProbesWhenIdle(t *testing.T) {
+	client := &FlakyApiRequest{Failures: []error{&StatusError{StatusCode: 401}}}
+	nr := NewApi("revoked", 1, client)
+
+	if err := nr.CheckConnectivity(time.Minute); err == nil {
+		t.Errorf("Expected a revoked key to fail the check")
+	}
+
+	if err := nr.CheckConnectivity(time.Minute); err != nil {
+		t.Errorf("Expected a successful probe to pass, got %s", err)
+	}
+
+	if err := nr.CheckConnectivity(time.Minute); err != nil || client.Calls != 2 {
+		t.Errorf("Expected the recent success to be reused, got %d calls (%v)", client.Calls, err)
+	}
+}
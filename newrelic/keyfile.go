@@ -0,0 +1,71 @@
+package newrelic
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// SetApiKey swaps the key used for new requests. Requests already sent keep the key they were made with, since
+// the key is read once when each request is built.
+func (nr *Api) SetApiKey(apiKey string) {
+	nr.apiKey.Store(apiKey)
+}
+
+func (nr *Api) currentApiKey() string {
+	return nr.apiKey.Load().(string)
+}
+
+// ReadApiKeyFile reads an API key from a file such as a mounted Secret, surrounding whitespace is ignored
+func ReadApiKeyFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	apiKey := strings.TrimSpace(string(contents))
+	if apiKey == "" {
+		return "", errors.New("API key file " + path + " is empty")
+	}
+
+	return apiKey, nil
+}
+
+// WatchApiKeyFile polls the file every interval and swaps in its key when it changes, until stopCh is closed.
+// Polling is used rather than inotify because kubelet updates mounted Secrets by swapping a symlink.
+func (nr *Api) WatchApiKeyFile(path string, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	nr.keyFileHeartbeat.Start(interval)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			nr.reloadApiKeyFile(path)
+			nr.keyFileHeartbeat.Beat()
+		}
+	}
+}
+
+// CheckApiKeyFileWatcher fails when WatchApiKeyFile stopped polling, a rotated key would then never be picked up
+func (nr *Api) CheckApiKeyFileWatcher() error {
+	return nr.keyFileHeartbeat.Check()
+}
+
+func (nr *Api) reloadApiKeyFile(path string) {
+	apiKey, err := ReadApiKeyFile(path)
+	if err != nil {
+		// keep the current key, a half written or missing file should not break every request
+		glog.Warningf("Could not reload API key from %s: %v", path, err)
+		return
+	}
+
+	if apiKey != nr.currentApiKey() {
+		glog.Infof("API key in %s changed, using it for new requests", path)
+		nr.SetApiKey(apiKey)
+	}
+}
@@ -0,0 +1,76 @@
+package newrelic
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type KeyRecordingApiRequest struct {
+	TestApiRequest
+	Keys []string
+}
+
+func (k *KeyRecordingApiRequest) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	k.Keys = append(k.Keys, headers["x-api-key"])
+	return k.TestApiRequest.Fetch(url, headers, params)
+}
+
+func TestApi_SetApiKeyUsedForNewRequests(t *testing.T) {
+	client := &KeyRecordingApiRequest{}
+	nr := NewApi("old-key", 1, client)
+
+	nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
+	nr.SetApiKey("new-key")
+	nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
+
+	if client.Keys[0] != "old-key" || client.Keys[len(client.Keys) - 1] != "new-key" {
+		t.Errorf("Expected requests to move from old-key to new-key, got %v", client.Keys)
+	}
+}
+
+func TestApi_WatchApiKeyFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "newrelic-key")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "apiKey")
+	ioutil.WriteFile(path, []byte("old-key\n"), 0600)
+
+	apiKey, err := ReadApiKeyFile(path)
+	if err != nil || apiKey != "old-key" {
+		t.Fatalf("Expected old-key, got %q (%v)", apiKey, err)
+	}
+
+	nr := NewApi(apiKey, 1, TestApiRequest{})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nr.WatchApiKeyFile(path, 10 * time.Millisecond, stopCh)
+
+	ioutil.WriteFile(path, []byte("new-key\n"), 0600)
+	deadline := time.Now().Add(2 * time.Second)
+	for nr.currentApiKey() != "new-key" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if nr.currentApiKey() != "new-key" {
+		t.Errorf("Key was not reloaded from the file")
+	}
+}
+
+func TestApi_ReloadKeepsKeyWhenFileIsEmpty(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "newrelic-key")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "apiKey")
+	ioutil.WriteFile(path, []byte(""), 0600)
+
+	nr := NewApi("old-key", 1, TestApiRequest{})
+	nr.reloadApiKeyFile(path)
+
+	if nr.currentApiKey() != "old-key" {
+		t.Errorf("Empty key file should not replace the key")
+	}
+}
@@ -1,11 +1,17 @@
 package newrelic
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"github.com/flexshopper/newrelic-custom-metrics/health"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
 	"github.com/golang/glog"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type applicationEntry struct {
@@ -44,6 +50,7 @@ type metricsDataResponse struct {
 
 type applicationHost struct {
 	ID int `json:"id"`
+	Host string `json:"host"`
 }
 
 type applicationHostResponse struct {
@@ -56,42 +63,151 @@ type GetApiRequest interface {
 
 type Api struct {
 	baseUri string
+	insightsBaseUri string
+	nerdGraphUri string
+	// userKey routes NRQL queries through NerdGraph, which can reach every account the key has access to
+	userKey bool
 	minRpmForConsideration int
-	apiKey string
+	// apiKey holds the current key as a string, it is swapped atomically when the key is rotated
+	apiKey atomic.Value
 	httpClient GetApiRequest
+	retries int
+	retryBackoff time.Duration
+	// lastSuccess is the time.Time of the last request New Relic answered successfully
+	lastSuccess atomic.Value
+	keyFileHeartbeat health.Heartbeat
+	// appIdTTL is how long an app name to ID lookup is reused, 0 lists the apps on every request
+	appIdTTL time.Duration
+	appIdsLock sync.Mutex
+	appIds map[string]cachedAppId
+	// rateLimiter limits the requests made with the key, accountRateLimiters the NRQL queries made to each account
+	rateLimiter *RateLimiter
+	accountRateLimiters map[int]*RateLimiter
+	// flights coalesces concurrent identical lookups into one set of requests
+	flights flightGroup
+}
+
+type cachedAppId struct {
+	id int
+	expires time.Time
+}
+
+const (
+	// AggregationSummary is an app level value summarized by New Relic over the query window
+	AggregationSummary = "summary"
+	// AggregationHostAverage is the average of per-host values above the minimum RPM
+	AggregationHostAverage = "host_average"
+	// AggregationHost is the value of a single host
+	AggregationHost = "host"
+	// AggregationNrql is the single result of an NRQL query
+	AggregationNrql = "nrql"
+)
+
+// MetricResult is a value read from New Relic along with what it describes
+type MetricResult struct {
+	// AccountID is only set for NRQL queries, which are made against an account
+	AccountID int
+	AppName string
+	AppID int
+	// Host is the host name reported by the agent, only set for AggregationHost
+	Host string
+	MetricName string
+	ValueKey string
+	Aggregation string
+	Value int
+	// Timestamp is the end of the New Relic timeslice the value was read from, zero when it could not be parsed
+	Timestamp time.Time
+	// HostCount and ConsideredHostCount are only set for per-host aggregations
+	HostCount int
+	ConsideredHostCount int
+}
+
+// IsStale reports whether the data is older than maxAge, a maxAge of zero disables the check. Results without a
+// timestamp are always considered stale since their age is unknown.
+func (r MetricResult) IsStale(maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	if r.Timestamp.IsZero() {
+		return true
+	}
+
+	return now.Sub(r.Timestamp) > maxAge
 }
 
 type RpmProvider interface {
-	GetApplicationRpm(appName string) (int, error)
+	GetApplicationMetric(ctx context.Context, appName string) (MetricResult, error)
+	GetPerHostMetrics(ctx context.Context, appName string) ([]MetricResult, error)
+	GetMetric(ctx context.Context, appName string, query MetricQuery) (MetricResult, error)
+	GetNrqlMetric(ctx context.Context, accountId int, nrql string) (MetricResult, error)
 }
 
 func NewApi(apiKey string, minRpmForConsideration int, client GetApiRequest) *Api {
-	return &Api{
-		baseUri: "https://api.newrelic.com/v2/",
-		apiKey: apiKey,
+	api := &Api{
 		minRpmForConsideration: minRpmForConsideration,
 		httpClient: client,
+		appIds: map[string]cachedAppId{},
 	}
+
+	api.UseRegion(RegionUS)
+	api.SetApiKey(apiKey)
+	return api
 }
 
-func (nr *Api) apiRequest(uri string, queryParams map[string]string) ([]byte, error) {
+func (nr *Api) apiRequest(ctx context.Context, endpoint string, priority Priority, uri string, queryParams map[string]string) ([]byte, error) {
 	headers := map[string]string{
-		"x-api-key": nr.apiKey,
+		"x-api-key": nr.currentApiKey(),
 		"content-type": "application/json",
 	}
 
-	return nr.httpClient.Fetch(uri, headers, queryParams)
+	return nr.send(ctx, endpoint, priority, 0, uri, func() ([]byte, error) {
+		return nr.httpClient.Fetch(uri, headers, queryParams)
+	})
+}
+
+// appsPageSize is how many applications the REST API returns per page
+const appsPageSize = 200
+
+// listApps returns the apps whose name contains nameFilter, following the REST API's pages
+func (nr *Api) listApps(ctx context.Context, nameFilter string) (apps applicationList, err error) {
+	ctx, span := tracing.Start(ctx, "newrelic.listApps", tracing.String("newrelic.name_filter", nameFilter))
+	defer func() {
+		span.SetAttributes(tracing.Int("newrelic.apps", len(apps.Applications)))
+		tracing.End(span, err)
+	}()
+
+	for page := 1; ; page++ {
+		appPage, err := nr.listAppsPage(ctx, nameFilter, page)
+		if err != nil {
+			return applicationList{}, err
+		}
+
+		apps.Applications = append(apps.Applications, appPage.Applications...)
+		if len(appPage.Applications) < appsPageSize {
+			return apps, nil
+		}
+	}
 }
 
-func (nr *Api) listApps() (applicationList, error) {
-	body, err := nr.apiRequest(nr.baseUri + "applications.json", map[string]string{})
+func (nr *Api) listAppsPage(ctx context.Context, nameFilter string, page int) (applicationList, error) {
+	params := map[string]string{}
+	if nameFilter != "" {
+		params["filter[name]"] = nameFilter
+	}
+
+	if page > 1 {
+		params["page"] = strconv.Itoa(page)
+	}
+
+	body, err := nr.apiRequest(ctx, endpointApplications, PriorityHigh, nr.baseUri + "applications.json", params)
 
 	if err != nil {
 		return applicationList{}, err
 	}
 
 	appList := applicationList{}
-	err = json.Unmarshal(body, &appList)
+	err = decode(ctx, endpointApplications, body, &appList)
 	if err != nil {
 		return applicationList{}, err
 	}
@@ -99,16 +215,16 @@ func (nr *Api) listApps() (applicationList, error) {
 	return appList, nil
 }
 
-func (nr *Api) getHostsForApp(appId int) (applicationHostResponse, error) {
+func (nr *Api) getHostsForApp(ctx context.Context, appId int) (applicationHostResponse, error) {
 	uri := nr.baseUri + "applications/"+ strconv.Itoa(appId) +"/hosts.json"
-	body, err := nr.apiRequest(uri, map[string]string{})
+	body, err := nr.apiRequest(ctx, endpointHosts, PriorityLow, uri, map[string]string{})
 
 	if err != nil {
 		return applicationHostResponse{}, err
 	}
 
 	appHosts := applicationHostResponse{}
-	err = json.Unmarshal(body, &appHosts)
+	err = decode(ctx, endpointHosts, body, &appHosts)
 	if err != nil {
 		return applicationHostResponse{}, err
 	}
@@ -116,8 +232,57 @@ func (nr *Api) getHostsForApp(appId int) (applicationHostResponse, error) {
 	return appHosts, nil
 }
 
-func (nr *Api) getApplicationId(appName string) (int, error) {
-	apps, err := nr.listApps()
+// SetAppIdTTL caches app name to ID lookups for ttl, app IDs only change when an app is deleted and recreated
+func (nr *Api) SetAppIdTTL(ttl time.Duration) {
+	nr.appIdsLock.Lock()
+	defer nr.appIdsLock.Unlock()
+
+	nr.appIdTTL = ttl
+	nr.appIds = map[string]cachedAppId{}
+}
+
+func (nr *Api) getApplicationId(ctx context.Context, appName string) (appId int, err error) {
+	ctx, span := tracing.Start(ctx, "newrelic.resolveApplicationId", tracing.String("newrelic.app_name", appName))
+	defer func() {
+		span.SetAttributes(tracing.Int("newrelic.app_id", appId))
+		tracing.End(span, err)
+	}()
+
+	nr.appIdsLock.Lock()
+	cached, ok := nr.appIds[appName]
+	ttl := nr.appIdTTL
+	nr.appIdsLock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		appIdCacheRequests.WithLabelValues("hit").Inc()
+		span.SetAttributes(tracing.Bool("newrelic.cache_hit", true))
+		return cached.id, nil
+	}
+
+	appIdCacheRequests.WithLabelValues("miss").Inc()
+	span.SetAttributes(tracing.Bool("newrelic.cache_hit", false))
+
+	lookup, err := nr.flights.do(ctx, flightKey{call: callAppId, appName: appName}, func(ctx context.Context) (interface{}, error) {
+		return nr.lookupApplicationId(ctx, appName)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	appId = lookup.(int)
+
+	if ttl > 0 {
+		nr.appIdsLock.Lock()
+		nr.appIds[appName] = cachedAppId{id: appId, expires: time.Now().Add(ttl)}
+		nr.appIdsLock.Unlock()
+	}
+
+	return appId, nil
+}
+
+func (nr *Api) lookupApplicationId(ctx context.Context, appName string) (int, error) {
+	// the name filter matches substrings, so the exact name is still looked for below
+	apps, err := nr.listApps(ctx, appName)
 	if err != nil {
 		return 0, err
 	}
@@ -149,7 +314,7 @@ func (nr *Api) parseInt(value json.Number) (int, error) {
 	} else {
 		rpmLarge, err := value.Int64()
 		if err != nil {
-			return 0, nil
+			return 0, err
 		}
 
 		intVal = int(rpmLarge)
@@ -158,88 +323,64 @@ func (nr *Api) parseInt(value json.Number) (int, error) {
 	return intVal, nil
 }
 
-func (nr *Api) GetApplicationRpm(appName string) (int, error) {
-	appId, err := nr.getApplicationId(appName)
+// parseTimestamp parses a timeslice time, New Relic returns them as RFC3339 (e.g. 2019-02-12T17:54:00+00:00)
+func (nr *Api) parseTimestamp(value string) time.Time {
+	timestamp, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		return 0, err
-	}
-
-	uri := nr.baseUri + "applications/"+ strconv.Itoa(appId) +"/metrics/data.json"
-	params := map[string]string{
-		"names[]": "HttpDispatcher",
-		"values[]": "requests_per_minute",
-		"summarize": "true",
+		glog.Warningf("Could not parse timeslice time %q: %v", value, err)
+		return time.Time{}
 	}
 
-	body, err := nr.apiRequest(uri, params)
-
-	if err != nil {
-		return 0, err
-	}
-
-	appMetrics := metricsDataResponse{}
-	err = json.Unmarshal(body, &appMetrics)
-	if err != nil {
-		return 0, err
-	}
-
-	cpm := appMetrics.MetricsData.Metrics[0].TimeSlices[0].Values["requests_per_minute"]
-	return nr.parseInt(cpm)
+	return timestamp
 }
 
-func (nr *Api) getHostRpm(hostId int, appId int) (int, error) {
-	uri := nr.baseUri + "applications/"+ strconv.Itoa(appId) +"/hosts/"+ strconv.Itoa(hostId) +"/metrics/data.json"
-	params := map[string]string{
-		"names[]": "HttpDispatcher",
-		"values[]": "calls_per_minute",
-		"summarize": "true",
-	}
+func (nr *Api) GetApplicationMetric(ctx context.Context, appName string) (MetricResult, error) {
+	return nr.GetMetric(ctx, appName, RequestsPerMinute)
+}
 
-	body, err := nr.apiRequest(uri, params)
+func (nr *Api) GetApplicationRpm(ctx context.Context, appName string) (int, error) {
+	result, err := nr.GetApplicationMetric(ctx, appName)
+	return result.Value, err
+}
 
-	if err != nil {
-		return 0, err
-	}
+// GetPerHostMetrics returns the RPM of every host reporting for the app
+func (nr *Api) GetPerHostMetrics(ctx context.Context, appName string) ([]MetricResult, error) {
+	return nr.GetPerHostMetricsFor(ctx, appName, HostCallsPerMinute)
+}
 
-	hostMetrics := metricsDataResponse{}
-	err = json.Unmarshal(body, &hostMetrics)
+// GetPerHostMetricsFor reads a REST API metric for every host reporting for the app, concurrent callers asking for
+// the same app and query share one set of requests
+func (nr *Api) GetPerHostMetricsFor(ctx context.Context, appName string, query MetricQuery) ([]MetricResult, error) {
+	shared, err := nr.flights.do(ctx, flightKey{call: callHostMetrics, appName: appName, query: query}, func(ctx context.Context) (interface{}, error) {
+		return nr.fetchPerHostMetrics(ctx, appName, query)
+	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	cpm := hostMetrics.MetricsData.Metrics[0].TimeSlices[0].Values["calls_per_minute"]
-	return nr.parseInt(cpm)
+	// every caller gets its own slice since the results are shared
+	return append([]MetricResult{}, shared.([]MetricResult)...), nil
 }
 
-func (nr *Api) GetRPMAverageAcrossHosts(appName string) (int, error) {
-	appId, err := nr.getApplicationId(appName)
+func (nr *Api) fetchPerHostMetrics(ctx context.Context, appName string, query MetricQuery) ([]MetricResult, error) {
+	appId, err := nr.getApplicationId(ctx, appName)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	hosts, err := nr.getHostsForApp(appId)
-	if err != nil {
-		return 0, err
+	results, err := nr.getPerHostMetrics(ctx, appName, appId, query)
+	if err == nil {
+		recordSuccessfulFetch(appName)
 	}
 
-	totalRpm := 0
-	consideredHosts := 0
-	for _, host := range hosts.Hosts {
-		hostRpm, err := nr.getHostRpm(host.ID, appId)
-		if err != nil {
-			return 0, err
-		}
-
-		if hostRpm >= nr.minRpmForConsideration {
-			consideredHosts++
-			totalRpm += hostRpm
-		}
-	}
+	return results, err
+}
 
-	if consideredHosts == 0 {
-		glog.Warningf("No hosts were found to be above the minimum RPM of %d", nr.minRpmForConsideration)
-		return 0, nil
-	}
+func (nr *Api) GetHostAverageMetric(ctx context.Context, appName string) (MetricResult, error) {
+	return nr.GetMetric(ctx, appName, HostCallsPerMinute)
+}
 
-	return int(totalRpm / consideredHosts), nil
-}
\ No newline at end of file
+func (nr *Api) GetRPMAverageAcrossHosts(ctx context.Context, appName string) (int, error) {
+	result, err := nr.GetHostAverageMetric(ctx, appName)
+	return result.Value, err
+}
@@ -1,10 +1,13 @@
 package newrelic
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 )
 
 type TestApiRequest struct {}
@@ -51,10 +54,19 @@ func (l *TestApiRequestListAppsFails) Fetch(url string, headers map[string]strin
 	return []byte{}, nil
 }
 
+// replayFixtures answers requests with the golden files in testdata/scenario, recorded with a FixtureRecorder
+func replayFixtures(t *testing.T, scenario string) *FixtureReplayer {
+	replay, err := NewFixtureReplayer(filepath.Join("testdata", scenario))
+	if err != nil {
+		t.Fatalf("Could not load fixtures: %s", err)
+	}
+
+	return replay
+}
 
 func TestApi_GetRPMAverageAcrossHosts(t *testing.T) {
 	nr := NewApi("123", 1, TestApiRequest{})
-	rpm, _ := nr.GetRPMAverageAcrossHosts("marketplace")
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 
 	if rpm != 120 {
 		t.Errorf("return RPM was not correct")
@@ -63,7 +75,7 @@ func TestApi_GetRPMAverageAcrossHosts(t *testing.T) {
 
 func TestApi_GetRPMAverageAcrossHostsAppNotFound(t *testing.T) {
 	nr := NewApi("123", 1 , TestApiRequest{})
-	_, err := nr.GetRPMAverageAcrossHosts("not-market-place")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "not-market-place")
 	if err.Error() != "could not find matching app" {
 		t.Errorf("application matching not working as expected")
 	}
@@ -76,7 +88,7 @@ func TestApi_GetRPMAverageAcrossHostsListAppFails(t *testing.T) {
 			ErrorReturn: "could not list applications",
 		}},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 
 	if err.Error() != "could not list applications" {
 		t.Errorf("failure to list applications it not bubbling up")
@@ -92,7 +104,7 @@ func TestApi_GetRPMAverageAcrossHostsListAppFailsWithJsonError(t *testing.T) {
 			},
 		},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err == nil {
 		t.Error("Invalid json is not triggering unmarshaling error")
 	}
@@ -111,7 +123,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotGetHosts(t *testing.T) {
 			},
 		},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err.Error() != "could not get hosts" {
 		t.Error("there was error in getHosts")
 	}
@@ -130,7 +142,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotUnmarshalHosts(t *testing.T) {
 			},
 		},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err == nil {
 		t.Error("Invalid json is not triggering unmarshaling error")
 	}
@@ -153,7 +165,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotGetHostRpm(t *testing.T) {
 			},
 		},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err.Error() != "could not get host rpm" {
 		t.Errorf("did not bubble up failure to get host rpm api call")
 	}
@@ -176,7 +188,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotUnmarshalJson(t *testing.T) {
 			},
 		},
 	})
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err == nil {
 		t.Error("Invalid json is not triggering unmarshaling error")
 	}
@@ -200,7 +212,7 @@ func TestApi_GetRPMAverageAcrossHostUnmarshalsFloatsToInts(t *testing.T) {
 		},
 	})
 
-	rpm, _ := nr.GetRPMAverageAcrossHosts("marketplace")
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if rpm != 12 {
 		t.Errorf("Expected rpm of 12, got %d", rpm)
 	}
@@ -224,7 +236,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotUnmarshalBadValueToFloat(t *testing
 		},
 	})
 
-	_, err := nr.GetRPMAverageAcrossHosts("marketplace")
+	_, err := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if err == nil {
 		t.Errorf("Did not detect float conversion error")
 	}
@@ -248,7 +260,7 @@ func TestApi_GetRPMAverageAcrossHostsCouldNotUnmarshalBadValueToInt(t *testing.T
 		},
 	})
 
-	rpm, _ := nr.GetRPMAverageAcrossHosts("marketplace")
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if rpm != 0 {
 		// @todo find a way to force a bad int
 		t.Errorf("something odd happened with bad int conversion")
@@ -273,55 +285,34 @@ func TestApi_GetRPMAverageAcrossHostsUnmarshalsIntsToInts(t *testing.T) {
 		},
 	})
 
-	rpm, _ := nr.GetRPMAverageAcrossHosts("marketplace")
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if rpm != 250 {
 		t.Errorf("Expected rpm of 250, got %d", rpm)
 	}
 }
 
 func TestApi_GetRPMAverageAcrossHostsIgnoresHostRpmBelowMinRpm(t *testing.T) {
-	nr := NewApi("123", 1, &TestApiRequestListAppsFails{
-		Returns: []ApiReturn{
-			{
-				UrlRegex: ".*applications.json$",
-				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
-			},
-			{
-				UrlRegex: `.*applications/1234/hosts.json`,
-				ReturnJson: `{"application_hosts":[{"ID":245}, {"ID":246}]}`,
-			},
-			{
-				UrlRegex: `.*applications/1234/hosts/245/metrics/data.json`,
-				ReturnJson: `{"metric_data":{"from":"foo","to":"foo","metrics_not_found":[],"metrics_found":["HttpDispatcher"],"metrics":[{"name":"HttpDispatcher","timeslices":[{"from":"foo","to":"foo","values":{"calls_per_minute":250}}]}]}}`,
-			},
-			{
-				UrlRegex: `.*applications/1234/hosts/246/metrics/data.json`,
-				ReturnJson: `{"metric_data":{"from":"foo","to":"foo","metrics_not_found":[],"metrics_found":["HttpDispatcher"],"metrics":[{"name":"HttpDispatcher","timeslices":[{"from":"foo","to":"foo","values":{"calls_per_minute":0}}]}]}}`,
-			},
-		},
-	})
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-idle-host"))
 
-	rpm, _ := nr.GetRPMAverageAcrossHosts("marketplace")
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
+	if rpm != 250 {
+		t.Errorf("Expected rpm of 250, got %d", rpm)
+	}
+}
+
+func TestApi_GetRPMAverageAcrossHostsIgnoresHostRpmBelowHigherMinRpm(t *testing.T) {
+	nr := NewApi("123", 50, replayFixtures(t, "marketplace-hosts"))
+
+	rpm, _ := nr.GetRPMAverageAcrossHosts(context.Background(), "marketplace")
 	if rpm != 250 {
 		t.Errorf("Expected rpm of 250, got %d", rpm)
 	}
 }
 
 func TestApi_GetApplicationRpm(t *testing.T) {
-	nr := NewApi("123", 1, &TestApiRequestListAppsFails{
-		Returns: []ApiReturn{
-			{
-				UrlRegex: ".*applications.json$",
-				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
-			},
-			{
-				UrlRegex: `.*applications/1234/metrics/data.json`,
-				ReturnJson: `{"metric_data":{"from":"foo","to":"foo","metrics_not_found":[],"metrics_found":["HttpDispatcher"],"metrics":[{"name":"HttpDispatcher","timeslices":[{"from":"foo","to":"foo","values":{"requests_per_minute":250}}]}]}}`,
-			},
-		},
-	})
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-summary"))
 
-	rpm, err := nr.GetApplicationRpm("marketplace")
+	rpm, err := nr.GetApplicationRpm(context.Background(), "marketplace")
 	fmt.Printf("%v", err)
 	if rpm != 250 {
 		t.Errorf("Expected rpm of 250, got %d", rpm)
@@ -338,7 +329,7 @@ func TestApi_GetApplicationRpmCouldNotFindApplication(t *testing.T) {
 		},
 	})
 
-	_, err := nr.GetApplicationRpm("marketplace")
+	_, err := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if err.Error() != "could not find matching app" {
 		t.Error("error for not finding application not coming through")
 	}
@@ -358,7 +349,7 @@ func TestApi_GetApplicationRpmApiRequestError(t *testing.T) {
 		},
 	})
 
-	_, err := nr.GetApplicationRpm("marketplace")
+	_, err := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if err.Error() != "api request failed" {
 		t.Error("failing to stop on api error")
 	}
@@ -378,7 +369,7 @@ func TestApi_GetApplicationRpmInvalidJson(t *testing.T) {
 		},
 	})
 
-	_, err := nr.GetApplicationRpm("marketplace")
+	_, err := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if err == nil {
 		t.Error("invalid json is not returning an error")
 	}
@@ -398,7 +389,7 @@ func TestApi_GetApplicationUnmarshalsFloatsToInts(t *testing.T) {
 		},
 	})
 
-	rpm, _ := nr.GetApplicationRpm("marketplace")
+	rpm, _ := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if rpm != 24 {
 		t.Errorf("Expected rpm of 24, got %d", rpm)
 	}
@@ -418,7 +409,7 @@ func TestApi_GetApplicationsCouldNotUnmarshalBadValueToFloat(t *testing.T) {
 		},
 	})
 
-	_, err := nr.GetApplicationRpm("marketplace")
+	_, err := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if err == nil {
 		t.Errorf("Did not detect float conversion error")
 	}
@@ -438,7 +429,7 @@ func TestApi_GetApplicationsCouldNotUnmarshalBadValueToInt(t *testing.T) {
 		},
 	})
 
-	rpm, _ := nr.GetApplicationRpm("marketplace")
+	rpm, _ := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if rpm != 0 {
 		// @todo find a way to force a bad int
 		t.Errorf("something odd happened with bad int conversion")
@@ -459,8 +450,83 @@ func TestApi_GetApplicationsUnmarshalsIntsToInts(t *testing.T) {
 		},
 	})
 
-	rpm, _ := nr.GetApplicationRpm("marketplace")
+	rpm, _ := nr.GetApplicationRpm(context.Background(), "marketplace")
 	if rpm != 250 {
 		t.Errorf("Expected rpm of 250, got %d", rpm)
 	}
-}
\ No newline at end of file
+}
+func TestApi_GetApplicationMetricDescribesResult(t *testing.T) {
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-summary"))
+
+	result, err := nr.GetApplicationMetric(context.Background(), "marketplace")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if result.AppID != 1234 || result.AppName != "marketplace" {
+		t.Errorf("Expected app marketplace (1234), got %s (%d)", result.AppName, result.AppID)
+	}
+
+	if result.ValueKey != "requests_per_minute" || result.Aggregation != AggregationSummary {
+		t.Errorf("Unexpected value key %s or aggregation %s", result.ValueKey, result.Aggregation)
+	}
+}
+
+func TestApi_GetHostAverageMetricCountsHosts(t *testing.T) {
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-idle-host"))
+
+	result, _ := nr.GetHostAverageMetric(context.Background(), "marketplace")
+	if result.HostCount != 2 || result.ConsideredHostCount != 1 {
+		t.Errorf("Expected 2 hosts with 1 considered, got %d with %d considered", result.HostCount, result.ConsideredHostCount)
+	}
+
+	if result.Aggregation != AggregationHostAverage {
+		t.Errorf("Expected aggregation %s, got %s", AggregationHostAverage, result.Aggregation)
+	}
+}
+
+func TestApi_GetApplicationMetricParsesTimestamp(t *testing.T) {
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-summary"))
+
+	result, _ := nr.GetApplicationMetric(context.Background(), "marketplace")
+	expected := time.Date(2019, 2, 12, 17, 54, 0, 0, time.UTC)
+	if !result.Timestamp.Equal(expected) {
+		t.Errorf("Expected timestamp %s, got %s", expected, result.Timestamp)
+	}
+
+	if result.IsStale(10 * time.Minute, expected.Add(5 * time.Minute)) {
+		t.Errorf("Data 5 minutes old should not be stale with a 10 minute max age")
+	}
+
+	if !result.IsStale(10 * time.Minute, expected.Add(15 * time.Minute)) {
+		t.Errorf("Data 15 minutes old should be stale with a 10 minute max age")
+	}
+}
+
+func TestMetricResult_IsStaleWithoutTimestamp(t *testing.T) {
+	result := MetricResult{}
+	if !result.IsStale(time.Minute, time.Now()) {
+		t.Errorf("Result without a timestamp should be stale")
+	}
+
+	if result.IsStale(0, time.Now()) {
+		t.Errorf("Max age of zero should disable the staleness check")
+	}
+}
+
+func TestApi_GetPerHostMetrics(t *testing.T) {
+	nr := NewApi("123", 1, replayFixtures(t, "marketplace-hosts"))
+
+	results, err := nr.GetPerHostMetrics(context.Background(), "marketplace")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 host results, got %d", len(results))
+	}
+
+	if results[1].Host != "marketplace-cmd-def34" || results[1].Value != 30 {
+		t.Errorf("Expected marketplace-cmd-def34 with 30 rpm, got %s with %d", results[1].Host, results[1].Value)
+	}
+}
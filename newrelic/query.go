@@ -0,0 +1,329 @@
+package newrelic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
+	"github.com/golang/glog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricQuery describes a REST API metric to read for an app
+type MetricQuery struct {
+	// MetricName is the New Relic metric, e.g. HttpDispatcher
+	MetricName string
+	// ValueKey is the value of the metric to read, e.g. requests_per_minute
+	ValueKey string
+	// Aggregation is either AggregationSummary or AggregationHostAverage
+	Aggregation string
+	// Window is how far back the value is summarized over, zero uses New Relic's default of 30 minutes
+	Window time.Duration
+}
+
+var (
+	// RequestsPerMinute is the app level RPM served as the rpm metric
+	RequestsPerMinute = MetricQuery{
+		MetricName: "HttpDispatcher",
+		ValueKey: "requests_per_minute",
+		Aggregation: AggregationSummary,
+	}
+	// HostCallsPerMinute is the RPM averaged across hosts above the minimum RPM
+	HostCallsPerMinute = MetricQuery{
+		MetricName: "HttpDispatcher",
+		ValueKey: "calls_per_minute",
+		Aggregation: AggregationHostAverage,
+	}
+)
+
+func (q MetricQuery) params() map[string]string {
+	params := map[string]string{
+		"names[]": q.MetricName,
+		"values[]": q.ValueKey,
+		"summarize": "true",
+	}
+
+	if q.Window > 0 {
+		now := time.Now().UTC()
+		params["from"] = now.Add(-q.Window).Format(time.RFC3339)
+		params["to"] = now.Format(time.RFC3339)
+	}
+
+	return params
+}
+
+// GetMetric reads a REST API metric for the app, aggregated as the query describes. Concurrent callers asking for the
+// same app and query, window included, share one set of requests.
+func (nr *Api) GetMetric(ctx context.Context, appName string, query MetricQuery) (MetricResult, error) {
+	result, err := nr.flights.do(ctx, flightKey{call: callMetric, appName: appName, query: query}, func(ctx context.Context) (interface{}, error) {
+		return nr.getMetric(ctx, appName, query)
+	})
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	return result.(MetricResult), nil
+}
+
+func (nr *Api) getMetric(ctx context.Context, appName string, query MetricQuery) (MetricResult, error) {
+	appId, err := nr.getApplicationId(ctx, appName)
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	var result MetricResult
+	switch query.Aggregation {
+	case AggregationSummary, "":
+		result, err = nr.getAppMetric(ctx, appName, appId, query)
+	case AggregationHostAverage:
+		result, err = nr.getHostAverageMetric(ctx, appName, appId, query)
+	default:
+		return MetricResult{}, fmt.Errorf("unsupported aggregation %q", query.Aggregation)
+	}
+
+	if err == nil {
+		recordSuccessfulFetch(appName)
+	}
+
+	return result, err
+}
+
+// getMetricData requests a metric's summarized data and returns its value and the end of its timeslice
+func (nr *Api) getMetricData(ctx context.Context, uri string, priority Priority, query MetricQuery) (int, time.Time, error) {
+	body, err := nr.apiRequest(ctx, endpointMetricData, priority, uri, query.params())
+
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	metrics := metricsDataResponse{}
+	err = decode(ctx, endpointMetricData, body, &metrics)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if len(metrics.MetricsData.Metrics) == 0 || len(metrics.MetricsData.Metrics[0].TimeSlices) == 0 {
+		return 0, time.Time{}, fmt.Errorf("New Relic has no data for metric %s", query.MetricName)
+	}
+
+	timeSlice := metrics.MetricsData.Metrics[0].TimeSlices[0]
+	// a value key the metric does not have is missing or null rather than an error from New Relic, serving 0 for it
+	// would scale the workload down
+	number, ok := timeSlice.Values[query.ValueKey]
+	if !ok || number == "" {
+		keys := []string{}
+		for key := range timeSlice.Values {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		return 0, time.Time{}, fmt.Errorf("New Relic has no %s value for metric %s, it has %s", query.ValueKey, query.MetricName, strings.Join(keys, ", "))
+	}
+
+	value, err := nr.parseInt(number)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("New Relic returned a non-numeric %s value for metric %s: %v", query.ValueKey, query.MetricName, err)
+	}
+
+	return value, nr.parseTimestamp(timeSlice.To), nil
+}
+
+func (nr *Api) getAppMetric(ctx context.Context, appName string, appId int, query MetricQuery) (MetricResult, error) {
+	uri := nr.baseUri + "applications/"+ strconv.Itoa(appId) +"/metrics/data.json"
+	value, timestamp, err := nr.getMetricData(ctx, uri, PriorityHigh, query)
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	return MetricResult{
+		AppName: appName,
+		AppID: appId,
+		MetricName: query.MetricName,
+		ValueKey: query.ValueKey,
+		Aggregation: AggregationSummary,
+		Value: value,
+		Timestamp: timestamp,
+	}, nil
+}
+
+func (nr *Api) getPerHostMetrics(ctx context.Context, appName string, appId int, query MetricQuery) (results []MetricResult, err error) {
+	// one span over the host list and every host's request, so the fan-out shows up as a whole
+	ctx, span := tracing.Start(ctx, "newrelic.hostMetrics", tracing.String("newrelic.app_name", appName))
+	defer func() {
+		span.SetAttributes(tracing.Int("newrelic.hosts", len(results)))
+		tracing.End(span, err)
+	}()
+
+	hosts, err := nr.getHostsForApp(ctx, appId)
+	if err != nil {
+		return nil, err
+	}
+
+	results = []MetricResult{}
+	for _, host := range hosts.Hosts {
+		uri := nr.baseUri + "applications/"+ strconv.Itoa(appId) +"/hosts/"+ strconv.Itoa(host.ID) +"/metrics/data.json"
+		value, timestamp, err := nr.getMetricData(ctx, uri, PriorityLow, query)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, MetricResult{
+			AppName: appName,
+			AppID: appId,
+			Host: host.Host,
+			MetricName: query.MetricName,
+			ValueKey: query.ValueKey,
+			Aggregation: AggregationHost,
+			Value: value,
+			Timestamp: timestamp,
+			HostCount: 1,
+			ConsideredHostCount: 1,
+		})
+	}
+
+	return results, nil
+}
+
+func (nr *Api) getHostAverageMetric(ctx context.Context, appName string, appId int, query MetricQuery) (MetricResult, error) {
+	hostResults, err := nr.getPerHostMetrics(ctx, appName, appId, query)
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	result := MetricResult{
+		AppName: appName,
+		AppID: appId,
+		MetricName: query.MetricName,
+		ValueKey: query.ValueKey,
+		Aggregation: AggregationHostAverage,
+		HostCount: len(hostResults),
+	}
+
+	total := 0
+	for i, hostResult := range hostResults {
+		// the average is only as fresh as its oldest host
+		if i == 0 || hostResult.Timestamp.Before(result.Timestamp) {
+			result.Timestamp = hostResult.Timestamp
+		}
+
+		if hostResult.Value >= nr.minRpmForConsideration {
+			result.ConsideredHostCount++
+			total += hostResult.Value
+		}
+	}
+
+	if result.ConsideredHostCount == 0 {
+		glog.Warningf("No hosts were found to be above the minimum RPM of %d", nr.minRpmForConsideration)
+		return result, nil
+	}
+
+	result.Value = int(total / result.ConsideredHostCount)
+	return result, nil
+}
+
+type nrqlMetadata struct {
+	EndTime string `json:"endTime"`
+}
+
+type nrqlResponse struct {
+	Results []map[string]interface{} `json:"results"`
+	Metadata nrqlMetadata `json:"metadata"`
+}
+
+// GetNrqlMetric runs an NRQL query against an account and returns its single numeric result, e.g.
+// SELECT rate(count(*), 1 minute) FROM Transaction WHERE appName = 'marketplace-prod' SINCE 5 minutes ago
+// Queries go through NerdGraph for user keys and through the Insights query API otherwise, concurrent callers sending
+// the same query to the same account share one request.
+func (nr *Api) GetNrqlMetric(ctx context.Context, accountId int, nrql string) (MetricResult, error) {
+	result, err := nr.flights.do(ctx, flightKey{call: callNrql, accountId: accountId, nrql: nrql}, func(ctx context.Context) (interface{}, error) {
+		return nr.getNrqlMetric(ctx, accountId, nrql)
+	})
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	return result.(MetricResult), nil
+}
+
+func (nr *Api) getNrqlMetric(ctx context.Context, accountId int, nrql string) (MetricResult, error) {
+	if accountId == 0 {
+		return MetricResult{}, errors.New("an account id is required for NRQL queries")
+	}
+
+	if nr.userKey {
+		return nr.getNerdGraphNrqlMetric(ctx, accountId, nrql)
+	}
+
+	uri := nr.insightsBaseUri + "accounts/" + strconv.Itoa(accountId) + "/query"
+	headers := map[string]string{
+		"x-query-key": nr.currentApiKey(),
+		"accept": "application/json",
+	}
+
+	body, err := nr.send(ctx, endpointInsightsQuery, PriorityHigh, accountId, uri, func() ([]byte, error) {
+		return nr.httpClient.Fetch(uri, headers, map[string]string{"nrql": nrql})
+	})
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	response := nrqlResponse{}
+	err = decode(ctx, endpointInsightsQuery, body, &response)
+	if err != nil {
+		return MetricResult{}, err
+	}
+
+	return nr.nrqlResult(accountId, response.Results, response.Metadata.EndTime)
+}
+
+// nrqlResult converts the results of an NRQL query, which must be a single numeric value. Results are decoded as
+// they come so a null (e.g. the average of no events) or a string column is reported rather than read as 0.
+func (nr *Api) nrqlResult(accountId int, results []map[string]interface{}, endTime string) (MetricResult, error) {
+	if len(results) == 0 {
+		return MetricResult{}, errors.New("NRQL query returned no results, FACET and TIMESERIES queries are not supported")
+	}
+
+	if len(results) > 1 {
+		return MetricResult{}, fmt.Errorf("NRQL query must return a single row, got %d", len(results))
+	}
+
+	if len(results[0]) != 1 {
+		columns := []string{}
+		for key := range results[0] {
+			columns = append(columns, key)
+		}
+
+		sort.Strings(columns)
+		return MetricResult{}, fmt.Errorf("NRQL query must return a single column, got %s", strings.Join(columns, ", "))
+	}
+
+	result := MetricResult{
+		AccountID: accountId,
+		Aggregation: AggregationNrql,
+	}
+
+	if endTime != "" {
+		result.Timestamp = nr.parseTimestamp(endTime)
+	} else {
+		// NerdGraph does not return the query window, the result is taken as the current minute's so reads within a
+		// minute share a timestamp, as they would share a timeslice
+		result.Timestamp = time.Now().Truncate(time.Minute)
+	}
+
+	for key, value := range results[0] {
+		result.ValueKey = key
+		switch number := value.(type) {
+		case float64:
+			result.Value = int(number)
+		case nil:
+			return MetricResult{}, fmt.Errorf("NRQL result %s is null", key)
+		default:
+			return MetricResult{}, fmt.Errorf("NRQL result %s is not numeric: %v", key, value)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,181 @@
+package newrelic
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type RecordingApiRequest struct {
+	TestApiRequestListAppsFails
+	Urls []string
+	Headers []map[string]string
+	Params []map[string]string
+}
+
+func (r *RecordingApiRequest) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	r.Urls = append(r.Urls, url)
+	r.Headers = append(r.Headers, headers)
+	r.Params = append(r.Params, params)
+	return r.TestApiRequestListAppsFails.Fetch(url, headers, params)
+}
+
+func TestApi_GetMetricWithCustomQuery(t *testing.T) {
+	client := &RecordingApiRequest{TestApiRequestListAppsFails: TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: ".*applications.json$",
+				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
+			},
+			{
+				UrlRegex: `.*applications/1234/metrics/data.json`,
+				ReturnJson: `{"metric_data":{"from":"foo","to":"foo","metrics_not_found":[],"metrics_found":["Errors/all"],"metrics":[{"name":"Errors/all","timeslices":[{"from":"foo","to":"foo","values":{"error_count":17}}]}]}}`,
+			},
+		},
+	}}
+	nr := NewApi("123", 1, client)
+
+	result, err := nr.GetMetric(context.Background(), "marketplace", MetricQuery{
+		MetricName: "Errors/all",
+		ValueKey: "error_count",
+		Aggregation: AggregationSummary,
+		Window: 5 * time.Minute,
+	})
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if result.Value != 17 || result.MetricName != "Errors/all" {
+		t.Errorf("Expected Errors/all of 17, got %s of %d", result.MetricName, result.Value)
+	}
+
+	params := client.Params[1]
+	if params["names[]"] != "Errors/all" || params["values[]"] != "error_count" {
+		t.Errorf("Query was not sent to New Relic, got params %v", params)
+	}
+
+	from, _ := time.Parse(time.RFC3339, params["from"])
+	to, _ := time.Parse(time.RFC3339, params["to"])
+	if to.Sub(from) != 5 * time.Minute {
+		t.Errorf("Expected a 5 minute window, got %s to %s", params["from"], params["to"])
+	}
+}
+
+func TestApi_GetMetricRejectsMissingValueKey(t *testing.T) {
+	tests := map[string]string{
+		"missing": `{"error_count":17}`,
+		"null": `{"error_counts":null}`,
+		"empty": `{}`,
+	}
+
+	for name, values := range tests {
+		nr := NewApi("123", 1, &TestApiRequestListAppsFails{
+			Returns: []ApiReturn{
+				{
+					UrlRegex: ".*applications.json$",
+					ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
+				},
+				{
+					UrlRegex: `.*applications/1234/metrics/data.json`,
+					ReturnJson: `{"metric_data":{"metrics":[{"name":"Errors/all","timeslices":[{"from":"foo","to":"foo","values":` + values + `}]}]}}`,
+				},
+			},
+		})
+
+		// error_counts is a typo of error_count
+		result, err := nr.GetMetric(context.Background(), "marketplace", MetricQuery{
+			MetricName: "Errors/all",
+			ValueKey: "error_counts",
+			Aggregation: AggregationSummary,
+		})
+
+		if err == nil {
+			t.Errorf("Expected an error for a %s value, got %d", name, result.Value)
+		}
+	}
+}
+
+func TestApi_GetMetricUnsupportedAggregation(t *testing.T) {
+	nr := NewApi("123", 1, TestApiRequest{})
+
+	_, err := nr.GetMetric(context.Background(), "marketplace", MetricQuery{MetricName: "HttpDispatcher", ValueKey: "call_count", Aggregation: "median"})
+	if err == nil {
+		t.Errorf("Expected an error for an unsupported aggregation")
+	}
+}
+
+func TestApi_GetNrqlMetric(t *testing.T) {
+	client := &RecordingApiRequest{TestApiRequestListAppsFails: TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: `.*accounts/42/query$`,
+				ReturnJson: `{"results":[{"count":340.5}],"metadata":{"endTime":"2019-02-12T17:54:00Z"}}`,
+			},
+		},
+	}}
+	nr := NewApi("123", 1, client)
+
+	result, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*) FROM Transaction SINCE 1 minute ago")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if result.Value != 340 || result.ValueKey != "count" {
+		t.Errorf("Expected count of 340, got %s of %d", result.ValueKey, result.Value)
+	}
+
+	if !result.Timestamp.Equal(time.Date(2019, 2, 12, 17, 54, 0, 0, time.UTC)) {
+		t.Errorf("Expected the query end time as timestamp, got %s", result.Timestamp)
+	}
+
+	if ok, _ := regexp.MatchString("^https://insights-api.newrelic.com/", client.Urls[0]); !ok {
+		t.Errorf("NRQL query was not sent to the Insights API: %s", client.Urls[0])
+	}
+
+	if client.Params[0]["nrql"] != "SELECT count(*) FROM Transaction SINCE 1 minute ago" {
+		t.Errorf("NRQL was not sent, got params %v", client.Params[0])
+	}
+}
+
+func TestApi_GetNrqlMetricRequiresSingleResult(t *testing.T) {
+	nr := NewApi("123", 1, &TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: `.*accounts/42/query$`,
+				ReturnJson: `{"results":[{"count":340,"average":2.5}]}`,
+			},
+		},
+	})
+
+	_, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*), average(duration) FROM Transaction")
+	if err == nil {
+		t.Errorf("Expected an error for a query with several results")
+	}
+
+	_, err = nr.GetNrqlMetric(context.Background(), 0, "SELECT count(*) FROM Transaction")
+	if err == nil {
+		t.Errorf("Expected an error without an account id")
+	}
+}
+
+func TestApi_GetNrqlMetricRejectsNonNumericResults(t *testing.T) {
+	tests := map[string]string{
+		"null": `{"results":[{"average":null}]}`,
+		"string": `{"results":[{"latest":"marketplace"}]}`,
+		"facet": `{"facets":[{"name":"marketplace","results":[{"count":340}]}],"totalResult":{"results":[{"count":340}]}}`,
+		"rows": `{"results":[{"count":340},{"count":12}]}`,
+	}
+
+	for name, returnJson := range tests {
+		nr := NewApi("123", 1, &TestApiRequestListAppsFails{
+			Returns: []ApiReturn{{UrlRegex: `.*accounts/42/query$`, ReturnJson: returnJson}},
+		})
+
+		result, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT average(duration) FROM Transaction")
+		if err == nil {
+			t.Errorf("Expected an error for a %s result, got %d", name, result.Value)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package newrelic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority orders requests waiting on a RateLimiter, every waiting PriorityHigh request is let through before any
+// PriorityLow one
+type Priority int
+
+const (
+	// PriorityHigh is for app level metrics, app listings and NRQL queries, one request answers an HPA
+	PriorityHigh Priority = iota
+	// PriorityLow is for the per-host fan-out, which costs a request per host
+	PriorityLow
+)
+
+func (p Priority) String() string {
+	if p == PriorityLow {
+		return "low"
+	}
+
+	return "high"
+}
+
+// ErrRateLimited is returned to requests that waited for the rate limiter longer than its maximum wait or their
+// context's deadline
+var ErrRateLimited = errors.New("New Relic request rate limited by the adapter")
+
+// RateLimiter is a token bucket shared by the requests made with one API key or to one account. Requests wait for a
+// token by priority, and give up with ErrRateLimited after maxWait so callers do not pile up behind a busy key.
+type RateLimiter struct {
+	lock sync.Mutex
+	// rate is in tokens per second
+	rate float64
+	burst float64
+	maxWait time.Duration
+	tokens float64
+	refilled time.Time
+	queues [2][]*rateLimitWaiter
+	// changed is closed and replaced whenever a token is taken or a waiter leaves, so the next waiter re-checks
+	changed chan struct{}
+}
+
+type rateLimitWaiter struct {
+	priority Priority
+}
+
+// NewRateLimiter allows requestsPerMinute on average with bursts of up to burst requests, starting with a full bucket
+func NewRateLimiter(requestsPerMinute int, burst int, maxWait time.Duration) *RateLimiter {
+	return &RateLimiter{
+		rate: float64(requestsPerMinute) / 60,
+		burst: float64(burst),
+		maxWait: maxWait,
+		tokens: float64(burst),
+		refilled: time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Wait blocks until the request may be sent, a nil RateLimiter never blocks. It gives up with ErrRateLimited at the
+// maximum wait or ctx's deadline, whichever comes first, and with ctx's error when ctx is cancelled.
+func (l *RateLimiter) Wait(ctx context.Context, priority Priority) error {
+	if l == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(l.maxWait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	waiter := &rateLimitWaiter{priority: priority}
+
+	l.lock.Lock()
+	l.queues[priority] = append(l.queues[priority], waiter)
+	for {
+		now := time.Now()
+		l.refillLocked(now)
+
+		next := l.nextLocked()
+		if next == waiter && l.tokens >= 1 {
+			l.tokens--
+			l.removeLocked(waiter)
+			l.lock.Unlock()
+			return nil
+		}
+
+		if !now.Before(deadline) || ctx.Err() == context.DeadlineExceeded {
+			l.removeLocked(waiter)
+			l.lock.Unlock()
+			rateLimitedRequests.WithLabelValues(priority.String()).Inc()
+			return ErrRateLimited
+		}
+
+		if err := ctx.Err(); err != nil {
+			l.removeLocked(waiter)
+			l.lock.Unlock()
+			return err
+		}
+
+		wait := deadline.Sub(now)
+		if next == waiter {
+			untilToken := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+			if untilToken < wait {
+				wait = untilToken
+			}
+		}
+
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+
+		changed := l.changed
+		l.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		l.lock.Lock()
+	}
+}
+
+// release gives back a token taken by a request that was not sent after all
+func (l *RateLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refillLocked(time.Now())
+	l.tokens++
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *RateLimiter) refillLocked(now time.Time) {
+	l.tokens += now.Sub(l.refilled).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+
+	l.refilled = now
+}
+
+// nextLocked is the waiter the next token goes to, the oldest of the highest priority
+func (l *RateLimiter) nextLocked() *rateLimitWaiter {
+	for _, queue := range l.queues {
+		if len(queue) > 0 {
+			return queue[0]
+		}
+	}
+
+	return nil
+}
+
+func (l *RateLimiter) removeLocked(waiter *rateLimitWaiter) {
+	queue := l.queues[waiter.priority]
+	for i, queued := range queue {
+		if queued == waiter {
+			l.queues[waiter.priority] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// SetRateLimit limits the requests made with the Api's key, a nil limiter removes the limit
+func (nr *Api) SetRateLimit(limiter *RateLimiter) {
+	nr.rateLimiter = limiter
+}
+
+// SetAccountRateLimits limits NRQL queries per account on top of the key's limit. The limiters may be shared with
+// Apis for other keys, since an account's limit applies whichever key is used.
+func (nr *Api) SetAccountRateLimits(limiters map[int]*RateLimiter) {
+	nr.accountRateLimiters = limiters
+}
+
+// waitForRateLimit waits for the key's limiter and, for requests made to an account, the account's limiter. The key's
+// token is given back when the account's limiter gives up, so a busy account does not use up the key's limit.
+func (nr *Api) waitForRateLimit(ctx context.Context, priority Priority, accountId int) error {
+	if err := nr.rateLimiter.Wait(ctx, priority); err != nil {
+		return err
+	}
+
+	if err := nr.accountRateLimiters[accountId].Wait(ctx, priority); err != nil {
+		nr.rateLimiter.release()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package newrelic
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (l *RateLimiter) queued(priority Priority) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return len(l.queues[priority])
+}
+
+func waitForQueued(t *testing.T, limiter *RateLimiter, priority Priority) {
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.queued(priority) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No %s priority request queued", priority)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRateLimiter_AllowsBurstThenGivesUp(t *testing.T) {
+	limiter := NewRateLimiter(60, 2, 20 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Wait(context.Background(), PriorityHigh); err != nil {
+			t.Fatalf("Expected request %d of the burst to pass, got %s", i, err)
+		}
+	}
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), PriorityHigh); err != ErrRateLimited {
+		t.Errorf("Expected ErrRateLimited once the burst is used, got %v", err)
+	}
+
+	if waited := time.Since(start); waited < 20 * time.Millisecond || waited > time.Second {
+		t.Errorf("Expected to give up after the 20ms max wait, waited %s", waited)
+	}
+
+	if limiter.queued(PriorityHigh) != 0 {
+		t.Errorf("Request that gave up is still queued")
+	}
+}
+
+func TestRateLimiter_RefillsOverTime(t *testing.T) {
+	limiter := NewRateLimiter(6000, 1, time.Second)
+	limiter.Wait(context.Background(), PriorityHigh)
+
+	// 100 requests per second, the next token is 10ms away
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), PriorityHigh); err != nil {
+		t.Fatalf("Expected the request to wait for a token, got %s", err)
+	}
+
+	if waited := time.Since(start); waited < 5 * time.Millisecond {
+		t.Errorf("Expected to wait for the next token, waited %s", waited)
+	}
+}
+
+func TestRateLimiter_HighPriorityGoesFirst(t *testing.T) {
+	limiter := NewRateLimiter(1200, 1, 2 * time.Second)
+	limiter.Wait(context.Background(), PriorityHigh)
+
+	order := []Priority{}
+	orderLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wait := func(priority Priority) {
+		defer wg.Done()
+		if err := limiter.Wait(context.Background(), priority); err != nil {
+			t.Errorf("There was an error: %s", err)
+		}
+
+		orderLock.Lock()
+		order = append(order, priority)
+		orderLock.Unlock()
+	}
+
+	// the host request queues first but the app request overtakes it
+	wg.Add(2)
+	limiter.lock.Lock()
+	go wait(PriorityLow)
+	limiter.lock.Unlock()
+	waitForQueued(t, limiter, PriorityLow)
+	go wait(PriorityHigh)
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != PriorityHigh {
+		t.Errorf("Expected the high priority request first, got %v", order)
+	}
+}
+
+func TestApi_RateLimitedRequestsFail(t *testing.T) {
+	nr := NewApi("123", 1, TestApiRequest{})
+	nr.SetRateLimit(NewRateLimiter(60, 1, 10 * time.Millisecond))
+
+	// listing the apps takes the only token, the metric request gives up
+	_, err := nr.GetApplicationMetric(context.Background(), "marketplace")
+	if err != ErrRateLimited {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestApi_AccountRateLimits(t *testing.T) {
+	nr := NewApi("123", 1, &TestApiRequestListAppsFails{
+		Returns: []ApiReturn{{UrlRegex: ".*/query$", ReturnJson: `{"results":[{"count":340}]}`}},
+	})
+	nr.SetAccountRateLimits(map[int]*RateLimiter{42: NewRateLimiter(60, 1, 10 * time.Millisecond)})
+
+	if _, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*) FROM Transaction"); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if _, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*) FROM PageView"); err != ErrRateLimited {
+		t.Errorf("Expected account 42 to be rate limited, got %v", err)
+	}
+
+	if _, err := nr.GetNrqlMetric(context.Background(), 7, "SELECT count(*) FROM PageView"); err != nil {
+		t.Errorf("Expected other accounts not to be limited, got %v", err)
+	}
+}
+
+func TestRateLimiter_GivesUpAtTheContextDeadline(t *testing.T) {
+	limiter := NewRateLimiter(60, 1, time.Second)
+	limiter.Wait(context.Background(), PriorityHigh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := limiter.Wait(ctx, PriorityHigh); err != ErrRateLimited {
+		t.Errorf("Expected ErrRateLimited at the context deadline, got %v", err)
+	}
+
+	if waited := time.Since(start); waited > 500 * time.Millisecond {
+		t.Errorf("Expected to give up at the 20ms deadline rather than the 1s max wait, waited %s", waited)
+	}
+}
+
+func TestRateLimiter_StopsWaitingWhenCancelled(t *testing.T) {
+	limiter := NewRateLimiter(60, 1, time.Second)
+	limiter.Wait(context.Background(), PriorityHigh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForQueued(t, limiter, PriorityHigh)
+		cancel()
+	}()
+
+	if err := limiter.Wait(ctx, PriorityHigh); err != context.Canceled {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+
+	if limiter.queued(PriorityHigh) != 0 {
+		t.Errorf("Cancelled request is still queued")
+	}
+}
+
+func TestApi_AccountRateLimitGivesBackTheKeyToken(t *testing.T) {
+	nr := NewApi("123", 1, &TestApiRequestListAppsFails{
+		Returns: []ApiReturn{{UrlRegex: ".*/query$", ReturnJson: `{"results":[{"count":340}]}`}},
+	})
+	nr.SetRateLimit(NewRateLimiter(60, 2, 10 * time.Millisecond))
+	nr.SetAccountRateLimits(map[int]*RateLimiter{42: NewRateLimiter(60, 1, 10 * time.Millisecond)})
+
+	nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*) FROM Transaction")
+	if _, err := nr.GetNrqlMetric(context.Background(), 42, "SELECT count(*) FROM PageView"); err != ErrRateLimited {
+		t.Fatalf("Expected account 42 to be rate limited, got %v", err)
+	}
+
+	// the key's second token was given back when account 42 gave up
+	if _, err := nr.GetNrqlMetric(context.Background(), 7, "SELECT count(*) FROM PageView"); err != nil {
+		t.Errorf("Expected the key's token to be available for another account, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package newrelic
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// RegionUS is the default New Relic data center
+	RegionUS = "us"
+	// RegionEU is the New Relic data center for accounts created in the EU
+	RegionEU = "eu"
+)
+
+// Endpoints are the base URIs requests are sent to
+type Endpoints struct {
+	// RestUri is the REST API v2 base, ending in a slash
+	RestUri string
+	// InsightsUri is the Insights query API base, ending in a slash
+	InsightsUri string
+	// NerdGraphUri is the NerdGraph GraphQL endpoint
+	NerdGraphUri string
+	// EventsUri is the Event API base custom events are sent to, ending in a slash
+	EventsUri string
+}
+
+var regions = map[string]Endpoints{
+	RegionUS: {
+		RestUri: "https://api.newrelic.com/v2/",
+		InsightsUri: "https://insights-api.newrelic.com/v1/",
+		NerdGraphUri: "https://api.newrelic.com/graphql",
+		EventsUri: "https://insights-collector.newrelic.com/v1/",
+	},
+	RegionEU: {
+		RestUri: "https://api.eu.newrelic.com/v2/",
+		InsightsUri: "https://insights-api.eu.newrelic.com/v1/",
+		NerdGraphUri: "https://api.eu.newrelic.com/graphql",
+		EventsUri: "https://insights-collector.eu01.nr-data.net/v1/",
+	},
+}
+
+// EndpointsAt returns the endpoints of a single host serving every API under New Relic's paths, such as the
+// newrelictest fake
+func EndpointsAt(baseUrl string) Endpoints {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return Endpoints{
+		RestUri: baseUrl + "/v2/",
+		InsightsUri: baseUrl + "/v1/",
+		NerdGraphUri: baseUrl + "/graphql",
+		EventsUri: baseUrl + "/v1/",
+	}
+}
+
+// ValidRegion reports whether region is a New Relic data center the Api can send requests to
+func ValidRegion(region string) bool {
+	_, ok := regions[region]
+	return ok
+}
+
+// RegionEndpoints returns the endpoints of a New Relic data center
+func RegionEndpoints(region string) (Endpoints, error) {
+	endpoints, ok := regions[region]
+	if !ok {
+		return Endpoints{}, fmt.Errorf("unknown New Relic region %q", region)
+	}
+
+	return endpoints, nil
+}
+
+// UseRegion points the Api at the data center its account lives in, keys only work against their own region
+func (nr *Api) UseRegion(region string) error {
+	endpoints, err := RegionEndpoints(region)
+	if err != nil {
+		return err
+	}
+
+	nr.SetEndpoints(endpoints)
+	return nil
+}
+
+// SetEndpoints points the Api at other base URIs, such as a local stand-in for New Relic
+func (nr *Api) SetEndpoints(endpoints Endpoints) {
+	nr.baseUri = endpoints.RestUri
+	nr.insightsBaseUri = endpoints.InsightsUri
+	nr.nerdGraphUri = endpoints.NerdGraphUri
+}
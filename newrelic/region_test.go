@@ -0,0 +1,65 @@
+package newrelic
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApi_UseRegionEU(t *testing.T) {
+	client := &RecordingApiRequest{TestApiRequestListAppsFails: TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: ".*applications.json$",
+				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
+			},
+		},
+	}}
+	nr := NewApi("123", 1, client)
+	if err := nr.UseRegion(RegionEU); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	nr.GetApplicationMetric(context.Background(), "marketplace")
+
+	if len(client.Urls) == 0 || !strings.HasPrefix(client.Urls[0], "https://api.eu.newrelic.com/v2/") {
+		t.Errorf("Expected requests to go to the EU API, got %v", client.Urls)
+	}
+}
+
+func TestApi_UseRegionUnknown(t *testing.T) {
+	nr := NewApi("123", 1, TestApiRequest{})
+
+	if err := nr.UseRegion("apac"); err == nil {
+		t.Errorf("Expected an error for an unknown region")
+	}
+
+	if ValidRegion("apac") || !ValidRegion(RegionUS) {
+		t.Errorf("Expected only known regions to be valid")
+	}
+}
+
+func TestApi_SetAppIdTTLCachesLookups(t *testing.T) {
+	client := &RecordingApiRequest{TestApiRequestListAppsFails: TestApiRequestListAppsFails{
+		Returns: []ApiReturn{
+			{
+				UrlRegex: ".*applications.json$",
+				ReturnJson: `{"applications":[{"id":1234,"name":"marketplace"}]}`,
+			},
+		},
+	}}
+	nr := NewApi("123", 1, client)
+	nr.SetAppIdTTL(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		appId, err := nr.getApplicationId(context.Background(), "marketplace")
+		if err != nil || appId != 1234 {
+			t.Fatalf("Expected app 1234, got %d (%v)", appId, err)
+		}
+	}
+
+	if len(client.Urls) != 1 {
+		t.Errorf("Expected the apps to be listed once, got %d requests", len(client.Urls))
+	}
+}
@@ -0,0 +1,506 @@
+// Package newrelictest provides a fake of the New Relic APIs the adapter uses, for tests and for running the adapter
+// locally. It serves the REST API v2 applications, hosts and metric data endpoints, Insights NRQL queries and
+// NerdGraph NRQL queries from programmable fixtures, takes in custom events and can inject faults.
+package newrelictest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPageSize is the number of applications per page, the same as New Relic's
+const DefaultPageSize = 200
+
+// Fake is an http.Handler imitating New Relic. It is safe to change its fixtures while requests are served.
+type Fake struct {
+	lock sync.Mutex
+	// ApiKey, when set, is required in the x-api-key, x-query-key or api-key header as New Relic would
+	ApiKey string
+	// PageSize is the number of applications returned per page
+	PageSize int
+	// Timestamp is the end of every timeslice, the current time when zero
+	Timestamp time.Time
+
+	apps []*App
+	nrql map[string]float64
+	faults []*Fault
+	requests []Request
+	events []map[string]interface{}
+	nextId int
+}
+
+// App is an application reporting to the fake
+type App struct {
+	fake *Fake
+	ID int
+	Name string
+	metrics map[string]map[string]float64
+	hosts []*Host
+}
+
+// Host is a host reporting for an App, Name is what the REST API calls host
+type Host struct {
+	fake *Fake
+	ID int
+	Name string
+	metrics map[string]map[string]float64
+}
+
+// Fault changes the response to matching requests
+type Fault struct {
+	// Path is a substring of the request path the fault applies to, empty matches every request
+	Path string
+	// Latency delays the response
+	Latency time.Duration
+	// Status responds with this status code and an error body instead of the fixtures, e.g. 429 or 503
+	Status int
+	// Malformed responds with a truncated JSON body
+	Malformed bool
+	// Times limits how many requests the fault applies to, zero applies it to every request
+	Times int
+
+	applied int
+}
+
+// Request is a request received by the fake
+type Request struct {
+	Method string
+	Path string
+	Query string
+	Body string
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		PageSize: DefaultPageSize,
+		nrql: map[string]float64{},
+		nextId: 1,
+	}
+}
+
+// AddApp adds an application and returns it so metrics and hosts can be added
+func (f *Fake) AddApp(name string) *App {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	app := &App{fake: f, ID: f.nextIdLocked(), Name: name, metrics: map[string]map[string]float64{}}
+	f.apps = append(f.apps, app)
+	return app
+}
+
+func (f *Fake) nextIdLocked() int {
+	id := f.nextId
+	f.nextId++
+	return id
+}
+
+// SetMetric sets the summarized value of an app metric, e.g. HttpDispatcher requests_per_minute
+func (a *App) SetMetric(metricName string, valueKey string, value float64) *App {
+	a.fake.lock.Lock()
+	defer a.fake.lock.Unlock()
+
+	setMetric(a.metrics, metricName, valueKey, value)
+	return a
+}
+
+// AddHost adds a host reporting for the app
+func (a *App) AddHost(name string) *Host {
+	a.fake.lock.Lock()
+	defer a.fake.lock.Unlock()
+
+	host := &Host{fake: a.fake, ID: a.fake.nextIdLocked(), Name: name, metrics: map[string]map[string]float64{}}
+	a.hosts = append(a.hosts, host)
+	return host
+}
+
+// SetMetric sets the summarized value of a host metric, e.g. HttpDispatcher calls_per_minute
+func (h *Host) SetMetric(metricName string, valueKey string, value float64) *Host {
+	h.fake.lock.Lock()
+	defer h.fake.lock.Unlock()
+
+	setMetric(h.metrics, metricName, valueKey, value)
+	return h
+}
+
+func setMetric(metrics map[string]map[string]float64, metricName string, valueKey string, value float64) {
+	if metrics[metricName] == nil {
+		metrics[metricName] = map[string]float64{}
+	}
+
+	metrics[metricName][valueKey] = value
+}
+
+// SetNrql sets the single value returned for an NRQL query sent to an account, through Insights or NerdGraph
+func (f *Fake) SetNrql(accountId int, nrql string, value float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.nrql[nrqlKey(accountId, nrql)] = value
+}
+
+func nrqlKey(accountId int, nrql string) string {
+	return strconv.Itoa(accountId) + "/" + nrql
+}
+
+// AddFault injects a fault, faults are checked in the order they were added
+func (f *Fake) AddFault(fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// ClearFaults removes every fault
+func (f *Fake) ClearFaults() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = nil
+}
+
+// Requests returns the requests received so far
+func (f *Fake) Requests() []Request {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]Request{}, f.requests...)
+}
+
+// Events returns the custom events sent to the Event API so far
+func (f *Fake) Events() []map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]map[string]interface{}{}, f.events...)
+}
+
+// fault returns the first fault matching the path and counts it as applied
+func (f *Fake) fault(path string) *Fault {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, fault := range f.faults {
+		if !strings.Contains(path, fault.Path) || (fault.Times > 0 && fault.applied >= fault.Times) {
+			continue
+		}
+
+		fault.applied++
+		copied := *fault
+		return &copied
+	}
+
+	return nil
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.lock.Lock()
+	f.requests = append(f.requests, Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: string(body)})
+	f.lock.Unlock()
+
+	if fault := f.fault(r.URL.Path); fault != nil {
+		time.Sleep(fault.Latency)
+		if fault.Status != 0 {
+			writeError(w, fault.Status, fmt.Sprintf("injected %d", fault.Status))
+			return
+		}
+
+		if fault.Malformed {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"applications":[{"id":`))
+			return
+		}
+	}
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/v2/"):
+		if !f.authorized(r, "x-api-key") {
+			writeError(w, http.StatusUnauthorized, "The API key provided is invalid")
+			return
+		}
+
+		f.serveRest(w, r, strings.Split(strings.TrimPrefix(path, "/v2/"), "/"))
+	case strings.HasPrefix(path, "/v1/accounts/") && strings.HasSuffix(path, "/query"):
+		if !f.authorized(r, "x-query-key") {
+			writeError(w, http.StatusForbidden, "Invalid query key")
+			return
+		}
+
+		accountId, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "/v1/accounts/"), "/query"))
+		f.serveInsights(w, accountId, r.URL.Query().Get("nrql"))
+	case path == "/graphql" && r.Method == http.MethodPost:
+		if !f.authorized(r, "api-key") {
+			writeError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+
+		f.serveNerdGraph(w, body)
+	case strings.HasPrefix(path, "/v1/accounts/") && strings.HasSuffix(path, "/events") && r.Method == http.MethodPost:
+		if !f.authorized(r, "api-key") {
+			writeError(w, http.StatusForbidden, "Invalid license key")
+			return
+		}
+
+		f.serveEvents(w, r, body)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (f *Fake) authorized(r *http.Request, header string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.ApiKey == "" || r.Header.Get(header) == f.ApiKey
+}
+
+func writeError(w http.ResponseWriter, status int, title string) {
+	writeJson(w, status, map[string]interface{}{"error": map[string]string{"title": title}})
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveRest serves applications.json, applications/{id}/hosts.json, applications/{id}/metrics/data.json and
+// applications/{id}/hosts/{id}/metrics/data.json
+func (f *Fake) serveRest(w http.ResponseWriter, r *http.Request, parts []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(parts) == 1 && parts[0] == "applications.json" {
+		f.serveApplicationsLocked(w, r)
+		return
+	}
+
+	if len(parts) < 2 || parts[0] != "applications" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	appId, _ := strconv.Atoi(strings.TrimSuffix(parts[1], ".json"))
+	app := f.appLocked(appId)
+	if app == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No Application found with ID %s", parts[1]))
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "hosts.json":
+		hosts := []map[string]interface{}{}
+		for _, host := range app.hosts {
+			hosts = append(hosts, map[string]interface{}{"id": host.ID, "host": host.Name, "application_name": app.Name})
+		}
+
+		writeJson(w, http.StatusOK, map[string]interface{}{"application_hosts": hosts})
+	case len(parts) == 4 && parts[2] == "metrics" && parts[3] == "data.json":
+		f.serveMetricDataLocked(w, r, app.metrics)
+	case len(parts) == 6 && parts[2] == "hosts" && parts[4] == "metrics" && parts[5] == "data.json":
+		hostId, _ := strconv.Atoi(parts[3])
+		for _, host := range app.hosts {
+			if host.ID == hostId {
+				f.serveMetricDataLocked(w, r, host.metrics)
+				return
+			}
+		}
+
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No Host found with ID %s", parts[3]))
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (f *Fake) appLocked(appId int) *App {
+	for _, app := range f.apps {
+		if app.ID == appId {
+			return app
+		}
+	}
+
+	return nil
+}
+
+func (f *Fake) serveApplicationsLocked(w http.ResponseWriter, r *http.Request) {
+	nameFilter := r.URL.Query().Get("filter[name]")
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	matching := []map[string]interface{}{}
+	for _, app := range f.apps {
+		if strings.Contains(app.Name, nameFilter) {
+			matching = append(matching, map[string]interface{}{"id": app.ID, "name": app.Name})
+		}
+	}
+
+	start := (page - 1) * f.PageSize
+	end := start + f.PageSize
+	if start > len(matching) {
+		start = len(matching)
+	}
+
+	if end > len(matching) {
+		end = len(matching)
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"applications": matching[start:end]})
+}
+
+func (f *Fake) timestampLocked() time.Time {
+	if f.Timestamp.IsZero() {
+		return time.Now().UTC()
+	}
+
+	return f.Timestamp.UTC()
+}
+
+func (f *Fake) serveMetricDataLocked(w http.ResponseWriter, r *http.Request, metrics map[string]map[string]float64) {
+	query := r.URL.Query()
+	to := f.timestampLocked()
+	from := to.Add(-30 * time.Minute)
+
+	found := []string{}
+	notFound := []string{}
+	data := []map[string]interface{}{}
+	for _, metricName := range query["names[]"] {
+		values, ok := metrics[metricName]
+		if !ok {
+			notFound = append(notFound, metricName)
+			continue
+		}
+
+		found = append(found, metricName)
+		requested := map[string]float64{}
+		for _, valueKey := range query["values[]"] {
+			if value, ok := values[valueKey]; ok {
+				requested[valueKey] = value
+			}
+		}
+
+		data = append(data, map[string]interface{}{
+			"name": metricName,
+			"timeslices": []map[string]interface{}{{
+				"from": from.Format(time.RFC3339),
+				"to": to.Format(time.RFC3339),
+				"values": requested,
+			}},
+		})
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"metric_data": map[string]interface{}{
+		"from": from.Format(time.RFC3339),
+		"to": to.Format(time.RFC3339),
+		"metrics_found": found,
+		"metrics_not_found": notFound,
+		"metrics": data,
+	}})
+}
+
+func (f *Fake) nrqlResult(accountId int, nrql string) ([]map[string]float64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	value, ok := f.nrql[nrqlKey(accountId, nrql)]
+	if !ok {
+		return nil, false
+	}
+
+	return []map[string]float64{{"result": value}}, true
+}
+
+func (f *Fake) serveInsights(w http.ResponseWriter, accountId int, nrql string) {
+	results, ok := f.nrqlResult(accountId, nrql)
+	if !ok {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "NRQL Syntax Error: unknown query " + nrql})
+		return
+	}
+
+	f.lock.Lock()
+	endTime := f.timestampLocked()
+	f.lock.Unlock()
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"results": results,
+		"metadata": map[string]interface{}{"endTime": endTime.Format(time.RFC3339)},
+	})
+}
+
+func (f *Fake) serveNerdGraph(w http.ResponseWriter, body []byte) {
+	request := struct {
+		Variables struct {
+			AccountId int `json:"accountId"`
+			Nrql string `json:"nrql"`
+		} `json:"variables"`
+	}{}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeJson(w, http.StatusOK, map[string]interface{}{"errors": []map[string]string{{"message": "invalid request: " + err.Error()}}})
+		return
+	}
+
+	results, ok := f.nrqlResult(request.Variables.AccountId, request.Variables.Nrql)
+	if !ok {
+		writeJson(w, http.StatusOK, map[string]interface{}{"errors": []map[string]string{{"message": "unknown query " + request.Variables.Nrql}}})
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+		"actor": map[string]interface{}{"account": map[string]interface{}{"nrql": map[string]interface{}{"results": results}}},
+	}})
+}
+
+// Apps returns the names of the apps in the fake, sorted
+func (f *Fake) Apps() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	names := []string{}
+	for _, app := range f.apps {
+		names = append(names, app.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// serveEvents takes in a batch of custom events as the Event API does, gzipped or not
+func (f *Fake) serveEvents(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid gzip body")
+			return
+		}
+
+		body, err = ioutil.ReadAll(reader)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid gzip body")
+			return
+		}
+	}
+
+	events := []map[string]interface{}{}
+	if err := json.Unmarshal(body, &events); err != nil {
+		writeError(w, http.StatusBadRequest, "Events must be a JSON array")
+		return
+	}
+
+	f.lock.Lock()
+	f.events = append(f.events, events...)
+	f.lock.Unlock()
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"success": true})
+}
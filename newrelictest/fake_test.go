@@ -0,0 +1,166 @@
+package newrelictest
+
+import (
+	"context"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testApi(server *Server, apiKey string) *newrelic.Api {
+	api := newrelic.NewApi(apiKey, 1, newrelic.HttpGetClient{Timeout: time.Second})
+	api.SetEndpoints(server.Endpoints())
+	return api
+}
+
+func TestFakeServesAppAndHostMetrics(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	app := server.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+	app.AddHost("marketplace-1").SetMetric("HttpDispatcher", "calls_per_minute", 650)
+	app.AddHost("marketplace-2").SetMetric("HttpDispatcher", "calls_per_minute", 550)
+
+	api := testApi(server, "")
+	result, err := api.GetApplicationMetric(context.Background(), "marketplace-prod")
+	if err != nil || result.Value != 1200 || result.AppID != app.ID {
+		t.Fatalf("Expected 1200 for app %d, got %v (%v)", app.ID, result, err)
+	}
+
+	average, err := api.GetHostAverageMetric(context.Background(), "marketplace-prod")
+	if err != nil || average.Value != 600 || average.HostCount != 2 {
+		t.Errorf("Expected an average of 600 across 2 hosts, got %v (%v)", average, err)
+	}
+}
+
+func TestFakeFollowsApplicationPages(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	// the name filter matches substrings, so the exact app is on the second page
+	for i := 0; i < DefaultPageSize; i++ {
+		server.AddApp("marketplace-prod-" + strconv.Itoa(i))
+	}
+	server.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 10)
+
+	result, err := testApi(server, "").GetApplicationMetric(context.Background(), "marketplace-prod")
+	if err != nil || result.Value != 10 {
+		t.Fatalf("Expected marketplace-prod to be found, got %v (%v)", result, err)
+	}
+
+	pages := []string{}
+	for _, request := range server.Requests() {
+		if request.Path == "/v2/applications.json" {
+			pages = append(pages, request.Query)
+		}
+	}
+
+	if len(pages) != 2 || pages[1] != "filter%5Bname%5D=marketplace-prod&page=2" {
+		t.Errorf("Expected two filtered pages of apps, got %v", pages)
+	}
+}
+
+func TestFakeRequiresApiKey(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.ApiKey = "secret"
+	server.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+
+	_, err := testApi(server, "wrong").GetApplicationMetric(context.Background(), "marketplace-prod")
+	if statusErr, ok := err.(*newrelic.StatusError); !ok || statusErr.StatusCode != 401 {
+		t.Errorf("Expected a 401 for the wrong key, got %v", err)
+	}
+
+	if _, err := testApi(server, "secret").GetApplicationMetric(context.Background(), "marketplace-prod"); err != nil {
+		t.Errorf("Expected the right key to be accepted, got %v", err)
+	}
+}
+
+func TestFakeServesNrql(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	nrql := "SELECT count(*) FROM Transaction"
+	server.SetNrql(42, nrql, 77)
+
+	result, err := testApi(server, "").GetNrqlMetric(context.Background(), 42, nrql)
+	if err != nil || result.Value != 77 {
+		t.Errorf("Expected 77 through Insights, got %v (%v)", result, err)
+	}
+
+	userKeyApi := newrelic.NewUserKeyApi("", 1, newrelic.HttpGetClient{Timeout: time.Second})
+	userKeyApi.SetEndpoints(server.Endpoints())
+	result, err = userKeyApi.GetNrqlMetric(context.Background(), 42, nrql)
+	if err != nil || result.Value != 77 {
+		t.Errorf("Expected 77 through NerdGraph, got %v (%v)", result, err)
+	}
+
+	if _, err := testApi(server, "").GetNrqlMetric(context.Background(), 7, nrql); err == nil {
+		t.Errorf("Expected an error for a query the fake does not know")
+	}
+}
+
+func TestFakeFaultsAreRetried(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+	server.AddFault(Fault{Path: "/metrics/data.json", Status: 429, Times: 1})
+	server.AddFault(Fault{Path: "/metrics/data.json", Status: 503, Times: 1})
+
+	api := testApi(server, "")
+	api.SetRetries(2, time.Millisecond)
+	result, err := api.GetApplicationMetric(context.Background(), "marketplace-prod")
+	if err != nil || result.Value != 1200 {
+		t.Errorf("Expected the 429 and 503 to be retried, got %v (%v)", result, err)
+	}
+}
+
+func TestFakeMalformedResponse(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.AddApp("marketplace-prod")
+	server.AddFault(Fault{Path: "applications.json", Malformed: true})
+
+	if _, err := testApi(server, "").GetApplicationMetric(context.Background(), "marketplace-prod"); err == nil {
+		t.Errorf("Expected malformed JSON to fail")
+	}
+}
+
+func TestFakeLatencyHitsClientTimeout(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.AddApp("marketplace-prod").SetMetric("HttpDispatcher", "requests_per_minute", 1200)
+	server.AddFault(Fault{Latency: 200 * time.Millisecond})
+
+	api := newrelic.NewApi("", 1, newrelic.HttpGetClient{Timeout: 50 * time.Millisecond})
+	api.SetEndpoints(server.Endpoints())
+	if _, err := api.GetApplicationMetric(context.Background(), "marketplace-prod"); err == nil {
+		t.Errorf("Expected the request to time out")
+	}
+}
+
+func TestLoadExampleFixtures(t *testing.T) {
+	fixtures, err := LoadFixtures("../examples/fake-newrelic.yml")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	server := NewServer()
+	defer server.Close()
+
+	if err := server.Load(fixtures); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	api := testApi(server, "fake-key")
+	api.SetRetries(1, time.Millisecond)
+	average, err := api.GetHostAverageMetric(context.Background(), "marketplace-prod")
+	if err != nil || average.Value != 600 {
+		t.Errorf("Expected an average of 600, got %v (%v)", average, err)
+	}
+}
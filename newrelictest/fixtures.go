@@ -0,0 +1,119 @@
+package newrelictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"time"
+)
+
+// Fixtures describe the data a Fake serves, they are loaded from YAML by the standalone fake
+type Fixtures struct {
+	ApiKey string `json:"apiKey"`
+	PageSize int `json:"pageSize"`
+	Apps []AppFixture `json:"apps"`
+	Nrql []NrqlFixture `json:"nrql"`
+	Faults []FaultFixture `json:"faults"`
+}
+
+// AppFixture is an app with its metrics as metric name to value key to value
+type AppFixture struct {
+	Name string `json:"name"`
+	Metrics map[string]map[string]float64 `json:"metrics"`
+	Hosts []HostFixture `json:"hosts"`
+}
+
+type HostFixture struct {
+	Name string `json:"name"`
+	Metrics map[string]map[string]float64 `json:"metrics"`
+}
+
+type NrqlFixture struct {
+	AccountID int `json:"accountId"`
+	Query string `json:"query"`
+	Value float64 `json:"value"`
+}
+
+type FaultFixture struct {
+	Path string `json:"path"`
+	Latency string `json:"latency"`
+	Status int `json:"status"`
+	Malformed bool `json:"malformed"`
+	Times int `json:"times"`
+}
+
+// LoadFixtures reads fixtures from a YAML or JSON file
+func LoadFixtures(path string) (Fixtures, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Fixtures{}, err
+	}
+
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return Fixtures{}, fmt.Errorf("could not parse fixtures %s: %v", path, err)
+	}
+
+	fixtures := Fixtures{}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return Fixtures{}, fmt.Errorf("could not parse fixtures %s: %v", path, err)
+	}
+
+	return fixtures, nil
+}
+
+// Load adds the fixtures to the fake
+func (f *Fake) Load(fixtures Fixtures) error {
+	faults := []Fault{}
+	for _, fault := range fixtures.Faults {
+		latency := time.Duration(0)
+		if fault.Latency != "" {
+			var err error
+			latency, err = time.ParseDuration(fault.Latency)
+			if err != nil {
+				return fmt.Errorf("invalid latency for fault on %q: %v", fault.Path, err)
+			}
+		}
+
+		faults = append(faults, Fault{Path: fault.Path, Latency: latency, Status: fault.Status, Malformed: fault.Malformed, Times: fault.Times})
+	}
+
+	f.lock.Lock()
+	if fixtures.ApiKey != "" {
+		f.ApiKey = fixtures.ApiKey
+	}
+
+	if fixtures.PageSize > 0 {
+		f.PageSize = fixtures.PageSize
+	}
+	f.lock.Unlock()
+
+	for _, appFixture := range fixtures.Apps {
+		app := f.AddApp(appFixture.Name)
+		for metricName, values := range appFixture.Metrics {
+			for valueKey, value := range values {
+				app.SetMetric(metricName, valueKey, value)
+			}
+		}
+
+		for _, hostFixture := range appFixture.Hosts {
+			host := app.AddHost(hostFixture.Name)
+			for metricName, values := range hostFixture.Metrics {
+				for valueKey, value := range values {
+					host.SetMetric(metricName, valueKey, value)
+				}
+			}
+		}
+	}
+
+	for _, nrql := range fixtures.Nrql {
+		f.SetNrql(nrql.AccountID, nrql.Query, nrql.Value)
+	}
+
+	for _, fault := range faults {
+		f.AddFault(fault)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package newrelictest
+
+import (
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"net/http/httptest"
+)
+
+// Server runs a Fake on a local port
+type Server struct {
+	*Fake
+	server *httptest.Server
+}
+
+// NewServer starts a Fake with no fixtures, Close must be called to stop it
+func NewServer() *Server {
+	fake := NewFake()
+	return &Server{Fake: fake, server: httptest.NewServer(fake)}
+}
+
+// URL is the base URL of the server, e.g. http://127.0.0.1:51234
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Endpoints points a newrelic.Api at the server
+func (s *Server) Endpoints() newrelic.Endpoints {
+	return newrelic.EndpointsAt(s.URL())
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
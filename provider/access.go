@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ALLOWED_APPS_ANNOTATION lists the app names (or globs) a namespace may query, comma separated
+	ALLOWED_APPS_ANNOTATION = "newrelic.com/allowed-apps"
+	// ALLOWED_METRICS_ANNOTATION lists the metric names (or globs) a namespace may query, comma separated
+	ALLOWED_METRICS_ANNOTATION = "newrelic.com/allowed-metrics"
+	// ALLOWED_ACCOUNTS_ANNOTATION lists the account IDs a namespace may send NRQL queries to, comma separated
+	ALLOWED_ACCOUNTS_ANNOTATION = "newrelic.com/allowed-accounts"
+)
+
+var configMapsResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// accessPolicy is what a namespace is allowed to query, apps must always be allowed explicitly while metrics are
+// only restricted once a metric list is configured
+type accessPolicy struct {
+	apps []string
+	metrics []string
+	accounts []string
+}
+
+func splitGlobs(value string) []string {
+	globs := []string{}
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+
+	return globs
+}
+
+func matchesAny(globs []string, value string) bool {
+	for _, glob := range globs {
+		if matched, err := path.Match(glob, value); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessPolicyFor merges the namespace's entries in the policy ConfigMap (<namespace>.allowed-apps,
+// <namespace>.allowed-metrics and <namespace>.allowed-accounts) with the matching annotations on the namespace. Both
+// objects are read through the object cache.
+func (np newrelicProvider) accessPolicyFor(namespace string) (accessPolicy, error) {
+	policy := accessPolicy{}
+
+	if np.options.AccessPolicyConfigMap != "" {
+		parts := strings.SplitN(np.options.AccessPolicyConfigMap, "/", 2)
+		configMap, err := np.objects.get(configMapsResource, parts[0], parts[1])
+		if err != nil && !apierrors.IsNotFound(err) {
+			return policy, err
+		}
+
+		if err == nil {
+			data, _, _ := unstructured.NestedStringMap(configMap.Object, "data")
+			policy.apps = append(policy.apps, splitGlobs(data[namespace + ".allowed-apps"])...)
+			policy.metrics = append(policy.metrics, splitGlobs(data[namespace + ".allowed-metrics"])...)
+			policy.accounts = append(policy.accounts, splitGlobs(data[namespace + ".allowed-accounts"])...)
+		}
+	}
+
+	ns, err := np.objects.get(namespacesResource, "", namespace)
+	if err != nil {
+		return policy, err
+	}
+
+	policy.apps = append(policy.apps, splitGlobs(ns.GetAnnotations()[ALLOWED_APPS_ANNOTATION])...)
+	policy.metrics = append(policy.metrics, splitGlobs(ns.GetAnnotations()[ALLOWED_METRICS_ANNOTATION])...)
+	policy.accounts = append(policy.accounts, splitGlobs(ns.GetAnnotations()[ALLOWED_ACCOUNTS_ANNOTATION])...)
+
+	return policy, nil
+}
+
+// authorize returns a Forbidden error when the namespace may not query the metric or one of the apps. Empty app
+// names (NRQL metric definitions) are only checked against the metric list: the apps an NRQL query reads cannot be
+// told from the query, so authorizeAccount is the only boundary for them.
+func (np newrelicProvider) authorize(namespace string, groupResource schema.GroupResource, metricName string, appNames []string) error {
+	if !np.options.EnforceAccessPolicy {
+		return nil
+	}
+
+	policy, err := np.accessPolicyFor(namespace)
+	if err != nil {
+		return err
+	}
+
+	if len(policy.metrics) > 0 && !matchesAny(policy.metrics, metricName) {
+		return apierrors.NewForbidden(groupResource, metricName, fmt.Errorf("namespace %s may not query metric %s", namespace, metricName))
+	}
+
+	for _, appName := range appNames {
+		if appName != "" && !matchesAny(policy.apps, appName) {
+			return apierrors.NewForbidden(groupResource, metricName, fmt.Errorf("namespace %s may not query app %s", namespace, appName))
+		}
+	}
+
+	return nil
+}
+
+// authorizeAccount returns a Forbidden error when the namespace may not send queries to the account
+func (np newrelicProvider) authorizeAccount(namespace string, groupResource schema.GroupResource, metricName string, accountId int) error {
+	if !np.options.EnforceAccessPolicy {
+		return nil
+	}
+
+	policy, err := np.accessPolicyFor(namespace)
+	if err != nil {
+		return err
+	}
+
+	if !matchesAny(policy.accounts, strconv.Itoa(accountId)) {
+		return apierrors.NewForbidden(groupResource, metricName, fmt.Errorf("namespace %s may not query account %d", namespace, accountId))
+	}
+
+	return nil
+}
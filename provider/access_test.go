@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	"testing"
+)
+
+func testConfigMap(namespace string, name string, data map[string]interface{}) *unstructured.Unstructured {
+	return testObject("v1", "ConfigMap", namespace, name, nil, map[string]interface{}{"data": data})
+}
+
+func accessControlledProvider(objects ...runtime.Object) (*newrelicProvider, *fake.FakeDynamicClient) {
+	return testProvider(TestRpmProvider{}, Options{
+		EnforceAccessPolicy: true,
+		AccessPolicyConfigMap: "custom-metrics/newrelic-access",
+	}, objects...)
+}
+
+func TestAccessPolicyAllowsAnnotatedApps(t *testing.T) {
+	np, _ := accessControlledProvider(testNamespace("marketplace", map[string]interface{}{
+		ALLOWED_APPS_ANNOTATION: "marketplace-*, checkout",
+	}))
+
+	_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err != nil {
+		t.Errorf("App matching an allowed glob was denied: %s", err)
+	}
+
+	_, err = np.GetExternalMetric("marketplace", appNameSelector("billing-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("Expected forbidden for an app that is not allowed, got %v", err)
+	}
+}
+
+func TestAccessPolicyFromConfigMap(t *testing.T) {
+	np, _ := accessControlledProvider(
+		testNamespace("marketplace", nil),
+		testConfigMap("custom-metrics", "newrelic-access", map[string]interface{}{
+			"marketplace.allowed-apps": "marketplace-prod",
+			"marketplace.allowed-metrics": "marketplace-*",
+		}),
+	)
+
+	_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("Expected forbidden for a metric that is not allowed, got %v", err)
+	}
+
+	_, err = np.GetExternalMetric("billing", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err == nil {
+		t.Errorf("Expected an error for a namespace without a policy")
+	}
+}
+
+func TestAccessPolicyDeniesByDefault(t *testing.T) {
+	np, _ := accessControlledProvider(testNamespace("marketplace", nil))
+
+	_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("Expected forbidden without any allowed apps, got %v", err)
+	}
+}
+
+func TestAccessPolicyRestrictsAccounts(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": int64(42)},
+	})
+	np, _ := testProvider(TestRpmProvider{}, Options{EnforceAccessPolicy: true}, obj, testNamespace("marketplace", map[string]interface{}{
+		ALLOWED_ACCOUNTS_ANNOTATION: "7",
+	}))
+	np.definitionChanged(obj)
+
+	_, err := np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if !apierrors.IsForbidden(err) {
+		t.Errorf("Expected forbidden for an account that is not allowed, got %v", err)
+	}
+}
+
+// TestAccessPolicyDoesNotRestrictNrqlApps documents that the account list is the only boundary for NRQL: the query
+// is not tied to an app, so a namespace allowed one app may query any app of an allowed account
+func TestAccessPolicyDoesNotRestrictNrqlApps(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "checkout-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction WHERE appName = 'checkout'", "accountId": int64(42)},
+	})
+	np, _ := testProvider(TestRpmProvider{}, Options{EnforceAccessPolicy: true}, obj, testNamespace("marketplace", map[string]interface{}{
+		ALLOWED_APPS_ANNOTATION: "marketplace-prod",
+		ALLOWED_ACCOUNTS_ANNOTATION: "42",
+	}))
+	np.definitionChanged(obj)
+
+	_, err := np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "checkout-transactions"})
+	if err != nil {
+		t.Errorf("Expected NRQL to be checked against the allowed accounts only, got %v", err)
+	}
+}
+
+func TestAccessPolicyIsReadOncePerTTL(t *testing.T) {
+	np, client := accessControlledProvider(testNamespace("marketplace", map[string]interface{}{
+		ALLOWED_APPS_ANNOTATION: "marketplace-*",
+	}))
+
+	for i := 0; i < 3; i++ {
+		_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+		if err != nil {
+			t.Fatalf("There was an error: %s", err)
+		}
+	}
+
+	// the missing ConfigMap is cached as well as the namespace
+	if len(client.Actions()) != 2 {
+		t.Errorf("Expected the namespace and the ConfigMap to be read once, got %v", client.Actions())
+	}
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// SECRET_API_KEY is the Secret key holding a New Relic API key
+	SECRET_API_KEY = "apiKey"
+	// SECRET_ACCOUNT_ID is the Secret key holding the New Relic account ID used for NRQL queries
+	SECRET_ACCOUNT_ID = "accountId"
+)
+
+var secretsResource = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// credentials is an api for a Secret's API key along with the account ID the Secret declares
+type credentials struct {
+	api newrelic.RpmProvider
+	accountId int
+}
+
+// credentialStore keeps one api per API key, so namespaces sharing a key share its client. Secrets are mapped to the
+// key they held when last read, a changed key replaces the api and the old one is dropped once nothing uses it.
+type credentialStore struct {
+	lock sync.Mutex
+	apis map[string]newrelic.RpmProvider
+	secretKeys map[string]string
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{
+		apis: map[string]newrelic.RpmProvider{},
+		secretKeys: map[string]string{},
+	}
+}
+
+func (s *credentialStore) apiFor(secret string, apiKey string, newApi func(apiKey string) newrelic.RpmProvider) newrelic.RpmProvider {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if previousKey, ok := s.secretKeys[secret]; ok && previousKey != apiKey {
+		delete(s.secretKeys, secret)
+		if !s.keyInUseLocked(previousKey) {
+			delete(s.apis, previousKey)
+		}
+	}
+
+	s.secretKeys[secret] = apiKey
+	api, ok := s.apis[apiKey]
+	if !ok {
+		api = newApi(apiKey)
+		s.apis[apiKey] = api
+	}
+
+	return api
+}
+
+func (s *credentialStore) keyInUseLocked(apiKey string) bool {
+	for _, key := range s.secretKeys {
+		if key == apiKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+func secretValue(secret *unstructured.Unstructured, key string) (string, error) {
+	encoded, _, _ := unstructured.NestedString(secret.Object, "data", key)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("secret %s/%s has an invalid %s: %v", secret.GetNamespace(), secret.GetName(), key, err)
+	}
+
+	return strings.TrimSpace(string(decoded)), nil
+}
+
+// credentialsFor returns the api to use for a namespace. secretName references a Secret explicitly (from a metric
+// definition), otherwise the conventional CredentialsSecretName is looked up and the default api is used when the
+// namespace does not have one.
+func (np newrelicProvider) credentialsFor(namespace string, secretName string) (credentials, error) {
+	explicit := secretName != ""
+	if !explicit {
+		secretName = np.options.CredentialsSecretName
+	}
+
+	if secretName == "" || np.options.NewApi == nil {
+		return credentials{api: np.api}, nil
+	}
+
+	secret, err := np.objects.get(secretsResource, namespace, secretName)
+	if apierrors.IsNotFound(err) && !explicit {
+		return credentials{api: np.api}, nil
+	}
+
+	if apierrors.IsForbidden(err) {
+		// the shipped ClusterRole only allows reading the Secrets it names
+		return credentials{}, apierrors.NewForbidden(secretsResource.GroupResource(), secretName, fmt.Errorf("the adapter may not read secret %s/%s, add %s to the resourceNames of its ClusterRole", namespace, secretName, secretName))
+	}
+
+	if err != nil {
+		return credentials{}, err
+	}
+
+	apiKey, err := secretValue(secret, SECRET_API_KEY)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	if apiKey == "" {
+		return credentials{}, apierrors.NewBadRequest(fmt.Sprintf("secret %s/%s does not hold an %s", namespace, secretName, SECRET_API_KEY))
+	}
+
+	result := credentials{
+		api: np.credentials.apiFor(namespace + "/" + secretName, apiKey, np.options.NewApi),
+	}
+
+	accountId, err := secretValue(secret, SECRET_ACCOUNT_ID)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	if accountId != "" {
+		result.accountId, err = strconv.Atoi(accountId)
+		if err != nil {
+			return credentials{}, apierrors.NewBadRequest(fmt.Sprintf("secret %s/%s has a non numeric %s", namespace, secretName, SECRET_ACCOUNT_ID))
+		}
+	}
+
+	return result, nil
+}
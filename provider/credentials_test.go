@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+)
+
+type KeyedRpmProvider struct {
+	TestRpmProvider
+	Key string
+}
+
+func testSecret(namespace string, name string, data map[string]string) *unstructured.Unstructured {
+	encoded := map[string]interface{}{}
+	for key, value := range data {
+		encoded[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	return testObject("v1", "Secret", namespace, name, nil, map[string]interface{}{"data": encoded})
+}
+
+func credentialsProvider(objects ...runtime.Object) (*newrelicProvider, *fake.FakeDynamicClient, *int) {
+	created := 0
+	np, client := testProvider(KeyedRpmProvider{Key: "default"}, Options{
+		CredentialsSecretName: "newrelic",
+		NewApi: func(apiKey string) newrelic.RpmProvider {
+			created++
+			return KeyedRpmProvider{Key: apiKey}
+		},
+	}, objects...)
+
+	return np, client, &created
+}
+
+func TestCredentialsFromNamespaceSecret(t *testing.T) {
+	np, client, created := credentialsProvider(testSecret("marketplace", "newrelic", map[string]string{
+		SECRET_API_KEY: "marketplace-key",
+		SECRET_ACCOUNT_ID: "42",
+	}))
+
+	creds, err := np.credentialsFor("marketplace", "")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if creds.api.(KeyedRpmProvider).Key != "marketplace-key" || creds.accountId != 42 {
+		t.Errorf("Expected marketplace-key for account 42, got %v", creds)
+	}
+
+	np.credentialsFor("marketplace", "")
+	if *created != 1 {
+		t.Errorf("Expected the api to be cached, %d were created", *created)
+	}
+
+	if len(client.Actions()) != 1 {
+		t.Errorf("Expected the Secret to be read once, got %v", client.Actions())
+	}
+}
+
+func TestCredentialsFallBackToDefault(t *testing.T) {
+	np, _, _ := credentialsProvider()
+
+	creds, err := np.credentialsFor("marketplace", "")
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if creds.api.(KeyedRpmProvider).Key != "default" {
+		t.Errorf("Expected the default api without a namespace secret")
+	}
+
+	_, err = np.credentialsFor("marketplace", "referenced")
+	if err == nil {
+		t.Errorf("Expected an error for a missing referenced secret")
+	}
+}
+
+func TestCredentialsSecretNotAllowedByRbac(t *testing.T) {
+	np, client, _ := credentialsProvider(testSecret("checkout", "checkout-newrelic", map[string]string{
+		SECRET_API_KEY: "checkout-key",
+	}))
+
+	// the shipped ClusterRole only allows reading the Secrets it names
+	client.PrependReactor("get", "secrets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(secretsResource.GroupResource(), "checkout-newrelic", errors.New("RBAC: access denied"))
+	})
+
+	_, err := np.credentialsFor("checkout", "checkout-newrelic")
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "resourceNames") {
+		t.Errorf("Expected a Forbidden error pointing at the ClusterRole, got %v", err)
+	}
+}
+
+func TestCredentialStoreRotatesKeys(t *testing.T) {
+	store := newCredentialStore()
+	newApi := func(apiKey string) newrelic.RpmProvider {
+		return KeyedRpmProvider{Key: apiKey}
+	}
+
+	store.apiFor("marketplace/newrelic", "old-key", newApi)
+	store.apiFor("billing/newrelic", "shared-key", newApi)
+	api := store.apiFor("marketplace/newrelic", "new-key", newApi)
+
+	if api.(KeyedRpmProvider).Key != "new-key" {
+		t.Errorf("Rotated secret did not get a new api")
+	}
+
+	if _, ok := store.apis["old-key"]; ok {
+		t.Errorf("Api for the rotated out key was not dropped")
+	}
+
+	if len(store.apis) != 2 {
+		t.Errorf("Expected 2 apis, got %d", len(store.apis))
+	}
+}
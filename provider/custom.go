@@ -0,0 +1,245 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider/helpers"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"time"
+)
+
+var (
+	podsGroupResource = schema.GroupResource{Resource: "pods"}
+	deploymentsGroupResource = schema.GroupResource{Group: "apps", Resource: "deployments"}
+)
+
+// appNameForObject returns the app named by the metric selector, falling back to annotation resolution when enabled,
+// once the namespace has been authorized to query it
+func (np newrelicProvider) appNameForObject(ctx context.Context, namespace string, deploymentName string, metricSelector labels.Selector, info provider.CustomMetricInfo) (appName string, err error) {
+	_, span := tracing.Start(ctx, "provider.resolveAppNames", tracing.Bool("provider.resolve_from_annotations", np.options.ResolveAppName))
+	defer func() {
+		span.SetAttributes(tracing.StringSlice("provider.apps", []string{appName}))
+		tracing.End(span, err)
+	}()
+
+	appNames, err := appNamesFromSelector(metricSelector)
+	if err != nil {
+		return "", err
+	}
+
+	if len(appNames) > 1 {
+		return "", apierrors.NewBadRequest("custom metrics only support a single appName")
+	}
+
+	if len(appNames) == 1 {
+		appName = appNames[0]
+	} else if np.options.ResolveAppName {
+		if deploymentName == "" {
+			deploymentName = selectorValue(metricSelector, DEPLOYMENT_KEY)
+		}
+
+		appName, err = np.resolveAppName(namespace, deploymentName)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		return "", apierrors.NewBadRequest("could not find appName selector")
+	}
+
+	err = np.authorize(namespace, info.GroupResource, info.Metric, []string{appName})
+	if err != nil {
+		return "", err
+	}
+
+	return appName, nil
+}
+
+// hostMetrics returns the per-host results of an app keyed by host name, which is the pod name for containerised agents
+func (np newrelicProvider) hostMetrics(ctx context.Context, namespace string, appName string) (map[string]newrelic.MetricResult, error) {
+	creds, err := np.credentialsFor(namespace, "")
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := creds.api.GetPerHostMetrics(ctx, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	byHost := map[string]newrelic.MetricResult{}
+	for _, result := range results {
+		byHost[result.Host] = result
+	}
+
+	return byHost, nil
+}
+
+func (np newrelicProvider) metricValue(name types.NamespacedName, info provider.CustomMetricInfo, result newrelic.MetricResult) (*custom_metrics.MetricValue, error) {
+	if result.IsStale(np.options.MaxDataAge, time.Now()) {
+		return nil, apierrors.NewServiceUnavailable(
+			fmt.Sprintf("New Relic data for %s is older than %s (last timeslice %s)", result.AppName, np.options.MaxDataAge, result.Timestamp))
+	}
+
+	ref, err := helpers.ReferenceFor(np.mapper, name, info)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := result.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return &custom_metrics.MetricValue{
+		DescribedObject: ref,
+		Metric: custom_metrics.MetricIdentifier{
+			Name: info.Metric,
+		},
+		Timestamp: meta1.Time{timestamp},
+		Value: *resource.NewQuantity(int64(result.Value), resource.DecimalSI),
+	}, nil
+}
+
+func (np newrelicProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	ctx, span := tracing.Start(context.Background(), "provider.GetMetricByName",
+		tracing.String("provider.namespace", name.Namespace),
+		tracing.String("provider.name", name.Name),
+		tracing.String("provider.resource", info.GroupResource.String()),
+		tracing.String("provider.metric", info.Metric),
+	)
+
+	value, err := np.getMetricByName(ctx, name, info, metricSelector)
+	tracing.End(span, err)
+	return value, err
+}
+
+func (np newrelicProvider) getMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	switch info.GroupResource {
+	case podsGroupResource:
+		appName, err := np.appNameForObject(ctx, name.Namespace, "", metricSelector, info)
+		if err != nil {
+			return nil, err
+		}
+
+		byHost, err := np.hostMetrics(ctx, name.Namespace, appName)
+		if err != nil {
+			return nil, err
+		}
+
+		result, ok := byHost[name.Name]
+		if !ok {
+			return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+		}
+
+		return np.metricValue(name, info, result)
+	case deploymentsGroupResource:
+		appName, err := np.appNameForObject(ctx, name.Namespace, name.Name, metricSelector, info)
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err := np.credentialsFor(name.Namespace, "")
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := creds.api.GetApplicationMetric(ctx, appName)
+		if err != nil {
+			return nil, err
+		}
+
+		return np.metricValue(name, info, result)
+	}
+
+	return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+}
+
+func (np newrelicProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	ctx, span := tracing.Start(context.Background(), "provider.GetMetricBySelector",
+		tracing.String("provider.namespace", namespace),
+		tracing.String("provider.selector", selector.String()),
+		tracing.String("provider.resource", info.GroupResource.String()),
+		tracing.String("provider.metric", info.Metric),
+	)
+
+	values, err := np.getMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	tracing.End(span, err)
+	return values, err
+}
+
+func (np newrelicProvider) getMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if info.GroupResource != podsGroupResource && info.GroupResource != deploymentsGroupResource {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	names, err := helpers.ListObjectNames(np.mapper, np.client, namespace, selector, info)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []custom_metrics.MetricValue{}
+	if info.GroupResource == deploymentsGroupResource {
+		for _, name := range names {
+			value, err := np.getMetricByName(ctx, types.NamespacedName{Namespace: namespace, Name: name}, info, metricSelector)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, *value)
+		}
+
+		return &custom_metrics.MetricValueList{Items: values}, nil
+	}
+
+	// all pods matched by the selector are expected to report to the same app, so the hosts are fetched once
+	appName, err := np.appNameForObject(ctx, namespace, "", metricSelector, info)
+	if err != nil {
+		return nil, err
+	}
+
+	byHost, err := np.hostMetrics(ctx, namespace, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		result, ok := byHost[name]
+		if !ok {
+			// pods without New Relic data are left out so the HPA treats them as missing rather than idle
+			continue
+		}
+
+		value, err := np.metricValue(types.NamespacedName{Namespace: namespace, Name: name}, info, result)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, *value)
+	}
+
+	return &custom_metrics.MetricValueList{Items: values}, nil
+}
+
+func (np newrelicProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	return []provider.CustomMetricInfo{
+		{
+			GroupResource: podsGroupResource,
+			Namespaced: true,
+			Metric: "rpm",
+		},
+		{
+			GroupResource: deploymentsGroupResource,
+			Namespaced: true,
+			Metric: "rpm",
+		},
+	}
+}
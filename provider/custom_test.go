@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"context"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+type TestHostRpmProvider struct {
+	TestRpmProvider
+}
+
+func (TestHostRpmProvider) GetPerHostMetrics(ctx context.Context, appName string) ([]newrelic.MetricResult, error) {
+	return []newrelic.MetricResult{
+		{AppName: appName, Host: "marketplace-cmd-abc12", Aggregation: newrelic.AggregationHost, Value: 40, Timestamp: testTimestamp},
+		{AppName: appName, Host: "marketplace-cmd-def34", Aggregation: newrelic.AggregationHost, Value: 60, Timestamp: testTimestamp},
+	}, nil
+}
+
+func testMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	return mapper
+}
+
+func appNameSelector(appName string) labels.Selector {
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{appName})
+	return selector.Add(*requirement)
+}
+
+func TestGetMetricByNameForPod(t *testing.T) {
+	np := NewProvider(TestDynamic{}, testMapper(), TestHostRpmProvider{}, Options{})
+
+	info := provider.CustomMetricInfo{GroupResource: podsGroupResource, Namespaced: true, Metric: "rpm"}
+	value, err := np.GetMetricByName(types.NamespacedName{Namespace: "marketplace", Name: "marketplace-cmd-def34"}, info, appNameSelector("marketplace-prod"))
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := value.Value.AsInt64(); val != int64(60) {
+		t.Errorf("Expected pod rpm of 60, got %d", val)
+	}
+
+	if value.DescribedObject.Kind != "Pod" || value.DescribedObject.Name != "marketplace-cmd-def34" {
+		t.Errorf("Value describes the wrong object: %v", value.DescribedObject)
+	}
+}
+
+func TestGetMetricByNameForPodWithoutHost(t *testing.T) {
+	np := NewProvider(TestDynamic{}, testMapper(), TestHostRpmProvider{}, Options{})
+
+	info := provider.CustomMetricInfo{GroupResource: podsGroupResource, Namespaced: true, Metric: "rpm"}
+	_, err := np.GetMetricByName(types.NamespacedName{Namespace: "marketplace", Name: "not-a-host"}, info, appNameSelector("marketplace-prod"))
+
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected not found for a pod without New Relic data, got %v", err)
+	}
+}
+
+func TestGetMetricByNameForDeployment(t *testing.T) {
+	np := NewProvider(TestDynamic{}, testMapper(), TestHostRpmProvider{}, Options{})
+
+	info := provider.CustomMetricInfo{GroupResource: deploymentsGroupResource, Namespaced: true, Metric: "rpm"}
+	value, err := np.GetMetricByName(types.NamespacedName{Namespace: "marketplace", Name: "marketplace-cmd"}, info, appNameSelector("marketplace-prod"))
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := value.Value.AsInt64(); val != int64(123) {
+		t.Errorf("Expected deployment rpm of 123, got %d", val)
+	}
+}
+
+func TestListAllMetrics(t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestHostRpmProvider{}, Options{})
+
+	if len(np.ListAllMetrics()) != 2 {
+		t.Errorf("Expected rpm for pods and deployments")
+	}
+}
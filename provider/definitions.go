@@ -0,0 +1,605 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AggregationFallback labels values that were replaced by a metric definition's fallback value
+const AggregationFallback = "fallback"
+
+var metricDefinitionsResource = schema.GroupVersionResource{
+	Group: "newrelic.flexshopper.com",
+	Version: "v1alpha1",
+	Resource: "newrelicmetrics",
+}
+
+// metricDefinition is a parsed NewRelicMetric object declaring an external metric
+type metricDefinition struct {
+	Namespace string
+	Name string
+	Generation int64
+
+	MetricName string
+	AppName string
+	Query newrelic.MetricQuery
+	Nrql string
+	AccountID int
+	FallbackValue *int
+	// CredentialsSecret is the Secret in the definition's namespace holding the API key to query with
+	CredentialsSecret string
+	// FailurePolicy overrides the provider's failure policy when set
+	FailurePolicy *FailurePolicy
+	// Smoothing overrides the provider's smoothing when set
+	Smoothing *Smoothing
+	// Static definitions come from the config file, they are never removed and have no status
+	Static bool
+}
+
+// parseMetricDefinition validates a NewRelicMetric object, errors are written to the object's status
+func parseMetricDefinition(obj *unstructured.Unstructured) (metricDefinition, error) {
+	definition := metricDefinition{
+		Namespace: obj.GetNamespace(),
+		Name: obj.GetName(),
+		Generation: obj.GetGeneration(),
+		Query: newrelic.RequestsPerMinute,
+	}
+
+	spec, found, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil || !found {
+		return definition, errors.New("spec is required")
+	}
+
+	definition.MetricName, _, _ = unstructured.NestedString(spec, "metricName")
+	if definition.MetricName == "" {
+		return definition, errors.New("spec.metricName is required")
+	}
+
+	if definition.MetricName == "rpm" {
+		return definition, errors.New("spec.metricName rpm is reserved for the built in metric")
+	}
+
+	definition.AppName, _, _ = unstructured.NestedString(spec, "appName")
+	definition.CredentialsSecret, _, _ = unstructured.NestedString(spec, "credentialsSecret")
+	definition.Nrql, _, _ = unstructured.NestedString(spec, "query", "nrql")
+	restMetricName, _, _ := unstructured.NestedString(spec, "query", "metric", "name")
+	restValueKey, _, _ := unstructured.NestedString(spec, "query", "metric", "value")
+	aggregation, _, _ := unstructured.NestedString(spec, "aggregation")
+	window, _, _ := unstructured.NestedString(spec, "window")
+
+	if definition.Nrql != "" {
+		if restMetricName != "" {
+			return definition, errors.New("only one of spec.query.nrql and spec.query.metric may be set")
+		}
+
+		// the account can also come from the accountId selector label, a credentials Secret or the default account
+		accountId, _, err := unstructured.NestedInt64(spec, "query", "accountId")
+		if err != nil {
+			return definition, errors.New("spec.query.accountId must be an integer")
+		}
+
+		if aggregation != "" || window != "" {
+			return definition, errors.New("spec.aggregation and spec.window are not supported for NRQL queries, use SINCE in the query")
+		}
+
+		definition.AccountID = int(accountId)
+	}
+
+	if restMetricName != "" {
+		if restValueKey == "" {
+			return definition, errors.New("spec.query.metric.value is required")
+		}
+
+		definition.Query.MetricName = restMetricName
+		definition.Query.ValueKey = restValueKey
+	}
+
+	switch aggregation {
+	case "":
+	case newrelic.AggregationSummary, newrelic.AggregationHostAverage:
+		definition.Query.Aggregation = aggregation
+	default:
+		return definition, fmt.Errorf("spec.aggregation must be %s or %s", newrelic.AggregationSummary, newrelic.AggregationHostAverage)
+	}
+
+	if window != "" {
+		definition.Query.Window, err = time.ParseDuration(window)
+		if err != nil || definition.Query.Window <= 0 {
+			return definition, fmt.Errorf("spec.window %q is not a positive duration", window)
+		}
+	}
+
+	fallback, found, _ := unstructured.NestedFieldNoCopy(spec, "fallbackValue")
+	if found {
+		switch value := fallback.(type) {
+		case int64:
+			fallbackValue := int(value)
+			definition.FallbackValue = &fallbackValue
+		case float64:
+			fallbackValue := int(value)
+			definition.FallbackValue = &fallbackValue
+		default:
+			return definition, errors.New("spec.fallbackValue must be a number")
+		}
+	}
+
+	definition.FailurePolicy, err = parseFailurePolicy(spec, definition.FallbackValue)
+	if err != nil {
+		return definition, err
+	}
+
+	definition.Smoothing, err = parseSmoothing(spec)
+	if err != nil {
+		return definition, err
+	}
+
+	return definition, nil
+}
+
+// statusWriteInterval is how often the last values served are written to the NewRelicMetric statuses, values served
+// in between replace each other so an object is written at most once per interval however often it is requested
+var statusWriteInterval = 30 * time.Second
+
+// pendingStatus is a status update waiting to be written
+type pendingStatus struct {
+	namespace string
+	name string
+	fields map[string]interface{}
+}
+
+// definitionStore holds the valid metric definitions keyed by namespace and metric name
+type definitionStore struct {
+	lock sync.RWMutex
+	definitions map[string]metricDefinition
+	// lastValues remembers the value written to each object's status so unchanged values are not rewritten
+	lastValues map[string]string
+	// pendingStatuses are the last values served that have not been written yet, keyed by namespace and name
+	pendingStatuses map[string]pendingStatus
+	// rejected are the definitions refused because another object declared their metric first, keyed by namespace
+	// and name, they are added once that object is deleted
+	rejected map[string]metricDefinition
+	// synced reports whether the NewRelicMetric objects have been listed, it is nil when they are not watched
+	synced func() bool
+}
+
+func newDefinitionStore() *definitionStore {
+	return &definitionStore{
+		definitions: map[string]metricDefinition{},
+		lastValues: map[string]string{},
+		pendingStatuses: map[string]pendingStatus{},
+		rejected: map[string]metricDefinition{},
+	}
+}
+
+func (s *definitionStore) get(namespace string, metricName string) (metricDefinition, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	definition, ok := s.definitions[namespace + "/" + metricName]
+	return definition, ok
+}
+
+// set stores the definition, failing when another object in the namespace already declares the metric. The value
+// written to the object's status is only forgotten when its spec changed, set is also called for the update the
+// status write itself causes.
+func (s *definitionStore) set(definition metricDefinition) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objectKey := definition.Namespace + "/" + definition.Name
+	delete(s.rejected, objectKey)
+	previous, ok := s.removeLocked(definition.Namespace, definition.Name)
+	if ok && previous.Generation != definition.Generation {
+		s.forgetValuesLocked(objectKey)
+	}
+
+	key := definition.Namespace + "/" + definition.MetricName
+	if existing, ok := s.definitions[key]; ok {
+		if !definition.Static {
+			s.rejected[objectKey] = definition
+		}
+
+		return fmt.Errorf("metric %s is already defined by %s", definition.MetricName, existing.Name)
+	}
+
+	s.definitions[key] = definition
+	return nil
+}
+
+// remove forgets the object, when it is deleted or no longer valid
+func (s *definitionStore) remove(namespace string, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objectKey := namespace + "/" + name
+	delete(s.rejected, objectKey)
+	s.removeLocked(namespace, name)
+	s.forgetValuesLocked(objectKey)
+}
+
+// removeLocked removes the object's definition and returns it
+func (s *definitionStore) removeLocked(namespace string, name string) (metricDefinition, bool) {
+	for key, definition := range s.definitions {
+		if definition.Namespace == namespace && definition.Name == name && !definition.Static {
+			delete(s.definitions, key)
+			return definition, true
+		}
+	}
+
+	return metricDefinition{}, false
+}
+
+func (s *definitionStore) forgetValuesLocked(objectKey string) {
+	delete(s.lastValues, objectKey)
+	delete(s.pendingStatuses, objectKey)
+}
+
+// addRejected adds the rejected definitions whose metric is no longer declared by another object and returns them
+func (s *definitionStore) addRejected() []metricDefinition {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// sorted so the object added does not depend on map order when several were rejected for the same metric
+	objectKeys := []string{}
+	for objectKey := range s.rejected {
+		objectKeys = append(objectKeys, objectKey)
+	}
+
+	sort.Strings(objectKeys)
+	added := []metricDefinition{}
+	for _, objectKey := range objectKeys {
+		definition := s.rejected[objectKey]
+		key := definition.Namespace + "/" + definition.MetricName
+		if _, ok := s.definitions[key]; ok {
+			continue
+		}
+
+		delete(s.rejected, objectKey)
+		s.definitions[key] = definition
+		added = append(added, definition)
+	}
+
+	return added
+}
+
+// metricNames returns the distinct metric names defined across all namespaces
+func (s *definitionStore) metricNames() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	seen := map[string]bool{}
+	metricNames := []string{}
+	for _, definition := range s.definitions {
+		if !seen[definition.MetricName] {
+			seen[definition.MetricName] = true
+			metricNames = append(metricNames, definition.MetricName)
+		}
+	}
+
+	sort.Strings(metricNames)
+	return metricNames
+}
+
+// valueChanged records the latest value for an object and reports whether it differs from the previous one
+func (s *definitionStore) valueChanged(namespace string, name string, value string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := namespace + "/" + name
+	if s.lastValues[key] == value {
+		return false
+	}
+
+	s.lastValues[key] = value
+	return true
+}
+
+// queueStatus replaces the status update waiting to be written for an object
+func (s *definitionStore) queueStatus(namespace string, name string, fields map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pendingStatuses[namespace + "/" + name] = pendingStatus{namespace: namespace, name: name, fields: fields}
+}
+
+// takePendingStatuses returns the status updates waiting to be written and forgets them
+func (s *definitionStore) takePendingStatuses() []pendingStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pending := []pendingStatus{}
+	for _, status := range s.pendingStatuses {
+		pending = append(pending, status)
+	}
+
+	s.pendingStatuses = map[string]pendingStatus{}
+	return pending
+}
+
+func (np newrelicProvider) WatchMetricDefinitions(stopCh <-chan struct{}) {
+	resourceClient := np.client.Resource(metricDefinitionsResource)
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options meta1.ListOptions) (runtime.Object, error) {
+				return resourceClient.List(options)
+			},
+			WatchFunc: func(options meta1.ListOptions) (watch.Interface, error) {
+				return resourceClient.Watch(options)
+			},
+		},
+		&unstructured.Unstructured{},
+		0,
+		cache.Indexers{},
+	)
+
+	np.definitions.lock.Lock()
+	np.definitions.synced = informer.HasSynced
+	np.definitions.lock.Unlock()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: np.definitionChanged,
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			np.definitionChanged(newObj)
+		},
+		DeleteFunc: np.definitionDeleted,
+	})
+
+	go informer.Run(stopCh)
+	go wait.Until(np.writePendingStatuses, statusWriteInterval, stopCh)
+}
+
+// CheckMetricDefinitions fails until the NewRelicMetric objects have been listed, metrics they declare would
+// otherwise be reported as missing right after startup
+func (np newrelicProvider) CheckMetricDefinitions() error {
+	np.definitions.lock.RLock()
+	synced := np.definitions.synced
+	np.definitions.lock.RUnlock()
+
+	if synced != nil && !synced() {
+		return errors.New("NewRelicMetric objects have not been listed yet")
+	}
+
+	return nil
+}
+
+func (np newrelicProvider) definitionChanged(obj interface{}) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	definition, err := parseMetricDefinition(unstructuredObj)
+	if err == nil {
+		err = np.definitions.set(definition)
+	} else {
+		np.definitions.remove(definition.Namespace, definition.Name)
+	}
+
+	validationError := ""
+	if err != nil {
+		validationError = err.Error()
+		glog.Warningf("NewRelicMetric %s/%s is invalid: %s", definition.Namespace, definition.Name, validationError)
+	}
+
+	// the object may have declared a metric another object was rejected for
+	np.addRejectedDefinitions()
+
+	// status writes cause an update event of their own, only write when the spec generation or validity changed
+	observedGeneration, _, _ := unstructured.NestedInt64(unstructuredObj.Object, "status", "observedGeneration")
+	currentError, _, _ := unstructured.NestedString(unstructuredObj.Object, "status", "validationError")
+	if observedGeneration == definition.Generation && currentError == validationError {
+		return
+	}
+
+	np.writeDefinitionStatus(definition.Namespace, definition.Name, map[string]interface{}{
+		"observedGeneration": definition.Generation,
+		"valid": err == nil,
+		"validationError": validationError,
+	})
+}
+
+func (np newrelicProvider) definitionDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	np.definitions.remove(unstructuredObj.GetNamespace(), unstructuredObj.GetName())
+	np.addRejectedDefinitions()
+}
+
+// addRejectedDefinitions adds the definitions rejected as duplicates of a metric that is free now, the informer does
+// not resync so they would otherwise stay rejected until they are edited
+func (np newrelicProvider) addRejectedDefinitions() {
+	for _, definition := range np.definitions.addRejected() {
+		glog.Infof("NewRelicMetric %s/%s now declares metric %s", definition.Namespace, definition.Name, definition.MetricName)
+		np.writeDefinitionStatus(definition.Namespace, definition.Name, map[string]interface{}{
+			"observedGeneration": definition.Generation,
+			"valid": true,
+			"validationError": "",
+		})
+	}
+}
+
+// writeDefinitionStatus merges fields into a NewRelicMetric's status, failures are only logged since the status is
+// informational and will be written again on the next change
+func (np newrelicProvider) writeDefinitionStatus(namespace string, name string, fields map[string]interface{}) {
+	resourceClient := np.client.Resource(metricDefinitionsResource).Namespace(namespace)
+	obj, err := resourceClient.Get(name, meta1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Could not get NewRelicMetric %s/%s to update its status: %v", namespace, name, err)
+		return
+	}
+
+	status, _, _ := unstructured.NestedMap(obj.Object, "status")
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+
+	for key, value := range fields {
+		status[key] = value
+	}
+
+	err = unstructured.SetNestedMap(obj.Object, status, "status")
+	if err != nil {
+		glog.Warningf("Could not set status on NewRelicMetric %s/%s: %v", namespace, name, err)
+		return
+	}
+
+	_, err = resourceClient.UpdateStatus(obj, meta1.UpdateOptions{})
+	if err != nil {
+		glog.Warningf("Could not update status of NewRelicMetric %s/%s: %v", namespace, name, err)
+	}
+}
+
+// writePendingStatuses writes the last values served since the previous call, outside of any metric request
+func (np newrelicProvider) writePendingStatuses() {
+	for _, status := range np.definitions.takePendingStatuses() {
+		np.writeDefinitionStatus(status.namespace, status.name, status.fields)
+	}
+}
+
+// recordDefinitionValue queues the last value or error served for a definition to be written into its status, the
+// request serving it does not wait for the API server
+func (np newrelicProvider) recordDefinitionValue(definition metricDefinition, results []newrelic.MetricResult, fetchErr error) {
+	if definition.Static {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"lastError": "",
+	}
+
+	if fetchErr != nil {
+		fields["lastError"] = fetchErr.Error()
+	}
+
+	if len(results) > 0 {
+		fields["lastValue"] = int64(results[0].Value)
+		fields["lastTimestamp"] = results[0].Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	if !np.definitions.valueChanged(definition.Namespace, definition.Name, fmt.Sprintf("%v", fields)) {
+		return
+	}
+
+	np.definitions.queueStatus(definition.Namespace, definition.Name, fields)
+}
+
+// accountIdFor picks the account an NRQL query is sent to: the definition's, then the accountId selector label's,
+// then the namespace credentials Secret's and finally the default account. Accounts that do not come from the
+// namespace's own Secret are subject to the access policy.
+func (np newrelicProvider) accountIdFor(namespace string, metricSelector labels.Selector, definition metricDefinition, creds credentials) (int, error) {
+	accountId := definition.AccountID
+	if accountId == 0 {
+		if value := selectorValue(metricSelector, ACCOUNT_KEY); value != "" {
+			var err error
+			accountId, err = strconv.Atoi(value)
+			if err != nil {
+				return 0, apierrors.NewBadRequest(fmt.Sprintf("%s selector %q is not a number", ACCOUNT_KEY, value))
+			}
+		}
+	}
+
+	if accountId == 0 && creds.accountId != 0 {
+		return creds.accountId, nil
+	}
+
+	if accountId == 0 {
+		accountId = np.options.DefaultAccountID
+	}
+
+	if accountId == 0 {
+		return 0, apierrors.NewBadRequest(fmt.Sprintf("no New Relic account for %s, set query.accountId or a %s selector", definition.MetricName, ACCOUNT_KEY))
+	}
+
+	err := np.authorizeAccount(namespace, externalMetricsGroupResource(definition.MetricName), definition.MetricName, accountId)
+	if err != nil {
+		return 0, err
+	}
+
+	return accountId, nil
+}
+
+func (np newrelicProvider) getDefinedMetric(ctx context.Context, namespace string, metricSelector labels.Selector, definition metricDefinition) (*external_metrics.ExternalMetricValueList, error) {
+	appNames := []string{definition.AppName}
+	if definition.Nrql == "" && definition.AppName == "" {
+		var err error
+		appNames, err = np.externalAppNames(ctx, namespace, metricSelector)
+		if err != nil {
+			return &external_metrics.ExternalMetricValueList{}, err
+		}
+	}
+
+	err := np.authorize(namespace, externalMetricsGroupResource(definition.MetricName), definition.MetricName, appNames)
+	if err != nil {
+		return &external_metrics.ExternalMetricValueList{}, err
+	}
+
+	results, err := np.fetchResults(ctx, appNames, func(ctx context.Context, appName string) (newrelic.MetricResult, error) {
+		creds, err := np.credentialsFor(namespace, definition.CredentialsSecret)
+		if err != nil {
+			return newrelic.MetricResult{}, err
+		}
+
+		if definition.Nrql != "" {
+			accountId, err := np.accountIdFor(namespace, metricSelector, definition, creds)
+			if err != nil {
+				return newrelic.MetricResult{}, err
+			}
+
+			result, err := creds.api.GetNrqlMetric(ctx, accountId, definition.Nrql)
+			result.AppName = appName
+			return result, err
+		}
+
+		return creds.api.GetMetric(ctx, appName, definition.Query)
+	})
+
+	policy := np.options.FailurePolicy
+	if definition.FailurePolicy != nil {
+		policy = *definition.FailurePolicy
+	}
+
+	smoothing := np.options.Smoothing
+	if definition.Smoothing != nil {
+		smoothing = *definition.Smoothing
+	}
+
+	key := namespace + "/" + definition.MetricName + "?" + metricSelector.String()
+	results, rawValues := np.smooth(key, smoothing, results, err)
+	servedResults, appliedPolicy, servedErr := np.applyFailurePolicy(key, definition.MetricName, policy, results, err)
+	if appliedPolicy == FailurePolicyFallback {
+		servedResults[0].AppName = definition.AppName
+	}
+
+	np.recordDefinitionValue(definition, servedResults, err)
+
+	if servedErr != nil {
+		return &external_metrics.ExternalMetricValueList{}, servedErr
+	}
+
+	values := withFailurePolicyLabel(externalMetricValues(definition.MetricName, servedResults), appliedPolicy)
+	return withSmoothingLabels(values, smoothing, rawValues), nil
+}
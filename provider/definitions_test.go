@@ -0,0 +1,267 @@
+package provider
+
+import (
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/dynamic/fake"
+	"testing"
+	"time"
+)
+
+func testMetricDefinition(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := testObject("newrelic.flexshopper.com/v1alpha1", "NewRelicMetric", "marketplace", name, nil, map[string]interface{}{"spec": spec})
+	obj.Object["metadata"].(map[string]interface{})["generation"] = int64(1)
+	return obj
+}
+
+func TestParseMetricDefinition(t *testing.T) {
+	definition, err := parseMetricDefinition(testMetricDefinition("errors", map[string]interface{}{
+		"metricName": "marketplace-errors",
+		"appName": "marketplace-prod",
+		"query": map[string]interface{}{
+			"metric": map[string]interface{}{"name": "Errors/all", "value": "error_count"},
+		},
+		"aggregation": "host_average",
+		"window": "5m",
+		"fallbackValue": int64(10),
+		"smoothing": map[string]interface{}{"type": "Max", "window": "10m"},
+	}))
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if definition.Query.MetricName != "Errors/all" || definition.Query.ValueKey != "error_count" {
+		t.Errorf("Query was not parsed, got %v", definition.Query)
+	}
+
+	if definition.Query.Window != 5 * time.Minute || definition.Query.Aggregation != "host_average" {
+		t.Errorf("Window or aggregation was not parsed, got %v", definition.Query)
+	}
+
+	if definition.FallbackValue == nil || *definition.FallbackValue != 10 {
+		t.Errorf("Fallback value was not parsed")
+	}
+
+	if definition.Smoothing == nil || definition.Smoothing.Type != SmoothingMax || definition.Smoothing.Window != 10 * time.Minute {
+		t.Errorf("Smoothing was not parsed, got %v", definition.Smoothing)
+	}
+}
+
+func TestParseMetricDefinitionValidation(t *testing.T) {
+	specs := map[string]map[string]interface{}{
+		"missing metric name": {"appName": "marketplace-prod"},
+		"reserved metric name": {"metricName": "rpm"},
+		"nrql with bad account": {"metricName": "count", "query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": "main"}},
+		"metric without value": {"metricName": "errors", "query": map[string]interface{}{"metric": map[string]interface{}{"name": "Errors/all"}}},
+		"bad aggregation": {"metricName": "errors", "aggregation": "median"},
+		"bad window": {"metricName": "errors", "window": "soon"},
+		"bad fallback": {"metricName": "errors", "fallbackValue": "ten"},
+		"bad smoothing": {"metricName": "errors", "smoothing": map[string]interface{}{"type": "Median"}},
+		"ewma without alpha": {"metricName": "errors", "smoothing": map[string]interface{}{"type": "EWMA"}},
+		"average without samples": {"metricName": "errors", "smoothing": map[string]interface{}{"type": "Average"}},
+	}
+
+	for description, spec := range specs {
+		_, err := parseMetricDefinition(testMetricDefinition("invalid", spec))
+		if err == nil {
+			t.Errorf("Expected a validation error for %s", description)
+		}
+	}
+}
+
+func TestGetExternalMetricFromDefinition(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": int64(42)},
+	})
+	np, client := testProvider(TestRpmProvider{}, Options{}, obj)
+	np.definitionChanged(obj)
+
+	metrics := np.ListAllExternalMetrics()
+	if len(metrics) != 2 || metrics[1].Metric != "marketplace-transactions" {
+		t.Fatalf("Defined metric is not listed, got %v", metrics)
+	}
+
+	client.ClearActions()
+	valueList, err := np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(77) {
+		t.Errorf("Expected NRQL value of 77, got %d", val)
+	}
+
+	if len(client.Actions()) != 0 {
+		t.Errorf("Expected the status to be written outside of the request, got %v", client.Actions())
+	}
+
+	np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	np.writePendingStatuses()
+	if len(client.Actions()) != 2 {
+		t.Errorf("Expected a single get and update for both requests, got %v", client.Actions())
+	}
+
+	updated, _ := client.Resource(metricDefinitionsResource).Namespace("marketplace").Get("nrql", meta1.GetOptions{})
+	lastValue, _, _ := unstructured.NestedInt64(updated.Object, "status", "lastValue")
+	if lastValue != 77 {
+		t.Errorf("Expected last value of 77 in status, got %d", lastValue)
+	}
+}
+
+func TestStatusWriteKeepsTheLastValueWritten(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": int64(42)},
+	})
+	np, client := testProvider(TestRpmProvider{}, Options{}, obj)
+	np.definitionChanged(obj)
+
+	np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	// an update of the object in between, e.g. the one an earlier status write caused, keeps the queued value
+	np.definitionChanged(obj)
+	np.writePendingStatuses()
+
+	updated, _ := client.Resource(metricDefinitionsResource).Namespace("marketplace").Get("nrql", meta1.GetOptions{})
+	if lastValue, _, _ := unstructured.NestedInt64(updated.Object, "status", "lastValue"); lastValue != 77 {
+		t.Fatalf("Expected last value of 77 in status, got %d", lastValue)
+	}
+
+	// the update caused by that write does not make the same value be written again
+	np.definitionChanged(updated)
+	client.ClearActions()
+	np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	np.writePendingStatuses()
+	if len(client.Actions()) != 0 {
+		t.Errorf("Expected an unchanged value not to be written again, got %v", client.Actions())
+	}
+
+	// a new spec generation writes it again
+	updated.SetGeneration(2)
+	np.definitionChanged(updated)
+	client.ClearActions()
+	np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	np.writePendingStatuses()
+	if len(client.Actions()) != 2 {
+		t.Errorf("Expected the value to be written for the new generation, got %v", client.Actions())
+	}
+}
+
+func TestDuplicateDefinitionIsAddedOnceTheFirstIsDeleted(t *testing.T) {
+	spec := map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": int64(42)},
+	}
+	first := testMetricDefinition("first", spec)
+	duplicate := testMetricDefinition("duplicate", spec)
+	np, client := testProvider(TestRpmProvider{}, Options{}, first, duplicate)
+	np.definitionChanged(first)
+	np.definitionChanged(duplicate)
+
+	updated, _ := client.Resource(metricDefinitionsResource).Namespace("marketplace").Get("duplicate", meta1.GetOptions{})
+	if valid, _, _ := unstructured.NestedBool(updated.Object, "status", "valid"); valid {
+		t.Fatalf("Expected the duplicate to be rejected")
+	}
+
+	np.definitionDeleted(first)
+	if definition, ok := np.definitions.get("marketplace", "marketplace-transactions"); !ok || definition.Name != "duplicate" {
+		t.Fatalf("Expected the duplicate to declare the metric once the first is deleted, got %v", definition)
+	}
+
+	updated, _ = client.Resource(metricDefinitionsResource).Namespace("marketplace").Get("duplicate", meta1.GetOptions{})
+	valid, _, _ := unstructured.NestedBool(updated.Object, "status", "valid")
+	validationError, _, _ := unstructured.NestedString(updated.Object, "status", "validationError")
+	if !valid || validationError != "" {
+		t.Errorf("Expected the duplicate's status to be valid, got %v", updated.Object["status"])
+	}
+}
+
+func TestGetExternalMetricFromDefinitionFallback(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction", "accountId": int64(7)},
+		"fallbackValue": int64(5),
+	})
+	np, _ := testProvider(TestRpmProvider{}, Options{}, obj)
+	np.definitionChanged(obj)
+
+	valueList, err := np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(5) {
+		t.Errorf("Expected fallback value of 5, got %d", val)
+	}
+
+	if valueList.Items[0].MetricLabels["aggregation"] != AggregationFallback {
+		t.Errorf("Fallback value is not labelled, got %v", valueList.Items[0].MetricLabels)
+	}
+}
+
+func TestInvalidDefinitionWritesStatus(t *testing.T) {
+	obj := testMetricDefinition("invalid", map[string]interface{}{"metricName": "rpm"})
+	np, client := testProvider(TestRpmProvider{}, Options{}, obj)
+	np.definitionChanged(obj)
+
+	if len(np.ListAllExternalMetrics()) != 1 {
+		t.Errorf("Invalid definition should not be listed")
+	}
+
+	updated, _ := client.Resource(metricDefinitionsResource).Namespace("marketplace").Get("invalid", meta1.GetOptions{})
+	validationError, _, _ := unstructured.NestedString(updated.Object, "status", "validationError")
+	if validationError == "" {
+		t.Errorf("Expected a validation error in the status")
+	}
+}
+
+func TestGetExternalMetricFromDefinitionRoutesByAccountSelector(t *testing.T) {
+	obj := testMetricDefinition("nrql", map[string]interface{}{
+		"metricName": "marketplace-transactions",
+		"query": map[string]interface{}{"nrql": "SELECT count(*) FROM Transaction"},
+	})
+	np, _ := testProvider(TestRpmProvider{}, Options{}, obj)
+	np.definitionChanged(obj)
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement(ACCOUNT_KEY, selection.Equals, []string{"42"})
+	selector = selector.Add(*requirement)
+
+	valueList, err := np.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if valueList.Items[0].MetricLabels[ACCOUNT_KEY] != "42" {
+		t.Errorf("Query was not routed to account 42, got labels %v", valueList.Items[0].MetricLabels)
+	}
+
+	_, err = np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if !apierrors.IsBadRequest(err) {
+		t.Errorf("Expected bad request without an account, got %v", err)
+	}
+}
+
+func TestCheckMetricDefinitionsWaitsForSync(t *testing.T) {
+	np := NewProvider(fake.NewSimpleDynamicClient(runtime.NewScheme()), TestRESTMapper{}, TestRpmProvider{}, Options{}).(*newrelicProvider)
+	if err := np.CheckMetricDefinitions(); err != nil {
+		t.Errorf("Expected a provider without watched definitions to be ready, got %s", err)
+	}
+
+	synced := false
+	np.definitions.synced = func() bool { return synced }
+	if err := np.CheckMetricDefinitions(); err == nil {
+		t.Errorf("Expected an error before the definitions were listed")
+	}
+
+	synced = true
+	if err := np.CheckMetricDefinitions(); err != nil {
+		t.Errorf("Expected the definitions to be ready once listed, got %s", err)
+	}
+}
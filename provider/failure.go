@@ -0,0 +1,204 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sync"
+	"time"
+)
+
+// FailurePolicyType decides what is served when New Relic cannot provide a value
+type FailurePolicyType string
+
+const (
+	// FailurePolicyError returns the error, the HPA then keeps its current scale
+	FailurePolicyError FailurePolicyType = "Error"
+	// FailurePolicyLastKnownGood returns the last value served for the same request while it is younger than MaxAge
+	FailurePolicyLastKnownGood FailurePolicyType = "LastKnownGood"
+	// FailurePolicyFallback returns a constant value
+	FailurePolicyFallback FailurePolicyType = "Fallback"
+)
+
+// FAILURE_POLICY_LABEL is the metric label naming the failure policy that produced a value
+const FAILURE_POLICY_LABEL = "failurePolicy"
+
+type FailurePolicy struct {
+	Type FailurePolicyType
+	// MaxAge is how long a last known good value may be served for
+	MaxAge time.Duration
+	// FallbackValue is served by the Fallback policy
+	FallbackValue int
+}
+
+// Validate checks that the policy has the settings its type needs
+func (p FailurePolicy) Validate() error {
+	switch p.Type {
+	case "", FailurePolicyError:
+	case FailurePolicyLastKnownGood:
+		if p.MaxAge <= 0 {
+			return errors.New("a LastKnownGood failure policy needs a positive maxAge")
+		}
+	case FailurePolicyFallback:
+	default:
+		return fmt.Errorf("failure policy must be %s, %s or %s", FailurePolicyError, FailurePolicyLastKnownGood, FailurePolicyFallback)
+	}
+
+	return nil
+}
+
+var failurePoliciesApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "newrelic_adapter_failure_policy_applied_total",
+	Help: "External metric requests answered by a failure policy instead of New Relic, by metric and policy.",
+}, []string{"metric", "policy"})
+
+func init() {
+	prometheus.MustRegister(failurePoliciesApplied)
+}
+
+type lastKnownGood struct {
+	results []newrelic.MetricResult
+	fetched time.Time
+	maxAge time.Duration
+}
+
+// lastKnownGoodStore keeps the last results served for each request that uses the LastKnownGood policy
+type lastKnownGoodStore struct {
+	lock sync.Mutex
+	values map[string]lastKnownGood
+}
+
+func newLastKnownGoodStore() *lastKnownGoodStore {
+	return &lastKnownGoodStore{
+		values: map[string]lastKnownGood{},
+	}
+}
+
+// set stores results and drops expired entries, so requests that stopped being made do not keep their values
+func (s *lastKnownGoodStore) set(key string, results []newrelic.MetricResult, maxAge time.Duration, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for existingKey, value := range s.values {
+		if now.Sub(value.fetched) > value.maxAge {
+			delete(s.values, existingKey)
+		}
+	}
+
+	s.values[key] = lastKnownGood{results: results, fetched: now, maxAge: maxAge}
+}
+
+func (s *lastKnownGoodStore) get(key string, now time.Time) ([]newrelic.MetricResult, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, ok := s.values[key]
+	if !ok || now.Sub(value.fetched) > value.maxAge {
+		return nil, false
+	}
+
+	return value.results, true
+}
+
+// parseFailurePolicy reads spec.failurePolicy, a bare spec.fallbackValue keeps meaning the Fallback policy
+func parseFailurePolicy(spec map[string]interface{}, fallbackValue *int) (*FailurePolicy, error) {
+	policyType, _, _ := unstructured.NestedString(spec, "failurePolicy", "type")
+	maxAge, _, _ := unstructured.NestedString(spec, "failurePolicy", "maxAge")
+
+	if policyType == "" && fallbackValue == nil {
+		if maxAge != "" {
+			return nil, errors.New("spec.failurePolicy.type is required")
+		}
+
+		return nil, nil
+	}
+
+	policy := &FailurePolicy{Type: FailurePolicyType(policyType)}
+	if policy.Type == "" {
+		policy.Type = FailurePolicyFallback
+	}
+
+	if maxAge != "" {
+		if policy.Type != FailurePolicyLastKnownGood {
+			return nil, errors.New("spec.failurePolicy.maxAge is only supported by the LastKnownGood policy")
+		}
+
+		var err error
+		policy.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("spec.failurePolicy.maxAge %q is not a duration", maxAge)
+		}
+	}
+
+	if policy.Type == FailurePolicyFallback {
+		if fallbackValue == nil {
+			return nil, errors.New("the Fallback failure policy needs spec.fallbackValue")
+		}
+
+		policy.FallbackValue = *fallbackValue
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, errors.New("spec." + err.Error())
+	}
+
+	return policy, nil
+}
+
+// applyFailurePolicy remembers successful results and replaces a failed fetch according to the policy. Requests the
+// namespace may not or cannot make are never hidden behind a policy. The returned string is the policy applied, if
+// any.
+func (np newrelicProvider) applyFailurePolicy(key string, metricName string, policy FailurePolicy, results []newrelic.MetricResult, err error) ([]newrelic.MetricResult, FailurePolicyType, error) {
+	now := time.Now()
+	if err == nil {
+		if policy.Type == FailurePolicyLastKnownGood {
+			np.lastKnownGood.set(key, results, policy.MaxAge, now)
+		}
+
+		return results, "", nil
+	}
+
+	if apierrors.IsForbidden(err) || apierrors.IsBadRequest(err) {
+		return results, "", err
+	}
+
+	switch policy.Type {
+	case FailurePolicyLastKnownGood:
+		lastResults, ok := np.lastKnownGood.get(key, now)
+		if !ok {
+			return results, "", err
+		}
+
+		glog.Warningf("Serving last known good value for %s: %v", key, err)
+		failurePoliciesApplied.WithLabelValues(metricName, string(policy.Type)).Inc()
+		return lastResults, policy.Type, nil
+	case FailurePolicyFallback:
+		glog.Warningf("Serving fallback value %d for %s: %v", policy.FallbackValue, key, err)
+		failurePoliciesApplied.WithLabelValues(metricName, string(policy.Type)).Inc()
+		return []newrelic.MetricResult{{
+			Aggregation: AggregationFallback,
+			Value: policy.FallbackValue,
+			Timestamp: now,
+		}}, policy.Type, nil
+	}
+
+	return results, "", err
+}
+
+// withFailurePolicyLabel labels values that a failure policy served so HPA events and dashboards can tell them apart
+func withFailurePolicyLabel(values *external_metrics.ExternalMetricValueList, policy FailurePolicyType) *external_metrics.ExternalMetricValueList {
+	if policy == "" {
+		return values
+	}
+
+	for i := range values.Items {
+		values.Items[i].MetricLabels[FAILURE_POLICY_LABEL] = string(policy)
+	}
+
+	return values
+}
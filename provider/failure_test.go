@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"testing"
+	"time"
+)
+
+// FailingRpmProvider answers until Fail is set
+type FailingRpmProvider struct {
+	TestRpmProvider
+	Fail *bool
+}
+
+func (p FailingRpmProvider) GetApplicationMetric(ctx context.Context, appName string) (newrelic.MetricResult, error) {
+	if *p.Fail {
+		return newrelic.MetricResult{}, errors.New("New Relic responded with status 503")
+	}
+
+	return p.TestRpmProvider.GetApplicationMetric(ctx, appName)
+}
+
+func TestGetExternalMetricServesLastKnownGood(t *testing.T) {
+	fail := false
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, FailingRpmProvider{Fail: &fail}, Options{
+		FailurePolicy: FailurePolicy{Type: FailurePolicyLastKnownGood, MaxAge: time.Minute},
+	})
+
+	_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	fail = true
+	valueList, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err != nil {
+		t.Fatalf("Expected the last known good value, got %s", err)
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(123) {
+		t.Errorf("Expected last known good value of 123, got %d", val)
+	}
+
+	if valueList.Items[0].MetricLabels[FAILURE_POLICY_LABEL] != string(FailurePolicyLastKnownGood) {
+		t.Errorf("Expected the value to be labelled, got %v", valueList.Items[0].MetricLabels)
+	}
+
+	_, err = np.GetExternalMetric("marketplace", appNameSelector("marketplace-staging"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err == nil {
+		t.Errorf("Expected an error for a request that never succeeded")
+	}
+}
+
+func TestLastKnownGoodExpires(t *testing.T) {
+	store := newLastKnownGoodStore()
+	now := time.Now()
+	store.set("marketplace/rpm", []newrelic.MetricResult{{Value: 5}}, time.Minute, now)
+
+	if _, ok := store.get("marketplace/rpm", now.Add(30 * time.Second)); !ok {
+		t.Errorf("Expected the value within its max age")
+	}
+
+	if _, ok := store.get("marketplace/rpm", now.Add(2 * time.Minute)); ok {
+		t.Errorf("Expected the value to expire")
+	}
+}
+
+func TestGetExternalMetricErrorPolicyReturnsError(t *testing.T) {
+	fail := true
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, FailingRpmProvider{Fail: &fail}, Options{
+		FailurePolicy: FailurePolicy{Type: FailurePolicyError},
+	})
+
+	_, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err == nil {
+		t.Errorf("Expected the error to be returned")
+	}
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	fallbackValue := 3
+	policy, err := parseFailurePolicy(map[string]interface{}{}, &fallbackValue)
+	if err != nil || policy.Type != FailurePolicyFallback || policy.FallbackValue != 3 {
+		t.Errorf("Expected fallbackValue alone to mean the Fallback policy, got %v (%v)", policy, err)
+	}
+
+	policy, err = parseFailurePolicy(map[string]interface{}{
+		"failurePolicy": map[string]interface{}{"type": "LastKnownGood", "maxAge": "15m"},
+	}, nil)
+	if err != nil || policy.Type != FailurePolicyLastKnownGood || policy.MaxAge != 15 * time.Minute {
+		t.Errorf("Expected a LastKnownGood policy, got %v (%v)", policy, err)
+	}
+
+	invalid := map[string]map[string]interface{}{
+		"unknown type": {"type": "Retry"},
+		"last known good without max age": {"type": "LastKnownGood"},
+		"fallback without value": {"type": "Fallback"},
+		"max age on error policy": {"type": "Error", "maxAge": "5m"},
+		"bad max age": {"type": "LastKnownGood", "maxAge": "soon"},
+	}
+
+	for description, spec := range invalid {
+		_, err := parseFailurePolicy(map[string]interface{}{"failurePolicy": spec}, nil)
+		if err == nil {
+			t.Errorf("Expected a validation error for %s", description)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	externalMetricRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "newrelic_adapter_external_metric_requests_total",
+		Help: "External metric requests served by the adapter.",
+	})
+	externalMetricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_external_metric_errors_total",
+		Help: "External metric requests that failed, by the reason returned to the API server.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(externalMetricRequests, externalMetricErrors)
+}
+
+// errorReason is the Kubernetes status reason of err, errors from New Relic itself have no status and are grouped
+func errorReason(err error) string {
+	reason := apierrors.ReasonForError(err)
+	if reason == "" {
+		return "NewRelicError"
+	}
+
+	return string(reason)
+}
+
+func recordExternalMetricRequest(err error) {
+	externalMetricRequests.Inc()
+	if err != nil {
+		externalMetricErrors.WithLabelValues(errorReason(err)).Inc()
+	}
+}
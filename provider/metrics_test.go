@@ -0,0 +1,22 @@
+package provider
+
+import (
+	"errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"testing"
+)
+
+func TestErrorReason(t *testing.T) {
+	reasons := map[string]error{
+		"BadRequest": apierrors.NewBadRequest("could not find appName selector"),
+		"ServiceUnavailable": apierrors.NewServiceUnavailable("stale"),
+		"TooManyRequests": apierrors.NewTooManyRequests("rate limited", 1),
+		"NewRelicError": errors.New("could not find matching app"),
+	}
+
+	for expected, err := range reasons {
+		if reason := errorReason(err); reason != expected {
+			t.Errorf("Expected %s, got %s", expected, reason)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package provider
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sync"
+	"time"
+)
+
+// objectCacheTTL is how long the namespaces, ConfigMaps and Secrets a request consults are reused, so an HPA polling
+// every 15 seconds does not cost API server round trips before New Relic is even reached. Changes to them take up
+// to this long to apply.
+var objectCacheTTL = 30 * time.Second
+
+type cachedObject struct {
+	obj *unstructured.Unstructured
+	err error
+	fetched time.Time
+}
+
+// objectCache keeps the objects read from the API server for objectCacheTTL. Objects that do not exist are cached
+// too, other errors are not so the next request tries again.
+type objectCache struct {
+	lock sync.Mutex
+	client dynamic.Interface
+	objects map[string]cachedObject
+}
+
+func newObjectCache(client dynamic.Interface) *objectCache {
+	return &objectCache{
+		client: client,
+		objects: map[string]cachedObject{},
+	}
+}
+
+// get returns the object, namespace is empty for cluster scoped resources
+func (c *objectCache) get(resource schema.GroupVersionResource, namespace string, name string) (*unstructured.Unstructured, error) {
+	key := resource.String() + "/" + namespace + "/" + name
+	now := time.Now()
+
+	c.lock.Lock()
+	cached, ok := c.objects[key]
+	c.lock.Unlock()
+
+	if ok && now.Sub(cached.fetched) <= objectCacheTTL {
+		return cached.obj, cached.err
+	}
+
+	var obj *unstructured.Unstructured
+	var err error
+	if namespace == "" {
+		obj, err = c.client.Resource(resource).Get(name, meta1.GetOptions{})
+	} else {
+		obj, err = c.client.Resource(resource).Namespace(namespace).Get(name, meta1.GetOptions{})
+	}
+
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// expired objects of namespaces no longer requested are dropped as others are added
+	for existingKey, existing := range c.objects {
+		if now.Sub(existing.fetched) > objectCacheTTL {
+			delete(c.objects, existingKey)
+		}
+	}
+
+	c.objects[key] = cachedObject{obj: obj, err: err, fetched: now}
+	return obj, err
+}
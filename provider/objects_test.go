@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// testObject builds an object as the dynamic client returns it, fields are set next to its metadata and namespace is
+// empty for cluster scoped kinds
+func testObject(apiVersion string, kind string, namespace string, name string, annotations map[string]interface{}, fields map[string]interface{}) *unstructured.Unstructured {
+	metadata := map[string]interface{}{
+		"name": name,
+	}
+
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+
+	obj := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind": kind,
+		"metadata": metadata,
+	}
+
+	for key, value := range fields {
+		obj[key] = value
+	}
+
+	return &unstructured.Unstructured{Object: obj}
+}
+
+// testProvider returns a provider reading objects through a fake dynamic client, which records the requests made
+func testProvider(api newrelic.RpmProvider, options Options, objects ...runtime.Object) (*newrelicProvider, *fake.FakeDynamicClient) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	return NewProvider(client, TestRESTMapper{}, api, options).(*newrelicProvider), client
+}
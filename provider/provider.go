@@ -1,71 +1,339 @@
 package provider
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
+	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/metrics/pkg/apis/external_metrics"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const APP_KEY = "appName"
 
-// testingProvider is a sample implementation of provider.MetricsProvider which stores a map of fake metrics
+// ACCOUNT_KEY is the selector label choosing the New Relic account NRQL metric definitions are sent to
+const ACCOUNT_KEY = "accountId"
+
+// Aggregation controls how values are returned when a selector matches several apps
+type Aggregation string
+
+const (
+	// AggregationNone returns one ExternalMetricValue per app
+	AggregationNone Aggregation = "none"
+	// AggregationSum returns a single ExternalMetricValue holding the sum across apps
+	AggregationSum Aggregation = "sum"
+)
+
+// Options holds the provider settings that are configured at startup
+type Options struct {
+	// Aggregation controls whether multiple apps are returned individually or summed
+	Aggregation Aggregation
+	// ResolveAppName enables looking up the app name from namespace/deployment annotations when appName is missing
+	ResolveAppName bool
+	// MaxDataAge rejects New Relic data older than this, zero disables the check
+	MaxDataAge time.Duration
+	// EnforceAccessPolicy restricts the apps and metrics each namespace may query
+	EnforceAccessPolicy bool
+	// AccessPolicyConfigMap is the namespace/name of a ConfigMap holding per-namespace access policies
+	AccessPolicyConfigMap string
+	// CredentialsSecretName is a Secret looked up in the request namespace for a New Relic API key and account ID
+	CredentialsSecretName string
+	// NewApi creates the api for a namespace's API key, per-namespace credentials are disabled when nil
+	NewApi func(apiKey string) newrelic.RpmProvider
+	// DefaultAccountID is the account NRQL queries are sent to when nothing else names one
+	DefaultAccountID int
+	// FailurePolicy decides what external metrics serve when New Relic fails, metric definitions can override it
+	FailurePolicy FailurePolicy
+	// Smoothing smooths the values of external metrics, metric definitions can override it
+	Smoothing Smoothing
+	// StaticDefinitions are served alongside NewRelicMetric objects, they should be checked with
+	// ValidateStaticDefinitions first since invalid ones are only logged here
+	StaticDefinitions []StaticDefinition
+}
+
+// newrelicProvider serves the custom and external metrics read from New Relic
 type newrelicProvider struct {
 	api newrelic.RpmProvider
 	client dynamic.Interface
 	mapper apimeta.RESTMapper
-
-	valuesLock sync.RWMutex
+	options Options
+	definitions *definitionStore
+	credentials *credentialStore
+	lastKnownGood *lastKnownGoodStore
+	smoothing *smoothingStore
+	objects *objectCache
 }
 
-func (np newrelicProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
-
-	appName := ""
+// appNamesFromSelector returns the app names requested through the appName label, only equality and set
+// inclusion are supported since the adapter has no way of listing "every app but these"
+func appNamesFromSelector(metricSelector labels.Selector) ([]string, error) {
+	appNames := []string{}
 	reqs, _ := metricSelector.Requirements()
 	for _, req := range reqs {
-		if req.Key() == APP_KEY {
-			appName = req.Values().List()[0]
+		if req.Key() != APP_KEY {
+			continue
+		}
+
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			appNames = append(appNames, req.Values().List()...)
+		default:
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("unsupported operator %q for %s selector, use = or in", req.Operator(), APP_KEY))
 		}
 	}
 
-	if appName == "" {
-		return &external_metrics.ExternalMetricValueList{}, errors.New("could not find appName selector")
+	return appNames, nil
+}
+
+// metricLabels describes where a value came from so kubectl and HPA status output is self-explanatory
+func metricLabels(result newrelic.MetricResult) map[string]string {
+	metricLabels := map[string]string{
+		APP_KEY: result.AppName,
+		"metricName": result.MetricName,
+		"valueKey": result.ValueKey,
+		"aggregation": result.Aggregation,
+	}
+
+	if result.AppID != 0 {
+		metricLabels["appId"] = strconv.Itoa(result.AppID)
+	}
+
+	if result.AccountID != 0 {
+		metricLabels[ACCOUNT_KEY] = strconv.Itoa(result.AccountID)
+	}
+
+	if result.Aggregation == newrelic.AggregationHostAverage {
+		metricLabels["hostCount"] = strconv.Itoa(result.HostCount)
+		metricLabels["consideredHostCount"] = strconv.Itoa(result.ConsideredHostCount)
+	}
+
+	return metricLabels
+}
+
+// sumResults combines the results of several apps into one, the app names are comma separated
+func sumResults(results []newrelic.MetricResult) newrelic.MetricResult {
+	appNames := []string{}
+	summed := newrelic.MetricResult{}
+	for i, result := range results {
+		appNames = append(appNames, result.AppName)
+		if i == 0 || result.Timestamp.Before(summed.Timestamp) {
+			summed.Timestamp = result.Timestamp
+		}
+
+		summed.MetricName = result.MetricName
+		summed.ValueKey = result.ValueKey
+		summed.Value += result.Value
+		summed.HostCount += result.HostCount
+		summed.ConsideredHostCount += result.ConsideredHostCount
 	}
 
-	rpm, err := np.api.GetApplicationRpm(appName)
+	summed.AppName = strings.Join(appNames, ",")
+	summed.Aggregation = string(AggregationSum)
+	return summed
+}
+
+func externalMetricsGroupResource(metricName string) schema.GroupResource {
+	return schema.GroupResource{Group: "external.metrics.k8s.io", Resource: metricName}
+}
+
+// externalAppNames returns the apps requested by the metric selector, resolving one from annotations when enabled
+func (np newrelicProvider) externalAppNames(ctx context.Context, namespace string, metricSelector labels.Selector) (appNames []string, err error) {
+	_, span := tracing.Start(ctx, "provider.resolveAppNames", tracing.Bool("provider.resolve_from_annotations", np.options.ResolveAppName))
+	defer func() {
+		span.SetAttributes(tracing.StringSlice("provider.apps", appNames))
+		tracing.End(span, err)
+	}()
+
+	appNames, err = appNamesFromSelector(metricSelector)
 	if err != nil {
-		return &external_metrics.ExternalMetricValueList{}, err
+		return nil, err
+	}
+
+	if len(appNames) == 0 && np.options.ResolveAppName {
+		appName, err := np.resolveAppName(namespace, selectorValue(metricSelector, DEPLOYMENT_KEY))
+		if err != nil {
+			return nil, err
+		}
+
+		appNames = []string{appName}
+	}
+
+	if len(appNames) == 0 {
+		return nil, apierrors.NewBadRequest("could not find appName selector")
+	}
+
+	return appNames, nil
+}
+
+// fetchResults reads every app through fetch, rejecting stale data and summing the results when configured to
+func (np newrelicProvider) fetchResults(ctx context.Context, appNames []string, fetch func(ctx context.Context, appName string) (newrelic.MetricResult, error)) ([]newrelic.MetricResult, error) {
+	results := []newrelic.MetricResult{}
+	for _, appName := range appNames {
+		result, err := fetch(ctx, appName)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.IsStale(np.options.MaxDataAge, time.Now()) {
+			return nil, apierrors.NewServiceUnavailable(
+				fmt.Sprintf("New Relic data for %s is older than %s (last timeslice %s)", appName, np.options.MaxDataAge, result.Timestamp))
+		}
+
+		results = append(results, result)
+	}
+
+	return np.aggregate(ctx, results), nil
+}
+
+// aggregate sums the results when configured to
+func (np newrelicProvider) aggregate(ctx context.Context, results []newrelic.MetricResult) []newrelic.MetricResult {
+	_, span := tracing.Start(ctx, "provider.aggregate",
+		tracing.String("provider.aggregation", string(np.options.Aggregation)),
+		tracing.Int("provider.results", len(results)),
+	)
+	defer tracing.End(span, nil)
+
+	if np.options.Aggregation == AggregationSum {
+		results = []newrelic.MetricResult{sumResults(results)}
+		span.SetAttributes(tracing.Int("provider.value", results[0].Value))
+	}
+
+	return results
+}
+
+func externalMetricValues(metricName string, results []newrelic.MetricResult) *external_metrics.ExternalMetricValueList {
+	values := []external_metrics.ExternalMetricValue{}
+	for _, result := range results {
+		timestamp := result.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricLabels: metricLabels(result),
+			Timestamp: meta1.Time{timestamp},
+			MetricName: metricName,
+			Value: *resource.NewQuantity(int64(result.Value), resource.DecimalSI),
+		})
 	}
 
 	return &external_metrics.ExternalMetricValueList{
-		Items: []external_metrics.ExternalMetricValue{{
-			MetricLabels: map[string]string{"app": namespace},
-			Timestamp: meta1.Time{time.Now()},
-			MetricName: "rpm",
-			Value: *resource.NewQuantity(int64(rpm), resource.DecimalSI),
-		}},
-	}, nil
+		Items: values,
+	}
+}
+
+func (np newrelicProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	// the API server does not pass a context down, each request starts its own trace
+	ctx, span := tracing.Start(context.Background(), "provider.GetExternalMetric",
+		tracing.String("provider.namespace", namespace),
+		tracing.String("provider.metric", info.Metric),
+		tracing.String("provider.selector", metricSelector.String()),
+	)
+
+	values, err := np.getExternalMetric(ctx, namespace, metricSelector, info)
+	if err == newrelic.ErrRateLimited {
+		// the HPA controller retries on its next sync, a 429 tells it the adapter is busy rather than broken
+		err = apierrors.NewTooManyRequests(err.Error(), 1)
+	}
+
+	tracing.End(span, err)
+	recordExternalMetricRequest(err)
+	return values, err
+}
+
+func (np newrelicProvider) getExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	if definition, ok := np.definitions.get(namespace, info.Metric); ok {
+		return np.getDefinedMetric(ctx, namespace, metricSelector, definition)
+	}
+
+	appNames, err := np.externalAppNames(ctx, namespace, metricSelector)
+	if err != nil {
+		return &external_metrics.ExternalMetricValueList{}, err
+	}
+
+	err = np.authorize(namespace, externalMetricsGroupResource("rpm"), "rpm", appNames)
+	if err != nil {
+		return &external_metrics.ExternalMetricValueList{}, err
+	}
+
+	creds, err := np.credentialsFor(namespace, "")
+	if err != nil {
+		return &external_metrics.ExternalMetricValueList{}, err
+	}
+
+	key := namespace + "/rpm?" + metricSelector.String()
+	results, err := np.fetchResults(ctx, appNames, creds.api.GetApplicationMetric)
+	results, rawValues := np.smooth(key, np.options.Smoothing, results, err)
+	results, appliedPolicy, err := np.applyFailurePolicy(key, "rpm", np.options.FailurePolicy, results, err)
+	if err != nil {
+		return &external_metrics.ExternalMetricValueList{}, err
+	}
+
+	values := withFailurePolicyLabel(externalMetricValues("rpm", results), appliedPolicy)
+	return withSmoothingLabels(values, np.options.Smoothing, rawValues), nil
 }
 
 func (np newrelicProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
-	return []provider.ExternalMetricInfo{{
+	metrics := []provider.ExternalMetricInfo{{
 		Metric: "rpm",
 	}}
+
+	for _, metricName := range np.definitions.metricNames() {
+		metrics = append(metrics, provider.ExternalMetricInfo{
+			Metric: metricName,
+		})
+	}
+
+	return metrics
 }
 
+// MetricsProvider serves both the custom and external metrics APIs
+type MetricsProvider interface {
+	provider.CustomMetricsProvider
+	provider.ExternalMetricsProvider
+
+	// WatchMetricDefinitions keeps the external metrics in sync with NewRelicMetric objects until stopCh is closed
+	WatchMetricDefinitions(stopCh <-chan struct{})
+	// CheckMetricDefinitions fails while the watched NewRelicMetric objects are still being loaded
+	CheckMetricDefinitions() error
+}
+
+// SharedExternalMetricsProvider is implemented by providers serving external values read by another replica, such as
+// the HA provider. GetSharedExternalMetric reports whether the values were served from what another replica read
+// rather than read from New Relic for the request.
+type SharedExternalMetricsProvider interface {
+	GetSharedExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, bool, error)
+}
+
+// NewProvider returns a provider reading the metrics from nrApi, serving NewRelicMetric objects once
+// WatchMetricDefinitions is running
+func NewProvider(client dynamic.Interface, mapper apimeta.RESTMapper, nrApi newrelic.RpmProvider, options Options) MetricsProvider {
+	definitions := newDefinitionStore()
+	if err := definitions.loadStatic(options.StaticDefinitions); err != nil {
+		glog.Errorf("Not all static metric definitions were loaded: %v", err)
+	}
 
-// NewFakeProvider returns an instance of testingProvider, along with its restful.WebService that opens endpoints to post new fake metrics
-func NewProvider(client dynamic.Interface, mapper apimeta.RESTMapper, nrApi newrelic.RpmProvider) provider.ExternalMetricsProvider {
 	return &newrelicProvider{
 		api: nrApi,
 		client: client,
 		mapper: mapper,
+		options: options,
+		definitions: definitions,
+		credentials: newCredentialStore(),
+		lastKnownGood: newLastKnownGoodStore(),
+		smoothing: newSmoothingStore(),
+		objects: newObjectCache(client),
 	}
 }
@@ -1,35 +1,64 @@
 package provider
 
 import (
+	"context"
 	"errors"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/flexshopper/newrelic-custom-metrics/tracing"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/dynamic"
 	"testing"
+	"time"
 )
 
+var testTimestamp = time.Now().Add(-5 * time.Minute)
+
 type TestRpmProvider struct {}
 
-func (TestRpmProvider) GetApplicationRpm(appName string) (int, error) {
+func (TestRpmProvider) GetApplicationMetric(ctx context.Context, appName string) (newrelic.MetricResult, error) {
 	if appName == "not-found" {
-		return 0, errors.New("random error")
+		return newrelic.MetricResult{}, errors.New("random error")
+	}
+
+	if appName == "rate-limited" {
+		return newrelic.MetricResult{}, newrelic.ErrRateLimited
 	}
 
-	return 123, nil
+	return newrelic.MetricResult{
+		AppName: appName,
+		AppID: 1234,
+		MetricName: "HttpDispatcher",
+		ValueKey: "requests_per_minute",
+		Aggregation: newrelic.AggregationSummary,
+		Value: 123,
+		Timestamp: testTimestamp,
+	}, nil
 }
 
-func (TestRpmProvider) GetRPMAverageAcrossHosts(appName string) (int, error) {
-	if appName == "not-found" {
-		return 0, errors.New("random error")
-	}
 
-	return 123, nil
+func (TestRpmProvider) GetPerHostMetrics(ctx context.Context, appName string) ([]newrelic.MetricResult, error) {
+	return []newrelic.MetricResult{}, nil
 }
 
+func (p TestRpmProvider) GetMetric(ctx context.Context, appName string, query newrelic.MetricQuery) (newrelic.MetricResult, error) {
+	result, err := p.GetApplicationMetric(ctx, appName)
+	result.MetricName = query.MetricName
+	result.ValueKey = query.ValueKey
+	return result, err
+}
 
+func (TestRpmProvider) GetNrqlMetric(ctx context.Context, accountId int, nrql string) (newrelic.MetricResult, error) {
+	if accountId != 42 {
+		return newrelic.MetricResult{}, errors.New("unknown account")
+	}
+
+	return newrelic.MetricResult{AccountID: accountId, ValueKey: "count", Aggregation: newrelic.AggregationNrql, Value: 77, Timestamp: testTimestamp}, nil
+}
 
 type TestRESTMapper struct {}
 
@@ -68,7 +97,7 @@ func (TestDynamic) Resource(resource schema.GroupVersionResource) dynamic.Namesp
 }
 
 func TestGetExternalMetric (t *testing.T) {
-	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{})
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
 
 	selector := labels.NewSelector()
 	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{"fmcore"})
@@ -84,10 +113,18 @@ func TestGetExternalMetric (t *testing.T) {
 	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(123) {
 		t.Errorf("Returned value does not match expected value")
 	}
+
+	if valueList.Items[0].MetricLabels["appName"] != "fmcore" || valueList.Items[0].MetricLabels["appId"] != "1234" {
+		t.Errorf("Returned value is not labelled with the New Relic app, got %v", valueList.Items[0].MetricLabels)
+	}
+
+	if valueList.Items[0].MetricLabels["valueKey"] != "requests_per_minute" {
+		t.Errorf("Returned value is not labelled with the value key, got %v", valueList.Items[0].MetricLabels)
+	}
 }
 
 func TestGetExternalMetricWithApiError (t *testing.T) {
-	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{})
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
 
 	selector := labels.NewSelector()
 	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{"not-found"})
@@ -101,8 +138,23 @@ func TestGetExternalMetricWithApiError (t *testing.T) {
 	}
 }
 
+func TestGetExternalMetricRateLimited (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{"rate-limited"})
+
+	selector = selector.Add(*requirement)
+
+	_, err := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+	if !apierrors.IsTooManyRequests(err) {
+		t.Errorf("Expected rate limited requests to be a 429, got %v", err)
+	}
+}
+
 func TestGetExternalMetricAppNameSelectorNotFound (t *testing.T) {
-	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{})
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
 
 	selector := labels.NewSelector()
 	requirement, _ := labels.NewRequirement("notName", selection.Equals, []string{"not-found"})
@@ -116,8 +168,141 @@ func TestGetExternalMetricAppNameSelectorNotFound (t *testing.T) {
 	}
 }
 
+func TestGetExternalMetricMultipleAppsPerApp (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.In, []string{"fmcore-east", "fmcore-west"})
+
+	selector = selector.Add(*requirement)
+
+	valueList, err := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+	if err != nil {
+		t.Errorf("There was an error: %s", err)
+	}
+
+	if len(valueList.Items) != 2 {
+		t.Fatalf("Expected 2 values, got %d", len(valueList.Items))
+	}
+
+	if valueList.Items[1].MetricLabels["appName"] != "fmcore-west" {
+		t.Errorf("Returned value is not labelled with its app")
+	}
+}
+
+func TestGetExternalMetricMultipleAppsSummed (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{Aggregation: AggregationSum})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.In, []string{"fmcore-east", "fmcore-west"})
+
+	selector = selector.Add(*requirement)
+
+	valueList, err := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+	if err != nil {
+		t.Errorf("There was an error: %s", err)
+	}
+
+	if len(valueList.Items) != 1 {
+		t.Fatalf("Expected 1 value, got %d", len(valueList.Items))
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(246) {
+		t.Errorf("Expected summed value of 246, got %d", val)
+	}
+
+	if valueList.Items[0].MetricLabels["appName"] != "fmcore-east,fmcore-west" {
+		t.Errorf("Summed value is not labelled with all apps, got %v", valueList.Items[0].MetricLabels)
+	}
+}
+
+func TestGetExternalMetricUnsupportedOperator (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
+
+	for _, op := range []selection.Operator{selection.NotIn, selection.Exists} {
+		values := []string{"fmcore"}
+		if op == selection.Exists {
+			values = []string{}
+		}
+
+		selector := labels.NewSelector()
+		requirement, _ := labels.NewRequirement("appName", op, values)
+
+		selector = selector.Add(*requirement)
+
+		_, err := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+		if !apierrors.IsBadRequest(err) {
+			t.Errorf("Expected bad request for operator %s, got %v", op, err)
+		}
+	}
+}
+
+func TestGetExternalMetricUsesNewRelicTimestamp (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{"fmcore"})
+
+	selector = selector.Add(*requirement)
+
+	valueList, _ := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+	if !valueList.Items[0].Timestamp.Time.Equal(testTimestamp) {
+		t.Errorf("Expected timestamp %s, got %s", testTimestamp, valueList.Items[0].Timestamp)
+	}
+}
+
+func TestGetExternalMetricRejectsStaleData (t *testing.T) {
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{MaxDataAge: time.Minute})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.Equals, []string{"fmcore"})
+
+	selector = selector.Add(*requirement)
+
+	_, err := np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{})
+
+	if !apierrors.IsServiceUnavailable(err) {
+		t.Errorf("Expected stale data to be rejected, got %v", err)
+	}
+}
+
+func TestGetExternalMetricTraced (t *testing.T) {
+	recorder := tracing.Record()
+
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{Aggregation: AggregationSum})
+
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement("appName", selection.In, []string{"fmcore-east", "not-found"})
+
+	selector = selector.Add(*requirement)
+
+	np.GetExternalMetric("fmcore", selector, provider.ExternalMetricInfo{Metric: "rpm"})
+
+	spans := map[string]*tracing.Span{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	root, ok := spans["provider.GetExternalMetric"]
+	if !ok || root.Err() == nil {
+		t.Fatalf("Expected a failed span for the request, got %v", spans)
+	}
+
+	if resolve, ok := spans["provider.resolveAppNames"]; !ok || resolve.ParentSpanID() != root.SpanID() {
+		t.Errorf("Expected the app names to be resolved under the request's span")
+	}
+
+	if _, ok := spans["provider.aggregate"]; ok {
+		t.Errorf("Expected nothing to be aggregated once an app failed")
+	}
+}
+
 func TestListAllExternalMetrics (t *testing.T) {
-	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{})
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, TestRpmProvider{}, Options{})
 	metricList := np.ListAllExternalMetrics()
 
 	if len(metricList) == 0 {
@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	// APP_NAME_ANNOTATION is read from deployments and namespaces when no appName selector is given
+	APP_NAME_ANNOTATION = "newrelic.com/app-name"
+	// APP_NAME_ENV is the New Relic agent env var looked up in a deployment's pod template
+	APP_NAME_ENV = "NEW_RELIC_APP_NAME"
+	// DEPLOYMENT_KEY is the selector label naming the deployment to resolve the app name from
+	DEPLOYMENT_KEY = "deployment"
+)
+
+var (
+	namespacesResource = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	deploymentsResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+// selectorValue returns the single value of an equality requirement on key, or an empty string
+func selectorValue(metricSelector labels.Selector, key string) string {
+	reqs, _ := metricSelector.Requirements()
+	for _, req := range reqs {
+		if req.Key() != key {
+			continue
+		}
+
+		if req.Operator() == selection.Equals || req.Operator() == selection.DoubleEquals {
+			return req.Values().List()[0]
+		}
+	}
+
+	return ""
+}
+
+// appNameFromPodTemplate returns the first literal NEW_RELIC_APP_NAME env value found in the deployment's containers
+func appNameFromPodTemplate(deployment *unstructured.Unstructured) string {
+	containers, _, _ := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+	for _, container := range containers {
+		containerMap, ok := container.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		env, _, _ := unstructured.NestedSlice(containerMap, "env")
+		for _, envVar := range env {
+			envMap, ok := envVar.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if envMap["name"] == APP_NAME_ENV {
+				if value, ok := envMap["value"].(string); ok && value != "" {
+					return value
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// resolveAppName finds the New Relic app name for a request without an appName selector. The deployment, when one is
+// given, is checked first (annotation, then pod template env) followed by the namespace annotation.
+func (np newrelicProvider) resolveAppName(namespace string, deploymentName string) (string, error) {
+	if deploymentName != "" {
+		deployment, err := np.client.Resource(deploymentsResource).Namespace(namespace).Get(deploymentName, meta1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		if appName := deployment.GetAnnotations()[APP_NAME_ANNOTATION]; appName != "" {
+			return appName, nil
+		}
+
+		if appName := appNameFromPodTemplate(deployment); appName != "" {
+			return appName, nil
+		}
+	}
+
+	ns, err := np.client.Resource(namespacesResource).Get(namespace, meta1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if appName := ns.GetAnnotations()[APP_NAME_ANNOTATION]; appName != "" {
+		return appName, nil
+	}
+
+	return "", apierrors.NewBadRequest(fmt.Sprintf("could not find appName selector or %s annotation in namespace %s", APP_NAME_ANNOTATION, namespace))
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"testing"
+)
+
+type RecordingRpmProvider struct {
+	Requested []string
+}
+
+func (r *RecordingRpmProvider) GetApplicationMetric(ctx context.Context, appName string) (newrelic.MetricResult, error) {
+	r.Requested = append(r.Requested, appName)
+	return newrelic.MetricResult{AppName: appName, Value: 123}, nil
+}
+
+func (r *RecordingRpmProvider) GetPerHostMetrics(ctx context.Context, appName string) ([]newrelic.MetricResult, error) {
+	return []newrelic.MetricResult{}, nil
+}
+
+func (r *RecordingRpmProvider) GetMetric(ctx context.Context, appName string, query newrelic.MetricQuery) (newrelic.MetricResult, error) {
+	return r.GetApplicationMetric(ctx, appName)
+}
+
+func (r *RecordingRpmProvider) GetNrqlMetric(ctx context.Context, accountId int, nrql string) (newrelic.MetricResult, error) {
+	return newrelic.MetricResult{}, nil
+}
+
+func testNamespace(name string, annotations map[string]interface{}) *unstructured.Unstructured {
+	return testObject("v1", "Namespace", "", name, annotations, nil)
+}
+
+func testDeployment(namespace string, name string, annotations map[string]interface{}, env []interface{}) *unstructured.Unstructured {
+	return testObject("apps/v1", "Deployment", namespace, name, annotations, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name": "app",
+							"env": env,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func resolvedAppName(t *testing.T, selector labels.Selector, objects ...runtime.Object) (string, error) {
+	api := &RecordingRpmProvider{}
+	np, _ := testProvider(api, Options{ResolveAppName: true}, objects...)
+
+	_, err := np.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{})
+	if err != nil {
+		return "", err
+	}
+
+	if len(api.Requested) != 1 {
+		t.Fatalf("Expected a single app to be requested, got %v", api.Requested)
+	}
+
+	return api.Requested[0], nil
+}
+
+func TestResolveAppNameFromNamespaceAnnotation(t *testing.T) {
+	appName, err := resolvedAppName(t, labels.NewSelector(), testNamespace("marketplace", map[string]interface{}{
+		APP_NAME_ANNOTATION: "marketplace-prod",
+	}))
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if appName != "marketplace-prod" {
+		t.Errorf("Expected marketplace-prod, got %s", appName)
+	}
+}
+
+func TestResolveAppNameFromDeploymentAnnotation(t *testing.T) {
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement(DEPLOYMENT_KEY, selection.Equals, []string{"marketplace-cmd"})
+	selector = selector.Add(*requirement)
+
+	appName, err := resolvedAppName(t, selector,
+		testNamespace("marketplace", map[string]interface{}{APP_NAME_ANNOTATION: "marketplace-prod"}),
+		testDeployment("marketplace", "marketplace-cmd", map[string]interface{}{APP_NAME_ANNOTATION: "marketplace-cmd-prod"}, nil),
+	)
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if appName != "marketplace-cmd-prod" {
+		t.Errorf("Expected marketplace-cmd-prod, got %s", appName)
+	}
+}
+
+func TestResolveAppNameFromPodTemplateEnv(t *testing.T) {
+	selector := labels.NewSelector()
+	requirement, _ := labels.NewRequirement(DEPLOYMENT_KEY, selection.Equals, []string{"marketplace-cmd"})
+	selector = selector.Add(*requirement)
+
+	appName, err := resolvedAppName(t, selector,
+		testNamespace("marketplace", nil),
+		testDeployment("marketplace", "marketplace-cmd", nil, []interface{}{
+			map[string]interface{}{"name": APP_NAME_ENV, "value": "marketplace-env"},
+		}),
+	)
+
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if appName != "marketplace-env" {
+		t.Errorf("Expected marketplace-env, got %s", appName)
+	}
+}
+
+func TestResolveAppNameNotFound(t *testing.T) {
+	_, err := resolvedAppName(t, labels.NewSelector(), testNamespace("marketplace", nil))
+
+	if !apierrors.IsBadRequest(err) {
+		t.Errorf("Expected bad request when app name cannot be resolved, got %v", err)
+	}
+}
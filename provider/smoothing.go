@@ -0,0 +1,261 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SmoothingType decides how the values read from New Relic are combined before they are served
+type SmoothingType string
+
+const (
+	// SmoothingEWMA serves an exponentially weighted moving average, each new value weighing Alpha
+	SmoothingEWMA SmoothingType = "EWMA"
+	// SmoothingAverage serves the average of the last Samples values
+	SmoothingAverage SmoothingType = "Average"
+	// SmoothingMax serves the highest value read within Window
+	SmoothingMax SmoothingType = "Max"
+)
+
+const (
+	// SMOOTHING_LABEL is the metric label naming the smoothing applied to a value
+	SMOOTHING_LABEL = "smoothing"
+	// RAW_VALUE_LABEL is the metric label holding the value read from New Relic before smoothing
+	RAW_VALUE_LABEL = "rawValue"
+)
+
+// smoothingStateExpiry is how long the state of a request that is no longer made is kept
+var smoothingStateExpiry = 30 * time.Minute
+
+// smoothingResolution is the timeslice values without a timestamp are counted in, New Relic's default resolution
+var smoothingResolution = time.Minute
+
+type Smoothing struct {
+	Type SmoothingType
+	// Alpha is the weight of each new value for EWMA, between 0 and 1, higher follows New Relic more closely
+	Alpha float64
+	// Samples is how many values Average averages
+	Samples int
+	// Window is how far back Max looks
+	Window time.Duration
+}
+
+// Validate checks that the smoothing has the settings its type needs
+func (s Smoothing) Validate() error {
+	switch s.Type {
+	case "":
+	case SmoothingEWMA:
+		if s.Alpha <= 0 || s.Alpha > 1 {
+			return errors.New("EWMA smoothing needs an alpha above 0 and up to 1")
+		}
+	case SmoothingAverage:
+		if s.Samples < 1 {
+			return errors.New("Average smoothing needs at least 1 sample")
+		}
+	case SmoothingMax:
+		if s.Window <= 0 {
+			return errors.New("Max smoothing needs a positive window")
+		}
+	default:
+		return fmt.Errorf("smoothing must be %s, %s or %s", SmoothingEWMA, SmoothingAverage, SmoothingMax)
+	}
+
+	return nil
+}
+
+type smoothingSample struct {
+	value float64
+	at time.Time
+}
+
+type smoothingState struct {
+	samples []smoothingSample
+	ewma float64
+	// timestamp is the New Relic timeslice of the last value added, the same timeslice is only counted once
+	timestamp time.Time
+	updated time.Time
+}
+
+// add records value read at at and returns the smoothed value
+func (state *smoothingState) add(smoothing Smoothing, value float64, at time.Time) float64 {
+	if len(state.samples) == 0 {
+		state.ewma = value
+	} else {
+		state.ewma = smoothing.Alpha*value + (1-smoothing.Alpha)*state.ewma
+	}
+
+	state.samples = append(state.samples, smoothingSample{value: value, at: at})
+	switch smoothing.Type {
+	case SmoothingAverage:
+		if len(state.samples) > smoothing.Samples {
+			state.samples = state.samples[len(state.samples)-smoothing.Samples:]
+		}
+	case SmoothingMax:
+		first := 0
+		for first < len(state.samples)-1 && at.Sub(state.samples[first].at) > smoothing.Window {
+			first++
+		}
+
+		state.samples = state.samples[first:]
+	default:
+		state.samples = state.samples[len(state.samples)-1:]
+	}
+
+	return state.value(smoothing)
+}
+
+func (state *smoothingState) value(smoothing Smoothing) float64 {
+	switch smoothing.Type {
+	case SmoothingAverage:
+		sum := 0.0
+		for _, sample := range state.samples {
+			sum += sample.value
+		}
+
+		return sum / float64(len(state.samples))
+	case SmoothingMax:
+		max := state.samples[0].value
+		for _, sample := range state.samples[1:] {
+			max = math.Max(max, sample.value)
+		}
+
+		return max
+	}
+
+	return state.ewma
+}
+
+// smoothingStore keeps the values read for each request and app that uses smoothing. It lives in the provider's
+// memory, so each replica smooths the values it reads on its own: with HA it is the leader's, updated every time the
+// values are refreshed in the background, and a new leader starts over.
+type smoothingStore struct {
+	lock sync.Mutex
+	states map[string]*smoothingState
+}
+
+func newSmoothingStore() *smoothingStore {
+	return &smoothingStore{
+		states: map[string]*smoothingState{},
+	}
+}
+
+// add records a value read from New Relic and returns the smoothed value. Values of a timeslice that was already
+// added, as returned when the HPA asks more often than New Relic aggregates, do not count twice. Values without a
+// timestamp are counted once per smoothingResolution rather than once per request.
+func (s *smoothingStore) add(key string, smoothing Smoothing, result newrelic.MetricResult, now time.Time) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for existingKey, state := range s.states {
+		if now.Sub(state.updated) > smoothingStateExpiry {
+			delete(s.states, existingKey)
+		}
+	}
+
+	state, ok := s.states[key]
+	if !ok {
+		state = &smoothingState{}
+		s.states[key] = state
+	}
+
+	state.updated = now
+	timestamp := result.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now.Truncate(smoothingResolution)
+	}
+
+	if timestamp.Equal(state.timestamp) {
+		return state.value(smoothing)
+	}
+
+	state.timestamp = timestamp
+	return state.add(smoothing, float64(result.Value), timestamp)
+}
+
+// parseSmoothing reads spec.smoothing
+func parseSmoothing(spec map[string]interface{}) (*Smoothing, error) {
+	smoothingSpec, found, _ := unstructured.NestedMap(spec, "smoothing")
+	if !found {
+		return nil, nil
+	}
+
+	smoothingType, _, _ := unstructured.NestedString(smoothingSpec, "type")
+	if smoothingType == "" {
+		return nil, errors.New("spec.smoothing.type is required")
+	}
+
+	smoothing := &Smoothing{Type: SmoothingType(smoothingType)}
+
+	alpha, found, _ := unstructured.NestedFieldNoCopy(smoothingSpec, "alpha")
+	if found {
+		switch value := alpha.(type) {
+		case int64:
+			smoothing.Alpha = float64(value)
+		case float64:
+			smoothing.Alpha = value
+		default:
+			return nil, errors.New("spec.smoothing.alpha must be a number")
+		}
+	}
+
+	samples, _, err := unstructured.NestedInt64(smoothingSpec, "samples")
+	if err != nil {
+		return nil, errors.New("spec.smoothing.samples must be an integer")
+	}
+
+	smoothing.Samples = int(samples)
+
+	window, _, _ := unstructured.NestedString(smoothingSpec, "window")
+	if window != "" {
+		smoothing.Window, err = time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("spec.smoothing.window %q is not a duration", window)
+		}
+	}
+
+	if err := smoothing.Validate(); err != nil {
+		return nil, fmt.Errorf("spec.smoothing: %v", err)
+	}
+
+	return smoothing, nil
+}
+
+// smooth replaces the values read from New Relic by their smoothed values and returns the values read. Nothing is
+// smoothed when the read failed, whatever the failure policy serves is served as it is.
+func (np newrelicProvider) smooth(key string, smoothing Smoothing, results []newrelic.MetricResult, err error) ([]newrelic.MetricResult, []int) {
+	if err != nil || smoothing.Type == "" {
+		return results, nil
+	}
+
+	now := time.Now()
+	smoothed := make([]newrelic.MetricResult, len(results))
+	rawValues := make([]int, len(results))
+	for i, result := range results {
+		rawValues[i] = result.Value
+		smoothed[i] = result
+		smoothed[i].Value = int(math.Round(np.smoothing.add(key + "|" + result.AppName, smoothing, result, now)))
+	}
+
+	return smoothed, rawValues
+}
+
+// withSmoothingLabels labels smoothed values with the smoothing and the value read from New Relic
+func withSmoothingLabels(values *external_metrics.ExternalMetricValueList, smoothing Smoothing, rawValues []int) *external_metrics.ExternalMetricValueList {
+	if rawValues == nil {
+		return values
+	}
+
+	for i := range values.Items {
+		values.Items[i].MetricLabels[SMOOTHING_LABEL] = string(smoothing.Type)
+		values.Items[i].MetricLabels[RAW_VALUE_LABEL] = strconv.Itoa(rawValues[i])
+	}
+
+	return values
+}
@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"context"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"testing"
+	"time"
+)
+
+// SequenceRpmProvider returns the next of Values on every call, each in a new timeslice
+type SequenceRpmProvider struct {
+	TestRpmProvider
+	Values []int
+	calls *int
+}
+
+func (p SequenceRpmProvider) GetApplicationMetric(ctx context.Context, appName string) (newrelic.MetricResult, error) {
+	value := p.Values[*p.calls]
+	*p.calls++
+	return newrelic.MetricResult{
+		AppName: appName,
+		Value: value,
+		Timestamp: testTimestamp.Add(time.Duration(*p.calls) * time.Minute),
+	}, nil
+}
+
+func smoothedValues(store *smoothingStore, smoothing Smoothing, values []int) []float64 {
+	smoothed := []float64{}
+	for i, value := range values {
+		at := testTimestamp.Add(time.Duration(i) * time.Minute)
+		smoothed = append(smoothed, store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: value, Timestamp: at}, at))
+	}
+
+	return smoothed
+}
+
+func TestSmoothingTypes(t *testing.T) {
+	tests := map[SmoothingType]struct {
+		smoothing Smoothing
+		expected []float64
+	}{
+		SmoothingEWMA: {Smoothing{Type: SmoothingEWMA, Alpha: 0.5}, []float64{100, 150, 125, 112.5}},
+		SmoothingAverage: {Smoothing{Type: SmoothingAverage, Samples: 2}, []float64{100, 150, 150, 100}},
+		SmoothingMax: {Smoothing{Type: SmoothingMax, Window: 2 * time.Minute}, []float64{100, 200, 200, 200}},
+	}
+
+	for smoothingType, test := range tests {
+		smoothed := smoothedValues(newSmoothingStore(), test.smoothing, []int{100, 200, 100, 100})
+		for i := range test.expected {
+			if smoothed[i] != test.expected[i] {
+				t.Errorf("Expected %s to smooth to %v, got %v", smoothingType, test.expected, smoothed)
+				break
+			}
+		}
+	}
+}
+
+func TestSmoothingCountsEachTimesliceOnce(t *testing.T) {
+	store := newSmoothingStore()
+	smoothing := Smoothing{Type: SmoothingAverage, Samples: 3}
+	now := time.Now()
+
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100, Timestamp: testTimestamp}, now)
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100, Timestamp: testTimestamp}, now.Add(15 * time.Second))
+	smoothed := store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 400, Timestamp: testTimestamp.Add(time.Minute)}, now.Add(time.Minute))
+
+	if smoothed != 250 {
+		t.Errorf("Expected the repeated timeslice to be averaged once, got %v", smoothed)
+	}
+}
+
+func TestSmoothingCountsValuesWithoutTimestampOncePerMinute(t *testing.T) {
+	store := newSmoothingStore()
+	smoothing := Smoothing{Type: SmoothingAverage, Samples: 3}
+	now := time.Date(2019, 2, 12, 17, 54, 0, 0, time.UTC)
+
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100}, now)
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100}, now.Add(15 * time.Second))
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100}, now.Add(30 * time.Second))
+	smoothed := store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 400}, now.Add(time.Minute))
+
+	if smoothed != 250 {
+		t.Errorf("Expected the values read within a minute to be averaged once, got %v", smoothed)
+	}
+}
+
+func TestSmoothingStateExpires(t *testing.T) {
+	store := newSmoothingStore()
+	smoothing := Smoothing{Type: SmoothingMax, Window: time.Hour}
+	now := time.Now()
+
+	store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 500}, now)
+	smoothed := store.add("marketplace/rpm", smoothing, newrelic.MetricResult{Value: 100}, now.Add(smoothingStateExpiry + time.Minute))
+
+	if smoothed != 100 {
+		t.Errorf("Expected the state of a request no longer made to be dropped, got %v", smoothed)
+	}
+}
+
+func TestGetExternalMetricSmoothed(t *testing.T) {
+	calls := 0
+	np := NewProvider(TestDynamic{}, TestRESTMapper{}, SequenceRpmProvider{Values: []int{100, 300, 300}, calls: &calls}, Options{
+		Smoothing: Smoothing{Type: SmoothingEWMA, Alpha: 0.25},
+	})
+
+	np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	valueList, err := np.GetExternalMetric("marketplace", appNameSelector("marketplace-prod"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(150) {
+		t.Errorf("Expected the smoothed value of 150, got %d", val)
+	}
+
+	labels := valueList.Items[0].MetricLabels
+	if labels[RAW_VALUE_LABEL] != "300" || labels[SMOOTHING_LABEL] != string(SmoothingEWMA) {
+		t.Errorf("Expected the raw value and smoothing in the labels, got %v", labels)
+	}
+
+	valueList, _ = np.GetExternalMetric("marketplace", appNameSelector("marketplace-staging"), provider.ExternalMetricInfo{Metric: "rpm"})
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(300) {
+		t.Errorf("Expected another app to start from its own value, got %d", val)
+	}
+}
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// StaticDefinition is a metric definition from the adapter's config file, it is served like a NewRelicMetric object
+// but never changes and has no status to write
+type StaticDefinition struct {
+	Namespace string
+	Name string
+	// Spec is a NewRelicMetric spec as JSON
+	Spec []byte
+}
+
+// parseStaticDefinition wraps the spec in a NewRelicMetric object so it is validated exactly like one
+func parseStaticDefinition(static StaticDefinition) (metricDefinition, error) {
+	spec := json.RawMessage(static.Spec)
+	if len(spec) == 0 {
+		spec = json.RawMessage("null")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": metricDefinitionsResource.GroupVersion().String(),
+		"kind": "NewRelicMetric",
+		"metadata": map[string]interface{}{
+			"namespace": static.Namespace,
+			"name": static.Name,
+		},
+		"spec": spec,
+	})
+	if err != nil {
+		return metricDefinition{}, err
+	}
+
+	// unstructured decoding turns whole numbers into int64 as the API server does
+	obj := &unstructured.Unstructured{}
+	err = obj.UnmarshalJSON(body)
+	if err != nil {
+		return metricDefinition{}, err
+	}
+
+	definition, err := parseMetricDefinition(obj)
+	definition.Static = true
+	return definition, err
+}
+
+// loadStatic adds the static definitions to the store, failing on the first invalid or duplicate one
+func (s *definitionStore) loadStatic(statics []StaticDefinition) error {
+	for _, static := range statics {
+		definition, err := parseStaticDefinition(static)
+		if err == nil {
+			err = s.set(definition)
+		}
+
+		if err != nil {
+			return fmt.Errorf("metric definition %s/%s is invalid: %v", static.Namespace, static.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateStaticDefinitions checks static definitions the way NewRelicMetric objects are checked, so a bad config
+// file is rejected at startup rather than when the metric is first requested
+func ValidateStaticDefinitions(statics []StaticDefinition) error {
+	return newDefinitionStore().loadStatic(statics)
+}
@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	"testing"
+)
+
+func TestGetExternalMetricFromStaticDefinition(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	np := NewProvider(client, TestRESTMapper{}, TestRpmProvider{}, Options{
+		StaticDefinitions: []StaticDefinition{{
+			Namespace: "marketplace",
+			Name: "transactions",
+			Spec: []byte(`{"metricName":"marketplace-transactions","query":{"nrql":"SELECT count(*) FROM Transaction","accountId":42}}`),
+		}},
+	}).(*newrelicProvider)
+
+	valueList, err := np.GetExternalMetric("marketplace", labels.NewSelector(), provider.ExternalMetricInfo{Metric: "marketplace-transactions"})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if val, _ := valueList.Items[0].Value.AsInt64(); val != int64(77) {
+		t.Errorf("Expected NRQL value of 77, got %d", val)
+	}
+
+	// an object with the same name must not replace the definition from the config file
+	np.definitionDeleted(testMetricDefinition("transactions", nil))
+	if _, ok := np.definitions.get("marketplace", "marketplace-transactions"); !ok {
+		t.Errorf("Static definition was removed")
+	}
+}
+
+func TestValidateStaticDefinitions(t *testing.T) {
+	statics := map[string][]StaticDefinition{
+		"missing spec": {{Namespace: "marketplace", Name: "errors"}},
+		"invalid spec": {{Namespace: "marketplace", Name: "errors", Spec: []byte(`{"metricName":"rpm"}`)}},
+		"duplicate metric": {
+			{Namespace: "marketplace", Name: "errors", Spec: []byte(`{"metricName":"errors"}`)},
+			{Namespace: "marketplace", Name: "more-errors", Spec: []byte(`{"metricName":"errors"}`)},
+		},
+	}
+
+	for description, static := range statics {
+		if err := ValidateStaticDefinitions(static); err == nil {
+			t.Errorf("Expected a validation error for %s", description)
+		}
+	}
+
+	valid := []StaticDefinition{{Namespace: "marketplace", Name: "errors", Spec: []byte(`{"metricName":"errors","fallbackValue":0}`)}}
+	if err := ValidateStaticDefinitions(valid); err != nil {
+		t.Errorf("Expected a valid definition, got %s", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package query implements the adapter's query subcommand, which reads a metric from New Relic the way the provider
+// does without needing a cluster
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flexshopper/newrelic-custom-metrics/config"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"github.com/spf13/pflag"
+	"io"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Request is a request made to New Relic while answering the query, API keys are sent as headers and not shown
+type Request struct {
+	Method string `json:"method"`
+	Url string `json:"url"`
+	Status string `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Output is what the query prints
+type Output struct {
+	Result newrelic.MetricResult `json:"result"`
+	Hosts []newrelic.MetricResult `json:"hosts,omitempty"`
+	Requests []Request `json:"requests"`
+	Error string `json:"error,omitempty"`
+}
+
+// recordingClient keeps every request sent through the client it wraps
+type recordingClient struct {
+	client newrelic.GetApiRequest
+	requests []Request
+}
+
+func requestStatus(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	if statusErr, ok := err.(*newrelic.StatusError); ok {
+		return strconv.Itoa(statusErr.StatusCode)
+	}
+
+	return err.Error()
+}
+
+func (r *recordingClient) Fetch(uri string, headers map[string]string, params map[string]string) ([]byte, error) {
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+
+	fullUri := uri
+	if len(query) > 0 {
+		fullUri += "?" + query.Encode()
+	}
+
+	start := time.Now()
+	body, err := r.client.Fetch(uri, headers, params)
+	r.requests = append(r.requests, Request{Method: "GET", Url: fullUri, Status: requestStatus(err), Duration: time.Since(start)})
+	return body, err
+}
+
+func (r *recordingClient) Post(uri string, headers map[string]string, body []byte) ([]byte, error) {
+	poster, ok := r.client.(newrelic.PostApiRequest)
+	if !ok {
+		return nil, errors.New("http client does not support POST requests")
+	}
+
+	start := time.Now()
+	responseBody, err := poster.Post(uri, headers, body)
+	r.requests = append(r.requests, Request{Method: "POST", Url: uri, Status: requestStatus(err), Duration: time.Since(start)})
+	return responseBody, err
+}
+
+type options struct {
+	app string
+	metric string
+	valueKey string
+	aggregation string
+	window time.Duration
+	hosts bool
+	nrql string
+	accountId int
+	output string
+	recordDir string
+}
+
+// Run parses the query subcommand's args, reads the metric and prints it to out. newClient builds the http client
+// for the configured timeout, the same one the adapter uses.
+func Run(args []string, out io.Writer, getenv func(key string) string, newClient func(timeout time.Duration) newrelic.GetApiRequest) error {
+	fs := pflag.NewFlagSet("query", pflag.ContinueOnError)
+	configFlags := config.BindFlags(fs)
+
+	opts := options{}
+	fs.StringVar(&opts.app, "app", "", "New Relic app name")
+	fs.StringVar(&opts.metric, "metric", "rpm", "rpm, or a New Relic metric name such as Errors/all")
+	fs.StringVar(&opts.valueKey, "value", "", "value of the New Relic metric to read, e.g. errors_per_minute")
+	fs.StringVar(&opts.aggregation, "aggregation", newrelic.AggregationSummary, "summary or host_average")
+	fs.DurationVar(&opts.window, "window", 0, "time window to summarize, New Relic's default when unset")
+	fs.BoolVar(&opts.hosts, "hosts", true, "also read the metric for each host")
+	fs.StringVar(&opts.nrql, "nrql", "", "NRQL query returning a single value, instead of --metric")
+	fs.IntVar(&opts.accountId, "account", 0, "account the NRQL query is sent to, newrelic.defaultAccountId when unset")
+	fs.StringVar(&opts.output, "output", "table", "table or json")
+	fs.StringVar(&opts.recordDir, "record", "", "directory to write each request and response to as test fixtures, with the API key redacted")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if opts.output != "table" && opts.output != "json" {
+		return errors.New("--output must be table or json")
+	}
+
+	cfg, err := configFlags.Load(getenv)
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := cfg.ApiKey()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newClient(cfg.NewRelic.Timeout.Duration)
+	if opts.recordDir != "" {
+		httpClient = newrelic.NewFixtureRecorder(httpClient, opts.recordDir, apiKey)
+	}
+
+	client := &recordingClient{client: httpClient}
+	api := cfg.NewApi(apiKey, client)
+
+	output := Output{}
+	output.Result, output.Hosts, err = read(api, cfg, opts)
+	output.Requests = client.requests
+	if err != nil {
+		output.Error = err.Error()
+	}
+
+	if opts.output == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(output); encodeErr != nil {
+			return encodeErr
+		}
+	} else {
+		printTable(out, output)
+	}
+
+	return err
+}
+
+func read(api *newrelic.Api, cfg *config.Config, opts options) (newrelic.MetricResult, []newrelic.MetricResult, error) {
+	ctx := context.Background()
+	if opts.nrql != "" {
+		accountId := opts.accountId
+		if accountId == 0 {
+			accountId = cfg.NewRelic.DefaultAccountID
+		}
+
+		result, err := api.GetNrqlMetric(ctx, accountId, opts.nrql)
+		return result, nil, err
+	}
+
+	if opts.app == "" {
+		return newrelic.MetricResult{}, nil, errors.New("--app is required unless --nrql is used")
+	}
+
+	query := newrelic.RequestsPerMinute
+	hostQuery := newrelic.HostCallsPerMinute
+	if opts.metric != "rpm" {
+		if opts.valueKey == "" {
+			return newrelic.MetricResult{}, nil, errors.New("--value is required for metrics other than rpm")
+		}
+
+		query = newrelic.MetricQuery{MetricName: opts.metric, ValueKey: opts.valueKey, Aggregation: opts.aggregation}
+		hostQuery = query
+	}
+
+	query.Window = opts.window
+	hostQuery.Window = opts.window
+
+	result, err := api.GetMetric(ctx, opts.app, query)
+	if err != nil || !opts.hosts {
+		return result, nil, err
+	}
+
+	hosts, err := api.GetPerHostMetricsFor(ctx, opts.app, hostQuery)
+	return result, hosts, err
+}
+
+func printTable(out io.Writer, output Output) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	result := output.Result
+
+	if result.AppName != "" {
+		fmt.Fprintf(w, "App\t%s (%d)\n", result.AppName, result.AppID)
+	}
+
+	if result.AccountID != 0 {
+		fmt.Fprintf(w, "Account\t%d\n", result.AccountID)
+	}
+
+	fmt.Fprintf(w, "Metric\t%s %s (%s)\n", result.MetricName, result.ValueKey, result.Aggregation)
+	fmt.Fprintf(w, "Value\t%d\n", result.Value)
+	fmt.Fprintf(w, "Timestamp\t%s\n", result.Timestamp.Format(time.RFC3339))
+	if result.Aggregation == newrelic.AggregationHostAverage {
+		fmt.Fprintf(w, "Hosts\t%d considered of %d\n", result.ConsideredHostCount, result.HostCount)
+	}
+
+	if output.Error != "" {
+		fmt.Fprintf(w, "Error\t%s\n", output.Error)
+	}
+
+	if len(output.Hosts) > 0 {
+		fmt.Fprintf(w, "\nHOST\tVALUE\tTIMESTAMP\n")
+		for _, host := range output.Hosts {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", host.Host, host.Value, host.Timestamp.Format(time.RFC3339))
+		}
+	}
+
+	fmt.Fprintf(w, "\nREQUEST\tSTATUS\tDURATION\n")
+	for _, request := range output.Requests {
+		fmt.Fprintf(w, "%s %s\t%s\t%s\n", request.Method, request.Url, request.Status, request.Duration.Round(time.Millisecond))
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,126 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/flexshopper/newrelic-custom-metrics/newrelic"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestApiRequest answers with the response whose URL suffix matches
+type TestApiRequest struct {
+	Responses map[string]string
+}
+
+func (c TestApiRequest) Fetch(url string, headers map[string]string, params map[string]string) ([]byte, error) {
+	for suffix, response := range c.Responses {
+		if strings.HasSuffix(url, suffix) {
+			return []byte(response), nil
+		}
+	}
+
+	return nil, &newrelic.StatusError{StatusCode: 404}
+}
+
+var testResponses = map[string]string{
+	"applications.json": `{"applications":[{"id":1234,"name":"marketplace-prod"}]}`,
+	"applications/1234/metrics/data.json": `{"metric_data":{"metrics":[{"name":"HttpDispatcher","timeslices":[{"to":"2019-02-12T17:54:00+00:00","values":{"requests_per_minute":120}}]}]}}`,
+	"applications/1234/hosts.json": `{"application_hosts":[{"id":1,"host":"marketplace-7d9f-abcde"}]}`,
+	"applications/1234/hosts/1/metrics/data.json": `{"metric_data":{"metrics":[{"name":"HttpDispatcher","timeslices":[{"to":"2019-02-12T17:54:00+00:00","values":{"calls_per_minute":60}}]}]}}`,
+}
+
+func testEnv(key string) string {
+	return map[string]string{"NEWRELIC_API_KEY": "abc"}[key]
+}
+
+func testClient(timeout time.Duration) newrelic.GetApiRequest {
+	return TestApiRequest{Responses: testResponses}
+}
+
+func TestRunJson(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run([]string{"--app", "marketplace-prod", "--output", "json"}, out, testEnv, testClient)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	output := Output{}
+	if err := json.Unmarshal(out.Bytes(), &output); err != nil {
+		t.Fatalf("Output is not JSON: %s\n%s", err, out)
+	}
+
+	if output.Result.Value != 120 || output.Result.AppID != 1234 {
+		t.Errorf("Expected 120 RPM for app 1234, got %+v", output.Result)
+	}
+
+	if len(output.Hosts) != 1 || output.Hosts[0].Host != "marketplace-7d9f-abcde" || output.Hosts[0].Value != 60 {
+		t.Errorf("Expected the host breakdown, got %+v", output.Hosts)
+	}
+
+	if len(output.Requests) != 4 || output.Requests[0].Status != "ok" {
+		t.Errorf("Expected the 4 requests made, got %+v", output.Requests)
+	}
+}
+
+func TestRunTable(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run([]string{"--app", "marketplace-prod", "--metric", "Errors/all", "--value", "errors_per_minute", "--hosts=false", "--window", "5m"}, out, testEnv, testClient)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	table := out.String()
+	for _, expected := range []string{"marketplace-prod (1234)", "Errors/all errors_per_minute", "GET", "from="} {
+		if !strings.Contains(table, expected) {
+			t.Errorf("Expected %q in the table, got\n%s", expected, table)
+		}
+	}
+
+	if strings.Contains(table, "HOST") {
+		t.Errorf("Expected no host breakdown with --hosts=false, got\n%s", table)
+	}
+}
+
+func TestRunPrintsRequestsOnError(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run([]string{"--app", "missing"}, out, testEnv, testClient)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing app")
+	}
+
+	if !strings.Contains(out.String(), "applications.json") {
+		t.Errorf("Expected the requests to be printed, got\n%s", out)
+	}
+}
+
+func TestRunRequiresValueForCustomMetrics(t *testing.T) {
+	err := Run([]string{"--app", "marketplace-prod", "--metric", "Errors/all"}, &bytes.Buffer{}, testEnv, testClient)
+	if err == nil || !strings.Contains(err.Error(), "--value") {
+		t.Errorf("Expected --value to be required, got %v", err)
+	}
+}
+
+func TestRunRecordsFixtures(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "query-fixtures")
+	defer os.RemoveAll(dir)
+
+	err := Run([]string{"--app", "marketplace-prod", "--hosts=false", "--record", dir}, &bytes.Buffer{}, testEnv, testClient)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	replay, err := newrelic.NewFixtureReplayer(dir)
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	result, err := newrelic.NewApi("other", 1, replay).GetApplicationMetric(context.Background(), "marketplace-prod")
+	if err != nil || result.Value != 120 {
+		t.Errorf("Expected the recorded 120, got %d (%v)", result.Value, err)
+	}
+}
@@ -0,0 +1,111 @@
+// Package shutdown stops the adapter on SIGTERM without cutting off the requests it is serving
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrShuttingDown fails the readiness check once a shutdown started, so the pod is taken out of the Service
+var ErrShuttingDown = errors.New("the adapter is shutting down")
+
+// Handler runs a shutdown in three steps. Readiness fails straight away while requests are still served for the
+// delay, so endpoints stop routing to the pod. The stop channel is then closed, stopping background work and letting
+// the API server finish the requests in flight. New Relic calls still running after the grace period are canceled
+// through the context, so those requests fail rather than hold up the exit.
+type Handler struct {
+	delay time.Duration
+	gracePeriod time.Duration
+	stopCh chan struct{}
+	ctx context.Context
+	cancel context.CancelFunc
+
+	lock sync.Mutex
+	shuttingDown bool
+}
+
+func NewHandler(delay time.Duration, gracePeriod time.Duration) *Handler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Handler{
+		delay: delay,
+		gracePeriod: gracePeriod,
+		stopCh: make(chan struct{}),
+		ctx: ctx,
+		cancel: cancel,
+	}
+}
+
+// StopCh is closed once the delay after the shutdown started is over
+func (h *Handler) StopCh() <-chan struct{} {
+	return h.stopCh
+}
+
+// Context is done once the grace period is over or Done is called
+func (h *Handler) Context() context.Context {
+	return h.ctx
+}
+
+// Notify starts a shutdown on the first SIGTERM or SIGINT, a second one exits immediately
+func (h *Handler) Notify() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		received := <-signals
+		glog.Infof("Received %s, shutting down within %s", received, h.delay + h.gracePeriod)
+		go h.Shutdown()
+
+		<-signals
+		glog.Warningf("Received a second signal, exiting without draining")
+		glog.Flush()
+		os.Exit(1)
+	}()
+}
+
+// Shutdown runs the shutdown and returns once the context is done, later calls return immediately
+func (h *Handler) Shutdown() {
+	h.lock.Lock()
+	if h.shuttingDown {
+		h.lock.Unlock()
+		return
+	}
+
+	h.shuttingDown = true
+	h.lock.Unlock()
+
+	time.Sleep(h.delay)
+	close(h.stopCh)
+
+	timer := time.NewTimer(h.gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		glog.Warningf("Requests still running after the %s grace period, canceling their New Relic calls", h.gracePeriod)
+		h.cancel()
+	case <-h.ctx.Done():
+	}
+}
+
+// Done cancels the context, for once everything stopped within the grace period
+func (h *Handler) Done() {
+	h.cancel()
+}
+
+// Check is a readiness check failing once a shutdown started
+func (h *Handler) Check() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.shuttingDown {
+		return ErrShuttingDown
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package shutdown
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandler_FailsReadinessBeforeStopping(t *testing.T) {
+	handler := NewHandler(50 * time.Millisecond, time.Second)
+	if err := handler.Check(); err != nil {
+		t.Fatalf("Expected the handler to be ready before shutting down, got %s", err)
+	}
+
+	go handler.Shutdown()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := handler.Check(); err != ErrShuttingDown {
+		t.Errorf("Expected readiness to fail as soon as the shutdown starts, got %v", err)
+	}
+
+	select {
+	case <-handler.StopCh():
+		t.Fatalf("Expected requests to keep being served for the delay")
+	default:
+	}
+
+	select {
+	case <-handler.StopCh():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the stop channel to be closed after the delay")
+	}
+
+	if handler.Context().Err() != nil {
+		t.Errorf("Expected New Relic calls to run on during the grace period")
+	}
+
+	handler.Done()
+	if handler.Context().Err() == nil {
+		t.Errorf("Expected Done to cancel the context")
+	}
+}
+
+func TestHandler_CancelsAfterGracePeriod(t *testing.T) {
+	handler := NewHandler(0, 20 * time.Millisecond)
+
+	start := time.Now()
+	handler.Shutdown()
+	if handler.Context().Err() == nil {
+		t.Fatalf("Expected the context to be canceled once the grace period is over")
+	}
+
+	if waited := time.Since(start); waited < 20 * time.Millisecond {
+		t.Errorf("Expected the grace period to be waited out, returned after %s", waited)
+	}
+
+	// a second shutdown, e.g. from a second caller, returns without closing the stop channel again
+	handler.Shutdown()
+}
@@ -0,0 +1,19 @@
+package telemetry
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	telemetryEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "newrelic_adapter_telemetry_events_total",
+		Help: "Events reported to New Relic by result: sent, failed (the Event API request failed) or dropped (the queue was full).",
+	}, []string{"result"})
+	telemetryRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "newrelic_adapter_telemetry_request_duration_seconds",
+		Help: "Latency of the requests sending batches of events to the Event API.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(telemetryEvents, telemetryRequestDuration)
+}
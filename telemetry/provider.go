@@ -0,0 +1,131 @@
+package telemetry
+
+import (
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"time"
+)
+
+const (
+	kindExternal = "external"
+	kindCustom = "custom"
+)
+
+// Provider records an event for every value the wrapped provider serves, and one for every request it fails
+type Provider struct {
+	nrProvider.MetricsProvider
+	reporter *Reporter
+}
+
+func NewProvider(metricsProvider nrProvider.MetricsProvider, reporter *Reporter) *Provider {
+	return &Provider{
+		MetricsProvider: metricsProvider,
+		reporter: reporter,
+	}
+}
+
+func (p *Provider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	start := time.Now()
+	values, shared, err := p.getExternalMetric(namespace, metricSelector, info)
+	event := p.event(kindExternal, namespace, info.Metric, start, err)
+
+	if err != nil || values == nil || len(values.Items) == 0 {
+		event.AppName = selectorAppName(metricSelector)
+		p.reporter.Record(event)
+		return values, err
+	}
+
+	for _, value := range values.Items {
+		valueEvent := event
+		valueEvent.AppName = value.MetricLabels[nrProvider.APP_KEY]
+		valueEvent.Value = float64(value.Value.MilliValue()) / 1000
+		// the last known good value is served from the adapter's memory when New Relic fails, a shared value from what
+		// the HA leader published
+		valueEvent.CacheHit = shared || value.MetricLabels[nrProvider.FAILURE_POLICY_LABEL] == string(nrProvider.FailurePolicyLastKnownGood)
+		p.reporter.Record(valueEvent)
+	}
+
+	return values, err
+}
+
+func (p *Provider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	start := time.Now()
+	value, err := p.MetricsProvider.GetMetricByName(name, info, metricSelector)
+	event := p.event(kindCustom, name.Namespace, info.Metric, start, err)
+	event.AppName = selectorAppName(metricSelector)
+	event.Object = name.Name
+
+	if err == nil && value != nil {
+		event.Value = float64(value.Value.MilliValue()) / 1000
+	}
+
+	p.reporter.Record(event)
+	return value, err
+}
+
+func (p *Provider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	start := time.Now()
+	values, err := p.MetricsProvider.GetMetricBySelector(namespace, selector, info, metricSelector)
+	event := p.event(kindCustom, namespace, info.Metric, start, err)
+	event.AppName = selectorAppName(metricSelector)
+
+	if err != nil || values == nil || len(values.Items) == 0 {
+		p.reporter.Record(event)
+		return values, err
+	}
+
+	for _, value := range values.Items {
+		valueEvent := event
+		valueEvent.Object = value.DescribedObject.Name
+		valueEvent.Value = float64(value.Value.MilliValue()) / 1000
+		p.reporter.Record(valueEvent)
+	}
+
+	return values, err
+}
+
+// getExternalMetric reads the external values from the wrapped provider, reporting whether they were shared by
+// another replica
+func (p *Provider) getExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, bool, error) {
+	if sharedProvider, ok := p.MetricsProvider.(nrProvider.SharedExternalMetricsProvider); ok {
+		return sharedProvider.GetSharedExternalMetric(namespace, metricSelector, info)
+	}
+
+	values, err := p.MetricsProvider.GetExternalMetric(namespace, metricSelector, info)
+	return values, false, err
+}
+
+// event returns the fields shared by the events of a request that started at start
+func (p *Provider) event(kind string, namespace string, metric string, start time.Time, err error) Event {
+	event := Event{
+		EventType: EVENT_TYPE,
+		Timestamp: start.UnixNano() / int64(time.Millisecond),
+		Kind: kind,
+		Namespace: namespace,
+		Metric: metric,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	return event
+}
+
+// selectorAppName returns the app a selector asks for with appName=..., empty when it names several or none
+func selectorAppName(metricSelector labels.Selector) string {
+	reqs, _ := metricSelector.Requirements()
+	for _, req := range reqs {
+		if req.Key() == nrProvider.APP_KEY && (req.Operator() == selection.Equals || req.Operator() == selection.DoubleEquals) {
+			return req.Values().List()[0]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,143 @@
+package telemetry
+
+import (
+	"errors"
+	nrProvider "github.com/flexshopper/newrelic-custom-metrics/provider"
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"testing"
+	"time"
+)
+
+// TestMetricsProvider serves two apps, one of them from the last known good value
+type TestMetricsProvider struct {
+	nrProvider.MetricsProvider
+}
+
+func (TestMetricsProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	if info.Metric == "broken" {
+		return &external_metrics.ExternalMetricValueList{}, errors.New("New Relic responded with status 503")
+	}
+
+	return &external_metrics.ExternalMetricValueList{Items: []external_metrics.ExternalMetricValue{{
+		MetricName: info.Metric,
+		MetricLabels: map[string]string{nrProvider.APP_KEY: "marketplace-east"},
+		Timestamp: meta1.Now(),
+		Value: *resource.NewQuantity(120, resource.DecimalSI),
+	}, {
+		MetricName: info.Metric,
+		MetricLabels: map[string]string{
+			nrProvider.APP_KEY: "marketplace-west",
+			nrProvider.FAILURE_POLICY_LABEL: string(nrProvider.FailurePolicyLastKnownGood),
+		},
+		Timestamp: meta1.Now(),
+		Value: *resource.NewMilliQuantity(2500, resource.DecimalSI),
+	}}}, nil
+}
+
+// SharedTestMetricsProvider serves TestMetricsProvider's values as values another replica read
+type SharedTestMetricsProvider struct {
+	TestMetricsProvider
+}
+
+func (p SharedTestMetricsProvider) GetSharedExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, bool, error) {
+	values, err := p.GetExternalMetric(namespace, metricSelector, info)
+	return values, err == nil, err
+}
+
+func (TestMetricsProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", Namespace: name.Namespace, Name: name.Name},
+		Metric: custom_metrics.MetricIdentifier{Name: info.Metric},
+		Timestamp: meta1.Now(),
+		Value: *resource.NewQuantity(7, resource.DecimalSI),
+	}, nil
+}
+
+func recorded(reporter *Reporter) []Event {
+	events := []Event{}
+	for {
+		select {
+		case event := <-reporter.queue:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestProvider_RecordsEveryValueServed(t *testing.T) {
+	reporter := NewReporter(Options{QueueSize: 10, BatchSize: 10, FlushInterval: time.Hour})
+	p := NewProvider(TestMetricsProvider{}, reporter)
+
+	selector, _ := labels.Parse("appName in (marketplace-east, marketplace-west)")
+	if _, err := p.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "rpm"}); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	events := recorded(reporter)
+	if len(events) != 2 {
+		t.Fatalf("Expected an event per value, got %d", len(events))
+	}
+
+	if events[0].AppName != "marketplace-east" || events[0].Value != 120 || events[0].CacheHit || events[0].Kind != kindExternal {
+		t.Errorf("Expected the value read from New Relic, got %+v", events[0])
+	}
+
+	if events[1].AppName != "marketplace-west" || events[1].Value != 2.5 || !events[1].CacheHit {
+		t.Errorf("Expected the last known good value as a cache hit, got %+v", events[1])
+	}
+
+	if events[0].EventType != EVENT_TYPE || events[0].Namespace != "marketplace" || events[0].Metric != "rpm" || events[0].Timestamp == 0 {
+		t.Errorf("Expected the request's fields on the event, got %+v", events[0])
+	}
+}
+
+func TestProvider_RecordsSharedValuesAsCacheHits(t *testing.T) {
+	reporter := NewReporter(Options{QueueSize: 10, BatchSize: 10, FlushInterval: time.Hour})
+	p := NewProvider(SharedTestMetricsProvider{}, reporter)
+
+	selector, _ := labels.Parse("appName in (marketplace-east, marketplace-west)")
+	if _, err := p.GetExternalMetric("marketplace", selector, provider.ExternalMetricInfo{Metric: "rpm"}); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	events := recorded(reporter)
+	if len(events) != 2 || !events[0].CacheHit || !events[1].CacheHit {
+		t.Errorf("Expected the shared values as cache hits, got %+v", events)
+	}
+}
+
+func TestProvider_RecordsFailures(t *testing.T) {
+	reporter := NewReporter(Options{QueueSize: 10, BatchSize: 10, FlushInterval: time.Hour})
+	p := NewProvider(TestMetricsProvider{}, reporter)
+
+	_, err := p.GetExternalMetric("marketplace", labels.SelectorFromSet(labels.Set{"appName": "marketplace-east"}), provider.ExternalMetricInfo{Metric: "broken"})
+	if err == nil {
+		t.Fatalf("Expected the wrapped provider's error")
+	}
+
+	events := recorded(reporter)
+	if len(events) != 1 || events[0].Error != err.Error() || events[0].AppName != "marketplace-east" {
+		t.Errorf("Expected a single event with the error, got %+v", events)
+	}
+}
+
+func TestProvider_RecordsCustomMetrics(t *testing.T) {
+	reporter := NewReporter(Options{QueueSize: 10, BatchSize: 10, FlushInterval: time.Hour})
+	p := NewProvider(TestMetricsProvider{}, reporter)
+
+	name := types.NamespacedName{Namespace: "marketplace", Name: "marketplace-1234"}
+	info := provider.CustomMetricInfo{Metric: "rpm"}
+	p.GetMetricByName(name, info, labels.SelectorFromSet(labels.Set{"appName": "marketplace-east"}))
+
+	events := recorded(reporter)
+	if len(events) != 1 || events[0].Object != "marketplace-1234" || events[0].Value != 7 || events[0].Kind != kindCustom {
+		t.Errorf("Expected an event for the pod's value, got %+v", events)
+	}
+}
@@ -0,0 +1,194 @@
+// Package telemetry reports the metric values the adapter serves to New Relic as custom events through the Event
+// API, so dashboards can show what the HPAs saw
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// EVENT_TYPE is the eventType of the events, e.g. SELECT average(value) FROM NewRelicAdapterMetric FACET appName
+const EVENT_TYPE = "NewRelicAdapterMetric"
+
+// Event is a metric value served, or a request that failed, as sent to the Event API
+type Event struct {
+	EventType string `json:"eventType"`
+	// Timestamp is when the request was served in Unix milliseconds
+	Timestamp int64 `json:"timestamp"`
+	// Kind is external or custom
+	Kind string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Metric string `json:"metric"`
+	AppName string `json:"appName,omitempty"`
+	// Object is the pod or deployment a custom metric describes
+	Object string `json:"object,omitempty"`
+	Value float64 `json:"value"`
+	// LatencyMs is how long the whole request took, a request serving several values reports it on each
+	LatencyMs float64 `json:"latencyMs"`
+	// CacheHit is set when the value was not read from New Relic for this request
+	CacheHit bool `json:"cacheHit"`
+	Error string `json:"error,omitempty"`
+}
+
+// Options configures where and how often events are sent
+type Options struct {
+	// Endpoint is the Event API URL of the account, e.g. https://insights-collector.newrelic.com/v1/accounts/1234/events
+	Endpoint string
+	// LicenseKey is an ingest license key of the account, REST and user keys are not accepted by the Event API
+	LicenseKey string
+	// QueueSize bounds the events waiting to be sent, events recorded while it is full are dropped
+	QueueSize int
+	// BatchSize is the most events sent in one request
+	BatchSize int
+	// FlushInterval is the longest an event waits before being sent
+	FlushInterval time.Duration
+	// Timeout bounds each request to the Event API
+	Timeout time.Duration
+}
+
+// Reporter sends events to the Event API in batches, in the background. Recording never blocks: when the Event API
+// is slow or down, events are dropped once the queue is full rather than holding up metric requests.
+type Reporter struct {
+	options Options
+	client *http.Client
+	queue chan Event
+	stopped chan struct{}
+}
+
+func NewReporter(options Options) *Reporter {
+	return &Reporter{
+		options: options,
+		client: &http.Client{Timeout: options.Timeout},
+		queue: make(chan Event, options.QueueSize),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Record queues event to be sent, dropping it when the queue is full
+func (r *Reporter) Record(event Event) {
+	if event.EventType == "" {
+		event.EventType = EVENT_TYPE
+	}
+
+	select {
+	case r.queue <- event:
+	default:
+		telemetryEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run sends the queued events every FlushInterval, or as soon as a batch is full, until stopCh is closed. The events
+// still queued are then sent before Stopped is closed.
+func (r *Reporter) Run(stopCh <-chan struct{}) {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := []Event{}
+	for {
+		select {
+		case event := <-r.queue:
+			batch = append(batch, event)
+			if len(batch) >= r.options.BatchSize {
+				r.send(batch)
+				batch = []Event{}
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				r.send(batch)
+				batch = []Event{}
+			}
+		case <-stopCh:
+			r.drain(batch)
+			return
+		}
+	}
+}
+
+// Stopped is closed once Run returned and the last events were sent
+func (r *Reporter) Stopped() <-chan struct{} {
+	return r.stopped
+}
+
+// drain sends batch and every event left in the queue
+func (r *Reporter) drain(batch []Event) {
+	for {
+		select {
+		case event := <-r.queue:
+			batch = append(batch, event)
+			if len(batch) < r.options.BatchSize {
+				continue
+			}
+		default:
+		}
+
+		if len(batch) == 0 {
+			return
+		}
+
+		r.send(batch)
+		if len(batch) < r.options.BatchSize {
+			return
+		}
+
+		batch = []Event{}
+	}
+}
+
+// send posts the events as gzipped JSON, a batch that fails is logged and dropped since the values it holds are
+// only worth anything while they are recent
+func (r *Reporter) send(batch []Event) {
+	start := time.Now()
+	err := r.post(batch)
+	telemetryRequestDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		glog.Warningf("Could not send %d events to New Relic: %v", len(batch), err)
+		telemetryEvents.WithLabelValues("failed").Add(float64(len(batch)))
+		return
+	}
+
+	telemetryEvents.WithLabelValues("sent").Add(float64(len(batch)))
+}
+
+func (r *Reporter) post(batch []Event) error {
+	body := bytes.Buffer{}
+	writer := gzip.NewWriter(&body)
+	if err := json.NewEncoder(writer).Encode(batch); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.options.Endpoint, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Api-Key", r.options.LicenseKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("the Event API responded with status %d: %s", resp.StatusCode, message)
+	}
+
+	return nil
+}
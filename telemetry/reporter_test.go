@@ -0,0 +1,94 @@
+package telemetry
+
+import (
+	"github.com/flexshopper/newrelic-custom-metrics/newrelictest"
+	"testing"
+	"time"
+)
+
+func testReporter(server *newrelictest.Server, queueSize int) *Reporter {
+	return NewReporter(Options{
+		Endpoint: server.Endpoints().EventsUri + "accounts/1234/events",
+		LicenseKey: "license",
+		QueueSize: queueSize,
+		BatchSize: 2,
+		FlushInterval: time.Hour,
+		Timeout: time.Second,
+	})
+}
+
+func waitForEvents(server *newrelictest.Server, count int) []map[string]interface{} {
+	deadline := time.Now().Add(time.Second)
+	for len(server.Events()) < count && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return server.Events()
+}
+
+func TestReporter_SendsFullBatchesThenTheRestOnStop(t *testing.T) {
+	server := newrelictest.NewServer()
+	defer server.Close()
+	server.ApiKey = "license"
+
+	reporter := testReporter(server, 10)
+	stopCh := make(chan struct{})
+	go reporter.Run(stopCh)
+
+	reporter.Record(Event{Metric: "rpm", AppName: "marketplace-prod", Value: 120})
+	reporter.Record(Event{Metric: "rpm", AppName: "checkout-prod", Value: 40})
+	reporter.Record(Event{Metric: "rpm", AppName: "search-prod", Value: 7})
+
+	// the flush interval is an hour away, only the full batch goes out straight away
+	events := waitForEvents(server, 2)
+	if len(events) != 2 {
+		t.Fatalf("Expected the full batch of 2 events to be sent, got %d", len(events))
+	}
+
+	close(stopCh)
+	<-reporter.Stopped()
+
+	events = server.Events()
+	if len(events) != 3 || len(server.Requests()) != 2 {
+		t.Fatalf("Expected the last event to be sent on stop in a second request, got %d events in %d requests", len(events), len(server.Requests()))
+	}
+
+	if events[0]["eventType"] != EVENT_TYPE || events[0]["appName"] != "marketplace-prod" || events[0]["value"] != float64(120) {
+		t.Errorf("Expected the event's attributes to be sent, got %v", events[0])
+	}
+}
+
+func TestReporter_DropsEventsWhenQueueIsFull(t *testing.T) {
+	server := newrelictest.NewServer()
+	defer server.Close()
+
+	reporter := testReporter(server, 1)
+	reporter.Record(Event{Metric: "rpm", AppName: "marketplace-prod"})
+	reporter.Record(Event{Metric: "rpm", AppName: "checkout-prod"})
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	reporter.Run(stopCh)
+
+	events := server.Events()
+	if len(events) != 1 || events[0]["appName"] != "marketplace-prod" {
+		t.Errorf("Expected only the event that fit in the queue to be sent, got %v", events)
+	}
+}
+
+func TestReporter_RejectedBatchesAreDropped(t *testing.T) {
+	server := newrelictest.NewServer()
+	defer server.Close()
+	server.ApiKey = "another-license"
+
+	reporter := testReporter(server, 10)
+	reporter.Record(Event{Metric: "rpm", AppName: "marketplace-prod"})
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	reporter.Run(stopCh)
+
+	if len(server.Events()) != 0 || len(server.Requests()) != 1 {
+		t.Errorf("Expected one rejected request and no events, got %d events in %d requests", len(server.Events()), len(server.Requests()))
+	}
+}
@@ -0,0 +1,264 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// exportInterval is how often the spans ended are sent to the collector
+	exportInterval = 5 * time.Second
+	// exportBatchSize is how many spans are sent at most per request, a full batch is sent straight away
+	exportBatchSize = 512
+	// exportQueueSize is how many ended spans wait to be sent, spans ended while it is full are dropped
+	exportQueueSize = 2048
+)
+
+// exporter sends the spans ended to an OTLP/HTTP collector in batches, encoded as OTLP JSON
+type exporter struct {
+	url string
+	serviceName string
+	client *http.Client
+	queue chan *Span
+	// stop asks run to send what is queued and return, done is closed once it did
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newExporter(url string, serviceName string) *exporter {
+	return &exporter{
+		url: url,
+		serviceName: serviceName,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue: make(chan *Span, exportQueueSize),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// add queues a span to be sent, it never blocks the request the span belongs to
+func (e *exporter) add(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+
+		e.send(batch)
+		batch = []*Span{}
+	}
+}
+
+// shutdown sends the spans still queued, giving up when ctx is done
+func (e *exporter) shutdown(ctx context.Context) error {
+	close(e.stop)
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		glog.Warningf("Could not encode %d spans: %v", len(batch), err)
+		return
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		glog.Warningf("Could not export %d spans: %v", len(batch), err)
+		return
+	}
+
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		glog.Warningf("Could not export %d spans: the collector answered %d", len(batch), res.StatusCode)
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource otlpResource `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId string `json:"traceId"`
+	SpanId string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpAttribute `json:"attributes,omitempty"`
+	Events []otlpEvent `json:"events,omitempty"`
+	Status otlpStatus `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name string `json:"name"`
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key string `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of its fields, 64 bit integers are strings in OTLP JSON
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue *string `json:"intValue,omitempty"`
+	BoolValue *bool `json:"boolValue,omitempty"`
+	ArrayValue *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpValue `json:"values"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError = 2
+)
+
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := []otlpSpan{}
+	for _, span := range batch {
+		span.lock.Lock()
+		encoded := otlpSpan{
+			TraceId: hex.EncodeToString(span.traceId[:]),
+			SpanId: hex.EncodeToString(span.spanId[:]),
+			Name: span.name,
+			Kind: otlpSpanKindInternal,
+			StartTimeUnixNano: unixNano(span.start),
+			EndTimeUnixNano: unixNano(span.end),
+			Attributes: encodeAttributes(span.attributes),
+		}
+
+		if span.parentSpanId != [8]byte{} {
+			encoded.ParentSpanId = hex.EncodeToString(span.parentSpanId[:])
+		}
+
+		// errors are recorded as OpenTelemetry does, an exception event besides the status
+		if span.err != nil {
+			encoded.Status = otlpStatus{Code: otlpStatusError, Message: span.err.Error()}
+			encoded.Events = []otlpEvent{{
+				TimeUnixNano: unixNano(span.end),
+				Name: "exception",
+				Attributes: encodeAttributes([]Attribute{
+					String("exception.type", fmt.Sprintf("%T", span.err)),
+					String("exception.message", span.err.Error()),
+				}),
+			}}
+		}
+		span.lock.Unlock()
+
+		spans = append(spans, encoded)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes([]Attribute{String("service.name", e.serviceName)})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: tracerName},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []otlpAttribute {
+	encoded := []otlpAttribute{}
+	for _, attr := range attrs {
+		encoded = append(encoded, otlpAttribute{Key: attr.Key, Value: encodeValue(attr.Value)})
+	}
+
+	return encoded
+}
+
+func encodeValue(value interface{}) otlpValue {
+	switch typed := value.(type) {
+	case int64:
+		formatted := strconv.FormatInt(typed, 10)
+		return otlpValue{IntValue: &formatted}
+	case bool:
+		return otlpValue{BoolValue: &typed}
+	case []string:
+		values := []otlpValue{}
+		for _, item := range typed {
+			values = append(values, encodeValue(item))
+		}
+
+		return otlpValue{ArrayValue: &otlpArray{Values: values}}
+	}
+
+	formatted := fmt.Sprint(value)
+	return otlpValue{StringValue: &formatted}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,270 @@
+// Package tracing traces metric requests and the New Relic calls serving them. Spans are exported to an
+// OpenTelemetry collector over OTLP/HTTP, and dropped until Setup installs an exporter, so tracing costs nothing when
+// disabled. It only depends on the standard library, to build with the same toolchain as the rest of the adapter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tracerName = "github.com/flexshopper/newrelic-custom-metrics"
+
+// Options configures where spans are exported
+type Options struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, tracing is disabled when empty
+	Endpoint string
+	// Insecure exports over plain HTTP rather than HTTPS
+	Insecure bool
+	// SampleRatio is the share of traces kept, between 0 and 1
+	SampleRatio float64
+	// ServiceName is the service.name spans are reported under
+	ServiceName string
+}
+
+// Attribute is a key and value recorded on a span, the value is a string, int64, bool or []string
+type Attribute struct {
+	Key string
+	Value interface{}
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func StringSlice(key string, value []string) Attribute {
+	return Attribute{Key: key, Value: append([]string{}, value...)}
+}
+
+// Span is an operation of a trace. Spans of traces that are not sampled are not recorded, every method of a nil Span
+// does nothing so callers do not have to check.
+type Span struct {
+	lock sync.Mutex
+	name string
+	traceId [16]byte
+	spanId [8]byte
+	parentSpanId [8]byte
+	start time.Time
+	end time.Time
+	attributes []Attribute
+	err error
+	// recording is false for spans of traces that are not sampled, kept in the context so their children are not
+	// sampled either
+	recording bool
+	onEnd func(span *Span)
+}
+
+// SetAttributes records attrs on the span, replacing the values of keys already set
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || !s.recording {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.attributes {
+			if s.attributes[i].Key == attr.Key {
+				s.attributes[i] = attr
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			s.attributes = append(s.attributes, attr)
+		}
+	}
+}
+
+func (s *Span) Name() string {
+	return s.name
+}
+
+func (s *Span) SpanID() [8]byte {
+	return s.spanId
+}
+
+func (s *Span) ParentSpanID() [8]byte {
+	return s.parentSpanId
+}
+
+// Err is the error the span ended with, nil for spans that succeeded
+func (s *Span) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// Attribute returns the value of the attribute key, nil when it is not set
+func (s *Span) Attribute(key string) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, attr := range s.attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+
+	return nil
+}
+
+// tracer starts the spans, it is replaced by Setup and Record
+type tracer struct {
+	sampleRatio float64
+	onEnd func(span *Span)
+}
+
+var (
+	tracerLock sync.Mutex
+	current *tracer
+)
+
+func currentTracer() *tracer {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+
+	return current
+}
+
+func setTracer(t *tracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+
+	current = t
+}
+
+type spanKey struct{}
+
+// Setup exports spans to the collector in options and returns a function flushing the spans still buffered, which
+// should be called before exiting. Nothing is exported without an endpoint.
+func Setup(options Options) (func(ctx context.Context) error, error) {
+	if options.Endpoint == "" {
+		setTracer(nil)
+		return func(ctx context.Context) error { return nil }, nil
+	}
+
+	scheme := "https"
+	if options.Insecure {
+		scheme = "http"
+	}
+
+	// the exporter connects lazily, an unreachable collector only loses spans
+	exporter := newExporter(scheme + "://" + options.Endpoint + "/v1/traces", options.ServiceName)
+	go exporter.run()
+
+	setTracer(&tracer{sampleRatio: options.SampleRatio, onEnd: exporter.add})
+	return exporter.shutdown, nil
+}
+
+// Recorder keeps the spans ended, in the order they ended
+type Recorder struct {
+	lock sync.Mutex
+	spans []*Span
+}
+
+// Record samples every trace and keeps its spans in the returned Recorder rather than exporting them, for tests
+func Record() *Recorder {
+	recorder := &Recorder{}
+	setTracer(&tracer{sampleRatio: 1, onEnd: recorder.add})
+	return recorder
+}
+
+func (r *Recorder) add(span *Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.spans = append(r.spans, span)
+}
+
+func (r *Recorder) Ended() []*Span {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*Span{}, r.spans...)
+}
+
+// Start starts a span as a child of the one in ctx, or as a new trace when ctx has none. A request is sampled from its
+// first span, so its New Relic calls are kept or dropped with it.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{name: name, start: time.Now(), onEnd: t.onEnd}
+	rand.Read(span.spanId[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceId = parent.traceId
+		span.parentSpanId = parent.spanId
+		span.recording = parent.recording
+	} else {
+		rand.Read(span.traceId[:])
+		span.recording = sampled(span.traceId, t.sampleRatio)
+	}
+
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// sampled keeps the share ratio of trace IDs, as OpenTelemetry's TraceIDRatioBased sampler does
+func sampled(traceId [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+
+	if ratio <= 0 {
+		return false
+	}
+
+	return binary.BigEndian.Uint64(traceId[8:]) >> 1 < uint64(ratio * (1 << 63))
+}
+
+// End ends span, marking it as failed when err is set
+func End(span *Span, err error) {
+	if span == nil || !span.recording {
+		return
+	}
+
+	span.lock.Lock()
+	span.err = err
+	span.end = time.Now()
+	span.lock.Unlock()
+
+	span.onEnd(span)
+}
+
+// RedactUrl returns uri without its query, which can hold NRQL or keys, and with IDs in its path replaced so spans for
+// different apps and hosts share one name, e.g. /v2/applications/{id}/hosts/{id}/metrics/data.json
+func RedactUrl(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	segments := strings.Split(parsed.Path, "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = "{id}"
+		}
+	}
+
+	// built by hand since url.URL would escape the braces
+	return parsed.Scheme + "://" + parsed.Host + strings.Join(segments, "/")
+}
@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedactUrl(t *testing.T) {
+	tests := map[string]string{
+		"https://api.newrelic.com/v2/applications/1234/hosts/5678/metrics/data.json?names[]=HttpDispatcher": "https://api.newrelic.com/v2/applications/{id}/hosts/{id}/metrics/data.json",
+		"https://insights-api.newrelic.com/v1/accounts/1234/query?nrql=SELECT+count(*)+FROM+Transaction": "https://insights-api.newrelic.com/v1/accounts/{id}/query",
+		"https://api.newrelic.com/v2/applications.json?filter[name]=marketplace-prod": "https://api.newrelic.com/v2/applications.json",
+		"https://api.newrelic.com/graphql": "https://api.newrelic.com/graphql",
+	}
+
+	for uri, expected := range tests {
+		if redacted := RedactUrl(uri); redacted != expected {
+			t.Errorf("Expected %s to be redacted to %s, got %s", uri, expected, redacted)
+		}
+	}
+}
+
+func TestEnd_MarksFailedSpans(t *testing.T) {
+	recorder := Record()
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("New Relic is down"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	if spans[0].ParentSpanID() != spans[1].SpanID() {
+		t.Errorf("Expected the child span to be started under the parent")
+	}
+
+	if spans[0].Err() == nil || spans[0].Err().Error() != "New Relic is down" {
+		t.Errorf("Expected the child span to be failed, got %v", spans[0].Err())
+	}
+
+	if spans[1].Err() != nil {
+		t.Errorf("Expected the parent span to succeed")
+	}
+}
+
+func TestStart_SamplesWholeTraces(t *testing.T) {
+	recorder := &Recorder{}
+	setTracer(&tracer{sampleRatio: 0, onEnd: recorder.add})
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttributes(String("newrelic.app_name", "marketplace"))
+	End(child, nil)
+	End(parent, nil)
+
+	if len(recorder.Ended()) != 0 {
+		t.Errorf("Expected the spans of a trace that is not sampled to be dropped, got %d", len(recorder.Ended()))
+	}
+}
+
+// otlpCollector keeps the spans posted to /v1/traces
+type otlpCollector struct {
+	lock sync.Mutex
+	spans []map[string]interface{}
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	request := otlpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				encoded, _ := json.Marshal(span)
+				decoded := map[string]interface{}{}
+				json.Unmarshal(encoded, &decoded)
+				c.spans = append(c.spans, decoded)
+			}
+		}
+	}
+}
+
+func TestSetup_ExportsToCollector(t *testing.T) {
+	collector := &otlpCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	shutdown, err := Setup(Options{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Insecure: true,
+		SampleRatio: 1,
+		ServiceName: "newrelic-custom-metrics",
+	})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	ctx, parent := Start(context.Background(), "GetExternalMetric", String("provider.metric", "rpm"))
+	_, child := Start(ctx, "newrelic.request", Int("newrelic.attempt", 1))
+	End(child, errors.New("New Relic is down"))
+	End(parent, nil)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if len(collector.spans) != 2 {
+		t.Fatalf("Expected the 2 spans to be exported to the collector on shutdown, got %d", len(collector.spans))
+	}
+
+	exportedChild, exportedParent := collector.spans[0], collector.spans[1]
+	if traceId, _ := hex.DecodeString(exportedChild["traceId"].(string)); len(traceId) != 16 || exportedChild["traceId"] != exportedParent["traceId"] {
+		t.Errorf("Expected both spans in one trace with a hex trace ID, got %v and %v", exportedChild["traceId"], exportedParent["traceId"])
+	}
+
+	if exportedChild["parentSpanId"] != exportedParent["spanId"] {
+		t.Errorf("Expected the request span under the metric span, got %v", exportedChild)
+	}
+
+	status := exportedChild["status"].(map[string]interface{})
+	if status["code"] != float64(otlpStatusError) || status["message"] != "New Relic is down" {
+		t.Errorf("Expected the request span to be failed, got %v", status)
+	}
+
+	attempt := exportedChild["attributes"].([]interface{})[0].(map[string]interface{})
+	if attempt["key"] != "newrelic.attempt" || attempt["value"].(map[string]interface{})["intValue"] != "1" {
+		t.Errorf("Expected the attempt as an OTLP integer, got %v", attempt)
+	}
+}
+
+func TestSetup_DisabledWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(Options{})
+	if err != nil {
+		t.Fatalf("There was an error: %s", err)
+	}
+
+	if _, span := Start(context.Background(), "GetExternalMetric"); span != nil {
+		t.Errorf("Expected no span without an endpoint")
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("There was an error: %s", err)
+	}
+}